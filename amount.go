@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// coinDecimals is the number of decimal places of one coin.
+	coinDecimals = 8
+	// coinUnit is the number of base units in one coin.
+	coinUnit int64 = 100000000
+	// maxMoney is the largest amount that can ever be valid, in base units.
+	maxMoney = 21000000 * coinUnit
+)
+
+// parseAmount parses a decimal coin amount such as "0.1" into base units without
+// going through floating point. Zero, negative and out of range amounts are rejected.
+func parseAmount(src string) (int64, error) {
+	if strings.HasPrefix(src, "-") {
+		return 0, errors.New("the amount can't be negative")
+	}
+	whole, frac := src, ""
+	if i := strings.Index(src, "."); i >= 0 {
+		whole, frac = src[:i], src[i+1:]
+	}
+	if len(whole) == 0 && len(frac) == 0 {
+		return 0, errors.New("the amount is empty")
+	}
+	if len(frac) > coinDecimals {
+		return 0, fmt.Errorf("the amount has more than %d decimal places", coinDecimals)
+	}
+	for _, c := range whole + frac {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid character %q in the amount", c)
+		}
+	}
+	var coins, units int64
+	var err error
+	if len(whole) != 0 {
+		coins, err = strconv.ParseInt(whole, 10, 64)
+		if err != nil || coins > maxMoney/coinUnit {
+			return 0, errors.New("the amount is too large")
+		}
+	}
+	if len(frac) != 0 {
+		frac += strings.Repeat("0", coinDecimals-len(frac))
+		units, err = strconv.ParseInt(frac, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+	amount := coins*coinUnit + units
+	if amount == 0 {
+		return 0, errors.New("the amount must be greater than zero")
+	}
+	if amount > maxMoney {
+		return 0, errors.New("the amount is too large")
+	}
+	return amount, nil
+}
+
+// parseFee parses a fee argument, which unlike other amounts may be zero.
+func parseFee(src string) (int64, error) {
+	if strings.Trim(src, "0.") == "" && strings.Trim(src, ".") != "" {
+		return 0, nil
+	}
+	return parseAmount(src)
+}
+
+// formatAmount renders base units as a decimal coin amount with all decimal places.
+func formatAmount(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/coinUnit, coinDecimals, amount%coinUnit)
+}
+
+// addAmount returns a+b, reporting whether the sum stays within maxMoney.
+func addAmount(a, b int64) (int64, bool) {
+	if a < 0 || b < 0 || a > maxMoney || b > maxMoney-a {
+		return 0, false
+	}
+	return a + b, true
+}
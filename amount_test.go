@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestParseAmount(t *testing.T) {
+	valid := map[string]int64{
+		"0.00000001":  1,
+		"0.1":         10000000,
+		"1":           coinUnit,
+		"1.":          coinUnit,
+		".5":          coinUnit / 2,
+		"12.5":        1250000000,
+		"21000000":    maxMoney,
+		"20999999.99": maxMoney - 1000000,
+	}
+	for src, want := range valid {
+		amount, err := parseAmount(src)
+		if err != nil || amount != want {
+			t.Fatalf("%q parses as %d, %v, want %d", src, amount, err, want)
+		}
+	}
+	for _, src := range []string{
+		"", ".", "0", "0.00000000", "0.000000001", "1.123456789", "-1", "-0.1", "+1",
+		"1e3", "1,5", "1.2.3", " 1", "21000000.00000001", "21000001", "9223372036854775808",
+	} {
+		if amount, err := parseAmount(src); err == nil {
+			t.Fatalf("%q was accepted as %d", src, amount)
+		}
+	}
+}
+
+func TestParseFee(t *testing.T) {
+	for _, src := range []string{"0", "0.0", "0.00000000", "00", ".0"} {
+		fee, err := parseFee(src)
+		if err != nil || fee != 0 {
+			t.Fatalf("the fee %q parses as %d, %v, want 0", src, fee, err)
+		}
+	}
+	if fee, err := parseFee("0.00000001"); err != nil || fee != 1 {
+		t.Fatalf("the fee 0.00000001 parses as %d, %v", fee, err)
+	}
+	for _, src := range []string{"", ".", "-0", "-1", "0.000000001"} {
+		if fee, err := parseFee(src); err == nil {
+			t.Fatalf("the fee %q was accepted as %d", src, fee)
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	cases := map[int64]string{
+		0:             "0.00000000",
+		1:             "0.00000001",
+		-1:            "-0.00000001",
+		coinUnit:      "1.00000000",
+		1250000000:    "12.50000000",
+		maxMoney:      "21000000.00000000",
+		-maxMoney - 1: "-21000000.00000001",
+	}
+	for amount, want := range cases {
+		if got := formatAmount(amount); got != want {
+			t.Fatalf("%d formats as %s, want %s", amount, got, want)
+		}
+		if amount > 0 {
+			if parsed, err := parseAmount(want); err != nil || parsed != amount {
+				t.Fatalf("%s parses back as %d, %v, want %d", want, parsed, err, amount)
+			}
+		}
+	}
+}
+
+func TestAddAmount(t *testing.T) {
+	if sum, ok := addAmount(maxMoney-1, 1); !ok || sum != maxMoney {
+		t.Fatalf("adding up to maxMoney gave %d, %v", sum, ok)
+	}
+	for _, c := range [][2]int64{{maxMoney, 1}, {-1, 1}, {1, -1}, {maxMoney + 1, 0}, {1 << 62, 1 << 62}} {
+		if sum, ok := addAmount(c[0], c[1]); ok {
+			t.Fatalf("%d + %d was accepted as %d", c[0], c[1], sum)
+		}
+	}
+}
@@ -1,13 +1,36 @@
 package main
 
 import (
+	"context"
 	"bytes"
 	"crypto/sha256"
-	"encoding/gob"
 	"fmt"
 	"time"
 )
 
+// merkleTreeVersion is the first block version whose MerkleRoot is a binary merkle tree;
+// earlier blocks hash the concatenation of all TXIDs.
+const merkleTreeVersion = 1
+
+// timeRulesVersion is the first block version whose Nonce is limited to maxNonce
+// and whose TimeStamp must be later than the median time of its ancestors.
+const timeRulesVersion = 2
+
+// canonicalTxVersion is the first block version whose transactions are txVersion
+// transactions; older blocks only hold legacyTxVersion transactions.
+const canonicalTxVersion = 3
+
+// strictEncodingVersion is the first block version whose P-256 signatures and public
+// keys must be two numbers padded to keyFieldSize bytes each, see wallet.go.
+const strictEncodingVersion = 4
+
+// secp256k1Version is the first block version whose compressed public keys are
+// secp256k1 keys.
+const secp256k1Version = 5
+
+// blockVersion is the version of newly mined blocks.
+const blockVersion = secp256k1Version
+
 type Block struct {
 	Version uint64
 	PrevHash []byte
@@ -15,59 +38,110 @@ type Block struct {
 	TimeStamp uint64
 	Bits uint64
 	Nonce uint64
+	Height uint64
 	Hash []byte
 	Transactions []*Transaction
 }
 
-func NewBlock(txs []*Transaction, prevHash []byte) *Block {
+// NewBlock mines a block on top of prevHash with a TimeStamp no earlier than minTimeStamp.
+// Whenever the nonce range is exhausted the miner moves TimeStamp up to the current
+// time, or, if the clock hasn't moved, rolls the extraNonce in the coinbase input.
+func NewBlock(txs []*Transaction, prevHash []byte, height uint64, bits uint64, minTimeStamp uint64) *Block {
+	timeStamp := uint64(time.Now().Unix())
+	if timeStamp < minTimeStamp {
+		timeStamp = minTimeStamp
+	}
 	b := Block{
-		Version:    0,
+		Version:    blockVersion,
 		PrevHash:   prevHash,
 		MerkleRoot: nil, 
-		TimeStamp:  uint64(time.Now().Unix()),
-		Bits:  0, 
+		TimeStamp:  timeStamp,
+		Bits:  bits, 
 		Nonce: 0, 
+		Height: height,
 		Hash:  nil,
 		Transactions: txs,
 	}
-	b.HashTransactionMerkleRoot()
-	fmt.Printf("merkleRoot:%x\n", b.MerkleRoot)
-	pow := NewProofOfWork(&b)
-	hash, nonce := pow.Run()
-	b.Hash = hash
-	b.Nonce = nonce
-	return &b
+	var extraNonce uint64
+	for {
+		b.HashTransactionMerkleRoot()
+		fmt.Printf("merkleRoot:%x\n", b.MerkleRoot)
+		pow := NewProofOfWork(&b)
+		var hash []byte
+		var nonce uint64
+		var err error
+		if miningWorkers <= 1 {
+			hash, nonce, err = pow.Run(context.Background())
+		} else {
+			hash, nonce, err = pow.RunParallel(context.Background(), miningWorkers)
+		}
+		if err == nil {
+			b.Hash = hash
+			b.Nonce = nonce
+			return &b
+		}
+		if err != errNonceExhausted {
+			fmt.Println("Mining failed:", err)
+			return nil
+		}
+
+		now := uint64(time.Now().Unix())
+		if now > b.TimeStamp {
+			fmt.Printf("The nonce range is exhausted, move the timestamp to %d\n", now)
+			b.TimeStamp = now
+			continue
+		}
+		extraNonce++
+		fmt.Printf("The nonce range is exhausted, roll the extraNonce to %d\n", extraNonce)
+		if !b.setExtraNonce(extraNonce) {
+			return nil
+		}
+	}
 }
 
-func (b *Block) Serialize() []byte {
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(b)
-	if err != nil {
-		fmt.Printf("Encode err:", err)
-		return nil
+// setExtraNonce writes extraNonce after the height in the coinbase input and
+// recomputes the coinbase TXID; the caller has to recompute the MerkleRoot.
+func (b *Block) setExtraNonce(extraNonce uint64) bool {
+	if len(b.Transactions) == 0 || !b.Transactions[0].isCoinbaseTx() {
+		fmt.Println("The block has no coinbase to roll the extraNonce in")
+		return false
 	}
-	return buffer.Bytes()
+	coinbase := b.Transactions[0]
+	scriptSig := append(uintToByte(b.Height), uintToByte(extraNonce)...)
+	coinbase.TXInputs[0].ScriptSig = scriptSig
+	coinbase.TXID = coinbase.computeTXID()
+	return true
+}
+
+// Serialize returns the canonical encoding of b.
+func (b *Block) Serialize() []byte {
+	var w canonicalWriter
+	b.encode(&w)
+	return w.Bytes()
 }
 
 func Deserialize(src []byte) *Block {
-	var block Block
-	decoder := gob.NewDecoder(bytes.NewReader(src))
-	err := decoder.Decode(&block)
+	r := canonicalReader{src: src}
+	block := decodeBlock(&r)
+	err := r.finish()
 	if err != nil {
-		fmt.Printf("decode err:", err)
+		fmt.Println("decode err:", err)
 		return nil
 	}
-	return &block
+	return block
 }
 
 func (block *Block) HashTransactionMerkleRoot() {
-	var info [][]byte
-	for _, tx := range block.Transactions {
-		txHashValue := tx.TXID //[]byte
-		info = append(info, txHashValue)
+	if block.Version < merkleTreeVersion {
+		var info [][]byte
+		for _, tx := range block.Transactions {
+			txHashValue := tx.TXID //[]byte
+			info = append(info, txHashValue)
+		}
+		value := bytes.Join(info, []byte{})
+		hash := sha256.Sum256(value)
+		block.MerkleRoot = hash[:]
+		return
 	}
-	value := bytes.Join(info, []byte{})
-	hash := sha256.Sum256(value)
-	block.MerkleRoot = hash[:]
+	block.MerkleRoot = merkleRoot(block.txids())
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func setMaxNonce(t *testing.T, n uint64) {
+	t.Helper()
+	old := maxNonce
+	maxNonce = n
+	t.Cleanup(func() { maxNonce = old })
+}
+
+// newExhaustedCoinbase returns a coinbase for the block at height 1 on top of parent
+// whose header has no nonce up to maxNonce meeting the target.
+func newExhaustedCoinbase(t *testing.T, bc *BlockChain, parent *Block, miner string, timeStamp uint64) *Transaction {
+	t.Helper()
+	for {
+		coinbase := NewCoinbaseTx(miner, "test", 1, 0)
+		probe := Block{Version: blockVersion, PrevHash: parent.Hash, TimeStamp: timeStamp,
+			Bits: bc.calcNextBits(parent), Height: 1, Transactions: []*Transaction{coinbase}}
+		probe.HashTransactionMerkleRoot()
+		_, _, err := NewProofOfWork(&probe).Run(context.Background())
+		if err == errNonceExhausted {
+			return coinbase
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExtraNonceRollsWhenNoncesRunOut(t *testing.T) {
+	setMiningWorkers(t, 1)
+	setMaxNonce(t, 200)
+	miner := newWalletKeyPair().getAddress()
+	bc := newTestChain(t, miner)
+	genesis := bc.GetBlockByHash(bc.tail)
+	// A TimeStamp ahead of the clock makes the miner roll the extraNonce instead.
+	timeStamp := uint64(time.Now().Unix()) + 600
+	coinbase := newExhaustedCoinbase(t, bc, genesis, miner, timeStamp)
+	txid := coinbase.TXID
+
+	block := NewBlock([]*Transaction{coinbase}, genesis.Hash, 1, bc.calcNextBits(genesis), timeStamp)
+	if block == nil {
+		t.Fatal("failed to mine the block")
+	}
+	if block.TimeStamp != timeStamp || block.Nonce > maxNonce {
+		t.Fatalf("the block has the TimeStamp %d and nonce %d", block.TimeStamp, block.Nonce)
+	}
+	scriptSig := block.Transactions[0].TXInputs[0].ScriptSig
+	if len(scriptSig) != 16 || !bytes.Equal(scriptSig[:8], uintToByte(1)) || binary.LittleEndian.Uint64(scriptSig[8:]) == 0 {
+		t.Fatalf("the coinbase input holds %x, want the height and a rolled extraNonce", scriptSig)
+	}
+	if bytes.Equal(block.Transactions[0].TXID, txid) || !bytes.Equal(block.Transactions[0].TXID, block.Transactions[0].computeTXID()) {
+		t.Fatal("the coinbase TXID wasn't recomputed with the extraNonce")
+	}
+	err := bc.ProcessBlock(block)
+	if err != nil {
+		t.Fatal("the block with a rolled extraNonce was rejected:", err)
+	}
+
+	// A block without a coinbase has no extraNonce to roll.
+	if (&Block{Height: 1}).setExtraNonce(1) {
+		t.Fatal("the extraNonce was set without a coinbase")
+	}
+}
+
+func TestRolledFieldsAreBounded(t *testing.T) {
+	miner := newWalletKeyPair().getAddress()
+	bc := newTestChain(t, miner)
+	genesis := bc.GetBlockByHash(bc.tail)
+
+	cases := []struct {
+		name   string
+		modify func(block *Block)
+		want   ErrorCode
+	}{
+		{"a nonce above maxNonce", func(block *Block) {
+			block.Nonce = maxNonce + 1
+			block.Hash = headerHash(block)
+		}, ErrBadNonce},
+		{"a timestamp too far ahead of the clock", func(block *Block) {
+			block.TimeStamp = uint64(time.Now().Unix()) + maxFutureBlockTime + 60
+			remineTestBlock(t, block)
+		}, ErrTimeTooNew},
+	}
+	for _, c := range cases {
+		block := mineTestBlockOn(t, bc, genesis, miner)
+		c.modify(block)
+		err := bc.ValidateBlock(block)
+		if ruleErr, ok := err.(RuleError); !ok || ruleErr.ErrorCode != c.want {
+			t.Fatalf("a block with %s was rejected with %v, want %v", c.name, err, c.want)
+		}
+	}
+}
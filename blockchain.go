@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
-	"crypto/ecdsa"
 	"errors"
 	"fmt"
+	"sort"
 	"github.com/boltdb/bolt"
 )
 
 type BlockChain struct {
 	db   *bolt.DB 
 	tail []byte  
+	// events announces the blocks connected and disconnected by this process.
+	events *EventBus
+	// download tracks the blocks of the best header chain still to be downloaded.
+	download downloadCursor
 }
 
 const genesisInfo = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
@@ -18,6 +22,26 @@ const blockchainDBFile = "blockchain.db"
 const bucketBlock = "bucketBlock"           
 const lastBlockHashKey = "lastBlockHashKey"
 
+// chainIndexes are the buckets derived from the blocks; each one is updated whenever a block is connected.
+var chainIndexes = []struct {
+	bucket string
+	update func(*bolt.Tx, *Block) error
+}{
+	{bucketUTXO, updateUTXOSet},
+	{bucketTxIndex, indexTransactions},
+	{bucketHeight, indexHeight},
+}
+
+// blockIndexes are the buckets that cover every stored block, including the blocks of side chains.
+var blockIndexes = []struct {
+	bucket string
+	update func(*bolt.Tx, *Block) error
+}{
+	{bucketChainWork, indexChainWork},
+	{bucketTips, indexTip},
+	{bucketHeaders, indexHeader},
+}
+
 func CreateBlockChain(address string) error {
 	if isFileExist(blockchainDBFile) {
 		fmt.Println("The file is existed!")
@@ -33,16 +57,35 @@ func CreateBlockChain(address string) error {
 		bucket := tx.Bucket([]byte(bucketBlock))
 
 		if bucket == nil {
-			bucket, err := tx.CreateBucket([]byte(bucketBlock))
+			_, err := tx.CreateBucket([]byte(bucketBlock))
+			if err != nil {
+				return err
+			}
+			for _, index := range chainIndexes {
+				_, err = tx.CreateBucket([]byte(index.bucket))
+				if err != nil {
+					return err
+				}
+			}
+			for _, index := range blockIndexes {
+				_, err = tx.CreateBucket([]byte(index.bucket))
+				if err != nil {
+					return err
+				}
+			}
+
+			err = writeDBVersion(tx, dbVersion)
 			if err != nil {
 				return err
 			}
 
-			coinbase := NewCoinbaseTx(address, genesisInfo)
+			coinbase := NewCoinbaseTx(address, genesisInfo, 0, 0)
 			txs := []*Transaction{coinbase}
-			genesisBlock := NewBlock(txs, nil)
-			bucket.Put(genesisBlock.Hash, genesisBlock.Serialize()) 
-			bucket.Put([]byte(lastBlockHashKey), genesisBlock.Hash)
+			genesisBlock := NewBlock(txs, nil, 0, initialBits, 0)
+			if genesisBlock == nil {
+				return errors.New("failed to mine the genesis block")
+			}
+			return connectBlock(tx, genesisBlock)
 		}
 		return nil
 	})
@@ -54,50 +97,132 @@ func GetBlockChainInstance() (*BlockChain, error) {
 		return nil, errors.New("The flie is not existed, please create it!")
 	}
 	var lastHash []byte 
+	missingIndexes := make(map[string]bool)
 	db, err := bolt.Open(blockchainDBFile, 0600, nil)
 	if err != nil {
 		return nil, err
 	}
+	var version uint64
 	db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketBlock))
+		version = readDBVersion(tx)
 		if bucket == nil {
 			return errors.New("bucket shouldn't be nil")
 		} else {
-			lastHash = bucket.Get([]byte(lastBlockHashKey))
+			lastHash = append([]byte{}, bucket.Get([]byte(lastBlockHashKey))...)
+		}
+		for _, index := range append(blockIndexes, chainIndexes...) {
+			if tx.Bucket([]byte(index.bucket)) == nil {
+				missingIndexes[index.bucket] = true
+			}
+		}
+		// The undo data is written together with the UTXO set.
+		if tx.Bucket([]byte(bucketUndo)) == nil {
+			missingIndexes[bucketUTXO] = true
 		}
 		return nil
 	})
-	bc := BlockChain{db, lastHash}
+	if version != dbVersion {
+		db.Close()
+		return nil, fmt.Errorf("The database format is version %d but version %d is required, please run migrate", version, dbVersion)
+	}
+	bc := BlockChain{db: db, tail: lastHash, events: newEventBus()}
+	for _, index := range append(blockIndexes, chainIndexes...) {
+		if !missingIndexes[index.bucket] {
+			continue
+		}
+		fmt.Printf("The index %s is missing, rebuilding it from the blocks...\n", index.bucket)
+		if isBlockIndex(index.bucket) {
+			err = bc.rebuildBlockIndex(index.bucket, index.update)
+		} else {
+			err = bc.rebuildIndex(index.bucket, index.update)
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
 	return &bc, nil
 }
 
-func (bc *BlockChain) AddBlock(txs1 []*Transaction) error {
-	txs := []*Transaction{}
-
-	fmt.Println("Verify the transaction before adding the block...")
-	for _, tx := range txs1 {
-		if bc.verifyTransaction(tx) {
-			fmt.Printf("The current transaction verification is successful: %x\n", tx.TXID)
-			txs = append(txs, tx)
-		} else {
-			fmt.Printf("The current transaction verification failed: %x\n", tx.TXID)
+// storeBlock stores block and updates the block indexes without changing the main chain.
+func storeBlock(tx *bolt.Tx, block *Block) error {
+	bucket := tx.Bucket([]byte(bucketBlock))
+	if bucket == nil {
+		return errors.New("Bucket shouldn't be nil when adding the block...")
+	}
+	err := bucket.Put(block.Hash, block.Serialize())
+	if err != nil {
+		return err
+	}
+	for _, index := range blockIndexes {
+		err = index.update(tx, block)
+		if err != nil {
+			return err
 		}
 	}
-	lashBlockHash := bc.tail 
-	newBlock := NewBlock(txs, lashBlockHash)
-	err := bc.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketBlock))
-		if bucket == nil {
-			return errors.New("Bucket shouldn't be nil when adding the block...")
+	return nil
+}
+
+// connectBlock stores block as the new tail and updates every chain index in the same bolt transaction.
+func connectBlock(tx *bolt.Tx, block *Block) error {
+	err := storeBlock(tx, block)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte(bucketBlock)).Put([]byte(lastBlockHashKey), block.Hash)
+	if err != nil {
+		return err
+	}
+	for _, index := range chainIndexes {
+		err = index.update(tx, block)
+		if err != nil {
+			return err
 		}
+	}
+	return removeFromMempool(tx, block.Transactions)
+}
 
-		bucket.Put(newBlock.Hash, newBlock.Serialize())
-		bucket.Put([]byte(lastBlockHashKey), newBlock.Hash)
+// AddBlock mines txs into a block on the tail. Nothing is mined if one of them is
+// invalid; its RuleError is returned instead. Later transactions may spend earlier ones.
+func (bc *BlockChain) AddBlock(txs []*Transaction) error {
+	template, err := bc.newBlockTemplate(txs)
+	if err != nil {
+		return err
+	}
+	newBlock := NewBlock(txs, template.PrevHash, template.Height, template.Bits, template.TimeStamp)
+	if newBlock == nil {
+		return errors.New("failed to mine the block")
+	}
+	return bc.ProcessBlock(newBlock)
+}
 
-		bc.tail = newBlock.Hash
-		return nil
-	})
-	return err
+// newBlockTemplate verifies txs and returns the unmined block on top of the tail holding
+// them, with the earliest TimeStamp the block may have.
+func (bc *BlockChain) newBlockTemplate(txs []*Transaction) (*Block, error) {
+	fmt.Println("Verify the transaction before adding the block...")
+	view := newUTXOView(bc)
+	for _, tx := range txs {
+		err := bc.checkTransaction(tx, view)
+		if err != nil {
+			fmt.Printf("The current transaction verification failed: %x\n", tx.TXID)
+			return nil, err
+		}
+		fmt.Printf("The current transaction verification is successful: %x\n", tx.TXID)
+		view.connectTransaction(tx)
+	}
+	lastBlock := bc.GetBlockByHash(bc.tail)
+	if lastBlock == nil {
+		return nil, errors.New("The last block is not found!")
+	}
+	return &Block{
+		Version:      blockVersion,
+		PrevHash:     lastBlock.Hash,
+		TimeStamp:    bc.medianTimePast(lastBlock) + 1,
+		Bits:         bc.calcNextBits(lastBlock),
+		Height:       lastBlock.Height + 1,
+		Transactions: txs,
+	}, nil
 }
 
 type Iterator struct {
@@ -121,12 +246,15 @@ func (it *Iterator) Next() (block *Block) {
 		}
 		blockTmpInfo := bucket.Get(it.currentHash)
 		block = Deserialize(blockTmpInfo)
+		if block == nil {
+			return fmt.Errorf("block %x is missing or corrupt", it.currentHash)
+		}
 		it.currentHash = block.PrevHash
 		return nil
 	})
 
 	if err != nil {
-		fmt.Printf("iterator next err:", err)
+		fmt.Println("iterator next err:", err)
 		return nil
 	}
 	return
@@ -138,56 +266,19 @@ type UTXOInfo struct {
 	TXOutput
 }
 
-func (bc *BlockChain) FindMyUTXO(pubKeyHash []byte) []UTXOInfo {
-	var utxoInfos []UTXOInfo
-	spentUtxos := make(map[string][]int)
-	it := bc.NewIterator()
-	for {
-		block := it.Next()
-		for _, tx := range block.Transactions {
-		LABEL:
-			for outputIndex, output := range tx.TXOutputs {
-				fmt.Println("outputIndex:", outputIndex)
-				if bytes.Equal(output.ScriptPubKeyHash, pubKeyHash) {
-					currentTxid := string(tx.TXID)
-					indexArray := spentUtxos[currentTxid]
-					if len(indexArray) != 0 {
-						for _, spendIndex := range indexArray {
-							if outputIndex == spendIndex {
-								continue LABEL
-							}
-						}
-					}
-					utxoinfo := UTXOInfo{tx.TXID, int64(outputIndex), output}
-					utxoInfos = append(utxoInfos, utxoinfo)
-				}
-			}
-
-			if tx.isCoinbaseTx() {
-				fmt.Println("Discover mining transactions")
-				continue
-			}
-
-			for _, input := range tx.TXInputs {
-				if bytes.Equal(getPubKeyHashFromPubKey(input.PubKey), pubKeyHash) {
-					spentKey := string(input.Txid)
-					spentUtxos[spentKey] = append(spentUtxos[spentKey], int(input.Index))
-				}
-			}
-
-		}
-		if len(block.PrevHash) == 0 {
-			break
-		}
-	}
-	return utxoInfos
-}
-
-func (bc *BlockChain) findNeedUTXO(pubKeyHash []byte, amount float64) (map[string][]int64, float64) {
+func (bc *BlockChain) findNeedUTXO(pubKeyHash []byte, amount int64) (map[string][]int64, int64) {
 	var retMap = make(map[string][]int64)
-	var retValue float64
+	var retValue int64
 	utxoInfos := bc.FindMyUTXO(pubKeyHash)
+	mp, err := NewMempool(bc)
+	if err != nil {
+		fmt.Println("NewMempool err:", err)
+		return retMap, 0
+	}
 	for _, utxoinfo := range utxoInfos {
+		if mp.IsSpent(utxoinfo.Txid, utxoinfo.Index) {
+			continue
+		}
 		retValue += utxoinfo.Value
 		key := string(utxoinfo.Txid)
 		retMap[key] = append(retMap[key], utxoinfo.Index)
@@ -198,52 +289,169 @@ func (bc *BlockChain) findNeedUTXO(pubKeyHash []byte, amount float64) (map[strin
 	return retMap, retValue
 }
 
-func (bc *BlockChain) signTransaction(tx *Transaction, priKey *ecdsa.PrivateKey) bool {
-	fmt.Println("signTransaction start!!!")
+// findPrevTransactions returns the transactions referenced by the inputs of tx keyed by txid,
+// or nil when one of them can't be found.
+func (bc *BlockChain) findPrevTransactions(tx *Transaction) map[string]*Transaction {
 	prevTxs := make(map[string]*Transaction)
 	for _, input := range tx.TXInputs {
 		prevTx := bc.findTransaction(input.Txid)
 		if prevTx == nil {
 			fmt.Println("No valid referenced transactions found")
-			return false
+			return nil
 		}
 		fmt.Println("The referenced transaction was found")
 		prevTxs[string(input.Txid)] = prevTx
 	}
-	return tx.sign(priKey, prevTxs)
+	return prevTxs
+}
+
+func (bc *BlockChain) signTransaction(tx *Transaction, w *wallet) bool {
+	fmt.Println("signTransaction start!!!")
+	prevTxs := bc.findPrevTransactions(tx)
+	if prevTxs == nil {
+		return false
+	}
+	return tx.sign(w, prevTxs)
 }
 
 func (bc *BlockChain) verifyTransaction(tx *Transaction) bool {
 	fmt.Println("verifyTransaction start!!!")
+	err := bc.checkTransaction(tx, newUTXOView(bc))
+	if err != nil {
+		fmt.Println("The transaction is invalid:", err)
+		return false
+	}
+	return true
+}
+
+// checkTransaction checks the inputs, value and signatures of tx against view the
+// way checkBlockInputs does for a block on the tail.
+func (bc *BlockChain) checkTransaction(tx *Transaction, view *UTXOView) error {
 	if tx.isCoinbaseTx() {
 		fmt.Println("Discover mining transactions")
-		return true
+		return nil
 	}
-	prevTxs := make(map[string]*Transaction)
-	for _, input := range tx.TXInputs {
-		prevTx := bc.findTransaction(input.Txid)
-		if prevTx == nil {
-			fmt.Println("No valid referenced transactions found")
-			return false
-		}
-		fmt.Println("The referenced transaction was found")
-		prevTxs[string(input.Txid)] = prevTx
+	prevTxs, err := bc.checkInputs(tx, view)
+	if err != nil {
+		return err
+	}
+	_, err = tx.fee(prevTxs)
+	if err != nil {
+		return ruleError(ErrBadTxValue, "transaction %x: %v", tx.TXID, err)
 	}
-	return tx.verify(prevTxs)
+	if !tx.verify(prevTxs, blockVersion) {
+		return ruleError(ErrBadSignature, "transaction %x has an invalid signature", tx.TXID)
+	}
+	return nil
 }
 
-func (bc *BlockChain) findTransaction(txid []byte) *Transaction {
+// blockHashesFromGenesis returns the hashes of the main chain ordered from genesis to tail.
+func (bc *BlockChain) blockHashesFromGenesis() ([][]byte, error) {
+	var hashes [][]byte
 	it := bc.NewIterator()
 	for {
 		block := it.Next()
-		for _, tx := range block.Transactions {
-			if bytes.Equal(tx.TXID, txid) {
-				return tx
-			}
+		if block == nil {
+			return nil, errors.New("failed to read the block while walking the chain")
 		}
+		hashes = append(hashes, block.Hash)
 		if len(block.PrevHash) == 0 {
 			break
 		}
 	}
-	return nil
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+	return hashes, nil
+}
+
+// rebuildIndex recreates bucketName and replays every block of the main chain from
+// genesis through update.
+func (bc *BlockChain) rebuildIndex(bucketName string, update func(*bolt.Tx, *Block) error) error {
+	hashes, err := bc.blockHashesFromGenesis()
+	if err != nil {
+		return err
+	}
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketName)) != nil {
+			err := tx.DeleteBucket([]byte(bucketName))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucket([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		blockBucket := tx.Bucket([]byte(bucketBlock))
+		for height, hash := range hashes {
+			block := Deserialize(blockBucket.Get(hash))
+			if block == nil {
+				return fmt.Errorf("failed to decode block %x", hash)
+			}
+			// Blocks stored before the Height field existed decode with height 0.
+			if block.Height != uint64(height) {
+				block.Height = uint64(height)
+				err = blockBucket.Put(block.Hash, block.Serialize())
+				if err != nil {
+					return err
+				}
+			}
+			err = update(tx, block)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func isBlockIndex(bucketName string) bool {
+	for _, index := range blockIndexes {
+		if index.bucket == bucketName {
+			return true
+		}
+	}
+	return false
+}
+
+// rebuildBlockIndex recreates bucketName and replays every stored block through
+// update, side chain blocks included, each block after its parent.
+func (bc *BlockChain) rebuildBlockIndex(bucketName string, update func(*bolt.Tx, *Block) error) error {
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketName)) != nil {
+			err := tx.DeleteBucket([]byte(bucketName))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucket([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		// The block indexes only look at headers, so the transactions aren't kept.
+		var headers []*Block
+		err = tx.Bucket([]byte(bucketBlock)).ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, []byte(lastBlockHashKey)) {
+				return nil
+			}
+			block := Deserialize(v)
+			if block == nil {
+				return fmt.Errorf("failed to decode block %x", k)
+			}
+			headers = append(headers, block.Header().toBlock())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(headers, func(i, j int) bool { return headers[i].Height < headers[j].Height })
+		for _, block := range headers {
+			err = update(tx, block)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestReindexUTXORebuildsTheSet(t *testing.T) {
+	miner, payee := newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesisCoinbase := bc.GetBlockByHash(bc.tail).Transactions[0]
+	spend := newTestSpend(t, miner, genesisCoinbase, 0, payee.getAddress())
+	err := bc.ProcessBlock(mineTestBlock(t, bc, miner.getAddress(), spend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	minerBalance, payeeBalance, count := balance(bc, miner), balance(bc, payee), bc.CountUTXOTransactions()
+	if payeeBalance != genesisCoinbase.TXOutputs[0].Value || minerBalance != blockSubsidy(1) {
+		t.Fatalf("the UTXO set holds %d for the miner and %d for the payee", minerBalance, payeeBalance)
+	}
+
+	err = bc.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(bucketUTXO))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte(bucketUTXO))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance(bc, payee) != 0 {
+		t.Fatal("the emptied UTXO set still pays the payee")
+	}
+	err = bc.ReindexUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance(bc, miner) != minerBalance || balance(bc, payee) != payeeBalance || bc.CountUTXOTransactions() != count {
+		t.Fatal("reindexing the UTXO set didn't restore it")
+	}
+}
+
+func TestWalkingStopsAtAMissingBlock(t *testing.T) {
+	miner := newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesis := bc.tail
+	err := bc.ProcessBlock(mineTestBlock(t, bc, miner.getAddress()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bc.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketBlock)).Delete(genesis)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it := bc.NewIterator()
+	if block := it.Next(); block == nil || block.Height != 1 {
+		t.Fatal("the iterator didn't return the tail")
+	}
+	if it.Next() != nil {
+		t.Fatal("the iterator returned a block for the missing genesis block")
+	}
+
+	// The commands walking the chain report the missing block instead of panicking.
+	bc.db.Close()
+	cli := CLI{}
+	cli.print()
+	cli.printTx()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/boltdb/bolt"
+)
+
+// bucketHeaders maps a block hash to its header, for every stored block and for the
+// headers received ahead of their blocks. bestHeaderKey holds the hash of the header
+// with the most cumulative work.
+const bucketHeaders = "bucketHeaders"
+const bestHeaderKey = "bestHeaderKey"
+
+// BlockHeader holds the fields of a block covered by its hash, together with the
+// Height and Hash the block carries.
+type BlockHeader struct {
+	Version    uint64
+	PrevHash   []byte
+	MerkleRoot []byte
+	TimeStamp  uint64
+	Bits       uint64
+	Nonce      uint64
+	Height     uint64
+	Hash       []byte
+}
+
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{b.Version, b.PrevHash, b.MerkleRoot, b.TimeStamp, b.Bits, b.Nonce, b.Height, b.Hash}
+}
+
+// toBlock returns a block without transactions carrying the fields of h, which is
+// all the header rules and the difficulty and time calculations look at.
+func (h *BlockHeader) toBlock() *Block {
+	return &Block{
+		Version:    h.Version,
+		PrevHash:   h.PrevHash,
+		MerkleRoot: h.MerkleRoot,
+		TimeStamp:  h.TimeStamp,
+		Bits:       h.Bits,
+		Nonce:      h.Nonce,
+		Height:     h.Height,
+		Hash:       h.Hash,
+	}
+}
+
+// Serialize returns the canonical encoding of h.
+func (h *BlockHeader) Serialize() []byte {
+	var w canonicalWriter
+	h.encode(&w)
+	return w.Bytes()
+}
+
+func deserializeHeader(src []byte) *BlockHeader {
+	r := canonicalReader{src: src}
+	h := decodeHeader(&r)
+	err := r.finish()
+	if err != nil {
+		fmt.Println("Decode header err:", err)
+		return nil
+	}
+	return h
+}
+
+// indexHeader records the header of block.
+// It must run inside the same bolt transaction that stores the block.
+func indexHeader(tx *bolt.Tx, block *Block) error {
+	return putHeader(tx, block.Header())
+}
+
+// putHeader stores h with its chain work and makes it the best header if no other
+// header has more work; its parent must be stored already.
+func putHeader(tx *bolt.Tx, h *BlockHeader) error {
+	bucket := tx.Bucket([]byte(bucketHeaders))
+	if bucket == nil {
+		return errors.New("headers bucket shouldn't be nil when storing the header")
+	}
+	err := indexChainWork(tx, h.toBlock())
+	if err != nil {
+		return err
+	}
+	err = bucket.Put(h.Hash, h.Serialize())
+	if err != nil {
+		return err
+	}
+	workBucket := tx.Bucket([]byte(bucketChainWork))
+	best := bucket.Get([]byte(bestHeaderKey))
+	work := new(big.Int).SetBytes(workBucket.Get(h.Hash))
+	if best == nil || work.Cmp(new(big.Int).SetBytes(workBucket.Get(best))) > 0 {
+		return bucket.Put([]byte(bestHeaderKey), h.Hash)
+	}
+	return nil
+}
+
+// GetHeaderByHash returns the stored header of hash, falling back to the block for
+// side chain blocks stored before the headers bucket existed.
+func (bc *BlockChain) GetHeaderByHash(hash []byte) *BlockHeader {
+	var h *BlockHeader
+	bc.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(bucketHeaders)); bucket != nil {
+			if data := bucket.Get(hash); data != nil {
+				h = deserializeHeader(data)
+				return nil
+			}
+		}
+		if data := tx.Bucket([]byte(bucketBlock)).Get(hash); data != nil {
+			if block := Deserialize(data); block != nil {
+				h = block.Header()
+			}
+		}
+		return nil
+	})
+	return h
+}
+
+// GetHeaderByHeight returns the header of the main chain block at height.
+func (bc *BlockChain) GetHeaderByHeight(height uint64) *BlockHeader {
+	var hash []byte
+	bc.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(bucketHeight)); bucket != nil {
+			hash = append([]byte{}, bucket.Get(heightToKey(height))...)
+		}
+		return nil
+	})
+	if len(hash) == 0 {
+		return nil
+	}
+	return bc.GetHeaderByHash(hash)
+}
+
+// headerBlock returns the header of hash as a block without transactions, or nil.
+func (bc *BlockChain) headerBlock(hash []byte) *Block {
+	h := bc.GetHeaderByHash(hash)
+	if h == nil {
+		return nil
+	}
+	return h.toBlock()
+}
+
+func (bc *BlockChain) hasBlock(hash []byte) bool {
+	found := false
+	bc.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte(bucketBlock)).Get(hash) != nil
+		return nil
+	})
+	return found
+}
+
+// BestHeader returns the header with the most cumulative work, which is ahead of
+// the tail while the blocks of a longer header chain are still being downloaded.
+func (bc *BlockChain) BestHeader() *BlockHeader {
+	var best []byte
+	bc.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(bucketHeaders)); bucket != nil {
+			best = append([]byte{}, bucket.Get([]byte(bestHeaderKey))...)
+		}
+		return nil
+	})
+	if len(best) == 0 {
+		best = bc.tail
+	}
+	return bc.GetHeaderByHash(best)
+}
+
+// ProcessHeaders checks the header rules for every header, each of which must follow
+// a stored header, and stores the new ones. It returns how many headers were new.
+func (bc *BlockChain) ProcessHeaders(headers []*BlockHeader) (int, error) {
+	added := 0
+	for _, h := range headers {
+		if bc.GetHeaderByHash(h.Hash) != nil {
+			continue
+		}
+		if len(h.PrevHash) == 0 {
+			return added, ruleError(ErrBadGenesis, "the chain already has a genesis block")
+		}
+		if bc.isInvalidBlock(h.PrevHash) {
+			return added, ruleError(ErrInvalidAncestor, "the parent block %x is invalid", h.PrevHash)
+		}
+		err := bc.checkBlockHeader(h.toBlock())
+		if err != nil {
+			return added, err
+		}
+		err = bc.db.Update(func(tx *bolt.Tx) error {
+			return putHeader(tx, h)
+		})
+		if err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
+
+// downloadCursor remembers the headers of the best header chain whose blocks were
+// still missing, so blocksToDownload walks forward from the lowest of them instead
+// of back from the best header on every call.
+type downloadCursor struct {
+	// best is the hash of the best header that pending leads to.
+	best []byte
+	// pending holds the headers from the lowest missing block up to best, lowest first.
+	pending []*BlockHeader
+}
+
+// blocksToDownload returns the headers of the best header chain whose blocks aren't
+// stored yet, lowest first, at most limit of them.
+func (bc *BlockChain) blocksToDownload(limit int) []*BlockHeader {
+	best := bc.BestHeader()
+	if best == nil {
+		return nil
+	}
+	cursor := &bc.download
+	if !bytes.Equal(cursor.best, best.Hash) {
+		// Only the headers since the previous best header are new, unless the best
+		// header moved to another branch; a block is only stored after its parent,
+		// so the walk back ends at the last stored block then.
+		var added []*BlockHeader
+		h := best
+		for h != nil && !bytes.Equal(h.Hash, cursor.best) && !bc.hasBlock(h.Hash) {
+			added = append(added, h)
+			h = bc.GetHeaderByHash(h.PrevHash)
+		}
+		if h == nil || !bytes.Equal(h.Hash, cursor.best) {
+			cursor.pending = nil
+		}
+		for i := len(added) - 1; i >= 0; i-- {
+			cursor.pending = append(cursor.pending, added[i])
+		}
+		cursor.best = best.Hash
+	}
+	for len(cursor.pending) != 0 && bc.hasBlock(cursor.pending[0].Hash) {
+		cursor.pending = cursor.pending[1:]
+	}
+
+	var missing []*BlockHeader
+	for _, h := range cursor.pending {
+		if len(missing) == limit {
+			break
+		}
+		if !bc.hasBlock(h.Hash) {
+			missing = append(missing, h)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// processTestHeaders mines n blocks on top of parent and hands only their headers to
+// ProcessHeaders, one at a time, so each is mined against its stored parent header.
+func processTestHeaders(t *testing.T, bc *BlockChain, parent *Block, miner string, n int) []*Block {
+	t.Helper()
+	var blocks []*Block
+	for i := 0; i < n; i++ {
+		block := mineTestBlockOn(t, bc, parent, miner)
+		added, err := bc.ProcessHeaders([]*BlockHeader{block.Header()})
+		if err != nil || added != 1 {
+			t.Fatalf("the header at height %d was added %d times: %v", block.Height, added, err)
+		}
+		blocks = append(blocks, block)
+		parent = block
+	}
+	return blocks
+}
+
+func checkDownloads(t *testing.T, bc *BlockChain, limit int, want ...*Block) {
+	t.Helper()
+	missing := bc.blocksToDownload(limit)
+	if len(missing) != len(want) {
+		t.Fatalf("%d blocks are to be downloaded, want %d", len(missing), len(want))
+	}
+	for i, h := range missing {
+		if !bytes.Equal(h.Hash, want[i].Hash) || h.Height != want[i].Height {
+			t.Fatalf("download %d is block %x at height %d, want %x at height %d",
+				i, h.Hash, h.Height, want[i].Hash, want[i].Height)
+		}
+	}
+}
+
+func TestInvalidHeadersAreRejected(t *testing.T) {
+	miner := newWalletKeyPair().getAddress()
+	bc := newTestChain(t, miner)
+	genesis := bc.GetBlockByHash(bc.tail)
+	good := processTestHeaders(t, bc, genesis, miner, 1)[0]
+
+	highHash := mineTestBlockOn(t, bc, good, miner).Header()
+	for NewProofOfWork(highHash.toBlock()).IsValid(highHash.Bits) {
+		highHash.Nonce++
+		highHash.Hash = headerHash(highHash.toBlock())
+	}
+	badBits := NewBlock([]*Transaction{NewCoinbaseTx(miner, "test", 2, 0)}, good.Hash, 2, powLimitBits, good.TimeStamp+1)
+	oldTime := mineTestBlockOn(t, bc, good, miner)
+	oldTime.TimeStamp = bc.medianTimePast(good)
+	remineTestBlock(t, oldTime)
+
+	cases := []struct {
+		name   string
+		header *BlockHeader
+		want   ErrorCode
+	}{
+		{"a hash above the target", highHash, ErrHighHash},
+		{"bad bits", badBits.Header(), ErrBadBits},
+		{"a timestamp at the median time past", oldTime.Header(), ErrTimeTooOld},
+	}
+	for _, c := range cases {
+		// The valid header before it is stored, the invalid one isn't.
+		next := mineTestBlockOn(t, bc, good, miner)
+		added, err := bc.ProcessHeaders([]*BlockHeader{good.Header(), c.header, next.Header()})
+		ruleErr, ok := err.(RuleError)
+		if !ok || ruleErr.ErrorCode != c.want || added != 0 {
+			t.Fatalf("a header with %s was rejected with %v after %d headers, want %v", c.name, err, added, c.want)
+		}
+		if bc.GetHeaderByHash(c.header.Hash) != nil || bc.GetHeaderByHash(next.Hash) != nil {
+			t.Fatalf("the header with %s or the one after it was stored", c.name)
+		}
+		if best := bc.BestHeader(); !bytes.Equal(best.Hash, good.Hash) {
+			t.Fatalf("the header with %s changed the best header", c.name)
+		}
+		checkDownloads(t, bc, 10, good)
+	}
+}
+
+func TestBlocksToDownloadInHeightOrder(t *testing.T) {
+	minerA, minerB := newWalletKeyPair().getAddress(), newWalletKeyPair().getAddress()
+	bc := newTestChain(t, minerA)
+	genesis := bc.GetBlockByHash(bc.tail)
+
+	chainA := processTestHeaders(t, bc, genesis, minerA, 5)
+	checkDownloads(t, bc, 10, chainA...)
+	checkDownloads(t, bc, 3, chainA[:3]...)
+
+	err := bc.ProcessBlock(chainA[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloads(t, bc, 10, chainA[1:]...)
+
+	// New headers are appended to the blocks still missing.
+	chainA = append(chainA, processTestHeaders(t, bc, chainA[4], minerA, 2)...)
+	checkDownloads(t, bc, 10, chainA[1:]...)
+	checkDownloads(t, bc, 2, chainA[1:3]...)
+
+	// A header chain with more work replaces them.
+	chainB := processTestHeaders(t, bc, genesis, minerB, 8)
+	checkDownloads(t, bc, 10, chainB...)
+	for i, block := range chainB {
+		err = bc.ProcessBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDownloads(t, bc, 10, chainB[i+1:]...)
+	}
+	if !bytes.Equal(bc.tail, chainB[7].Hash) {
+		t.Fatal("the downloaded header chain isn't the main chain")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// medianTimeBlocks is the number of ancestors whose median TimeStamp a new block must exceed.
+	medianTimeBlocks = 11
+	// maxFutureBlockTime is how many seconds a block TimeStamp may be ahead of the local clock.
+	maxFutureBlockTime = 2 * 60 * 60
+)
+
+// medianTimePast returns the median TimeStamp of prev and its ancestors, up to medianTimeBlocks blocks.
+func (bc *BlockChain) medianTimePast(prev *Block) uint64 {
+	var timestamps []uint64
+	block := prev
+	for block != nil && len(timestamps) < medianTimeBlocks {
+		timestamps = append(timestamps, block.TimeStamp)
+		if len(block.PrevHash) == 0 {
+			break
+		}
+		block = bc.headerBlock(block.PrevHash)
+	}
+	if len(timestamps) == 0 {
+		return 0
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// maxBlockTime returns the latest TimeStamp a block may carry right now.
+func maxBlockTime() uint64 {
+	return uint64(time.Now().Unix()) + maxFutureBlockTime
+}
@@ -16,17 +16,90 @@ The Usage of
 	./blockchain addBlock <ADD INFO> 
 	./blockchain print
 	./blockchain getBalance <ADDRESS>
-	./blockchain send <FROM> <TO> <AMOUNT> <MINER> <DATA>
+	./blockchain send <FROM> <TO> <AMOUNT> <MINER> <DATA> [FEE]
+	./blockchain send --mempool <FROM> <TO> <AMOUNT> [FEE]
+	./blockchain mine <MINER> [DATA]
+	./blockchain printMempool
 	./blockchain createWallet
 	./blockchain listAddress
+	./blockchain encryptWallet
+	./blockchain changePassphrase
+	./blockchain unlock
+	./blockchain newMnemonic [WORDS]
+	./blockchain restoreWallet
+	./blockchain deriveAddress [INDEX]
+	./blockchain dumpPrivKey <ADDRESS>
+	./blockchain importPrivKey <WIF> [--rescan]
 	./blockchain printTx
+	./blockchain supply
+	./blockchain verifyChain
+	./blockchain reindex-utxo
+	./blockchain migrate
+	./blockchain getTx <TXID>
+	./blockchain getBlock <HASH|HEIGHT>
+	./blockchain getBlockCount
+	./blockchain getChainTips
+	./blockchain getTxProof <TXID>
+	./blockchain verifyTxProof <TXID> <BLOCK HASH> <PROOF>
+	./blockchain startNode --port <PORT> [--peer <HOST:PORT>]... [--miner <ADDRESS>] [--ws <PORT>]
+	./blockchain rpcserver
+	./blockchain explorer --port <PORT>
+
+Every node needs its own directory with a copy of the same blockchain.db; the other
+commands can't open the database while a node runs in the same directory.
+--ws streams new blocks, reorganizations and mempool transactions to WebSocket clients
+of ws://localhost:<PORT>/ws, optionally filtered with ?address=<ADDRESS> parameters.
+rpcserver serves JSON-RPC 2.0 on localhost with the rpcuser, rpcpassword and optional
+rpcport (default 8332) set as key=value lines in rpc.conf.
+Once encryptWallet has encrypted wallet.dat, the commands that need a private key ask
+for the passphrase without echoing it, or read it from WALLET_PASSPHRASE; unlock only
+checks it. The rpcserver is unlocked for a while with the unlock method.
+newMnemonic makes wallet.dat an HD wallet whose addresses, including those of later
+createWallet calls, are derived from a new mnemonic of 12 (default) to 24 words along
+m/44'/0'/0'/0/<INDEX>. restoreWallet recovers them from the mnemonic, asked for without
+echoing it or read from WALLET_MNEMONIC, by scanning the outputs of the main chain until
+20 addresses in a row were never paid; payments still in the mempool aren't seen.
+dumpPrivKey and importPrivKey move private keys in Wallet Import Format (compressed);
+--rescan lists the transactions of the imported address and its balance.
+Set MINER_THREADS to the number of mining goroutines, 1 mines deterministically on a single thread.
+INITIAL_SUBSIDY (in coins, default 12.5) and HALVING_INTERVAL (in blocks, default 210000) set the
+subsidy schedule, which every node of a chain must share; it may issue at most 21000000 coins.
 `
 
 func (cli *CLI) Run() {
 	cmds := os.Args
 	if len(cmds) < 2 {
 		fmt.Println("Invalid input parameter, please check!")
-		fmt.Println(Usage)
+		fmt.Print(Usage)
+		return
+	}
+	if threads := os.Getenv("MINER_THREADS"); threads != "" {
+		n, err := strconv.Atoi(threads)
+		if err != nil || n < 1 {
+			fmt.Println("Invalid MINER_THREADS, please check!")
+			return
+		}
+		miningWorkers = n
+	}
+	subsidy, interval := initialSubsidy, halvingInterval
+	if value := os.Getenv("INITIAL_SUBSIDY"); value != "" {
+		amount, err := parseAmount(value)
+		if err != nil {
+			fmt.Println("Invalid INITIAL_SUBSIDY:", err)
+			return
+		}
+		subsidy = amount
+	}
+	if value := os.Getenv("HALVING_INTERVAL"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			fmt.Println("Invalid HALVING_INTERVAL, please check!")
+			return
+		}
+		interval = n
+	}
+	if err := setSubsidySchedule(subsidy, interval); err != nil {
+		fmt.Println("Invalid subsidy schedule:", err)
 		return
 	}
 	switch cmds[1] {
@@ -58,26 +131,236 @@ func (cli *CLI) Run() {
 		cli.getBalance(address)
 	case "send":
 		fmt.Println("Send command called")
-		if len(cmds) != 7 {
+		if len(cmds) > 2 && cmds[2] == "--mempool" {
+			if len(cmds) != 6 && len(cmds) != 7 {
+				fmt.Println("Invalid input parameter, please check!")
+				return
+			}
+			amount, err := parseAmount(cmds[5])
+			if err != nil {
+				fmt.Println("Invalid amount:", err)
+				return
+			}
+			var fee int64
+			if len(cmds) == 7 {
+				fee, err = parseFee(cmds[6])
+				if err != nil {
+					fmt.Println("Invalid fee:", err)
+					return
+				}
+			}
+			cli.sendToMempool(cmds[3], cmds[4], amount, fee)
+			return
+		}
+		if len(cmds) != 7 && len(cmds) != 8 {
 			fmt.Println("Invalid input parameter, please check!")
 			return
 		}
 		from := cmds[2]
 		to := cmds[3]
-		amount, _ := strconv.ParseFloat(cmds[4], 64)
+		amount, err := parseAmount(cmds[4])
+		if err != nil {
+			fmt.Println("Invalid amount:", err)
+			return
+		}
+		var fee int64
+		if len(cmds) == 8 {
+			fee, err = parseFee(cmds[7])
+			if err != nil {
+				fmt.Println("Invalid fee:", err)
+				return
+			}
+		}
 		miner := cmds[5]
 		data := cmds[6]
-		cli.send(from, to, amount, miner, data)
+		cli.send(from, to, amount, fee, miner, data)
+	case "mine":
+		fmt.Println("Mine command called")
+		if len(cmds) != 3 && len(cmds) != 4 {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		data := ""
+		if len(cmds) == 4 {
+			data = cmds[3]
+		}
+		cli.mine(cmds[2], data)
+	case "printMempool":
+		cli.printMempool()
 	case "createWallet":
 		fmt.Println("Createwallet command called")
 		cli.createWallet()
 	case "listAddress":
 		fmt.Println("Listaddress command called")
 		cli.listAddress()
+	case "encryptWallet":
+		fmt.Println("Encrypt wallet command called")
+		cli.encryptWallet()
+	case "changePassphrase":
+		fmt.Println("Change passphrase command called")
+		cli.changePassphrase()
+	case "unlock":
+		fmt.Println("Unlock command called")
+		cli.unlock()
+	case "newMnemonic":
+		fmt.Println("New mnemonic command called")
+		if len(cmds) != 2 && len(cmds) != 3 {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		words := 12
+		if len(cmds) == 3 {
+			var err error
+			words, err = strconv.Atoi(cmds[2])
+			if err != nil {
+				fmt.Println("Invalid number of words, please check!")
+				return
+			}
+		}
+		cli.newMnemonic(words)
+	case "restoreWallet":
+		fmt.Println("Restore wallet command called")
+		if len(cmds) != 2 {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		cli.restoreWallet()
+	case "deriveAddress":
+		fmt.Println("Derive address command called")
+		if len(cmds) != 2 && len(cmds) != 3 {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		index := int64(-1)
+		if len(cmds) == 3 {
+			i, err := strconv.ParseUint(cmds[2], 10, 31)
+			if err != nil {
+				fmt.Println("Invalid index, please check!")
+				return
+			}
+			index = int64(i)
+		}
+		cli.deriveAddress(index)
+	case "dumpPrivKey":
+		fmt.Println("Dump private key command called")
+		if len(cmds) != 3 {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		cli.dumpPrivKey(cmds[2])
+	case "importPrivKey":
+		fmt.Println("Import private key command called")
+		if len(cmds) != 3 && (len(cmds) != 4 || cmds[3] != "--rescan") {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		cli.importPrivKey(cmds[2], len(cmds) == 4)
 	case "printTx":
 		cli.printTx()
+	case "getTx":
+		fmt.Println("Get transaction command called")
+		if len(cmds) != 3 {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		cli.getTx(cmds[2])
+	case "getBlock":
+		fmt.Println("Get block command called")
+		if len(cmds) != 3 {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		cli.getBlock(cmds[2])
+	case "getBlockCount":
+		cli.getBlockCount()
+	case "getChainTips":
+		cli.getChainTips()
+	case "getTxProof":
+		fmt.Println("Get transaction proof command called")
+		if len(cmds) != 3 {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		cli.getTxProof(cmds[2])
+	case "verifyTxProof":
+		fmt.Println("Verify transaction proof command called")
+		if len(cmds) != 5 {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		cli.verifyTxProof(cmds[2], cmds[3], cmds[4])
+	case "supply":
+		fmt.Println("Supply command called")
+		cli.supply()
+	case "verifyChain":
+		fmt.Println("Verify chain command called")
+		cli.verifyChain()
+	case "reindex-utxo":
+		fmt.Println("Reindex UTXO command called")
+		cli.reindexUTXO()
+	case "migrate":
+		fmt.Println("Migrate command called")
+		cli.migrate()
+	case "startNode":
+		fmt.Println("Start node command called")
+		var port int
+		var seeds []string
+		var miner string
+		var wsPort int
+		for i := 2; i < len(cmds); i += 2 {
+			if i+1 >= len(cmds) {
+				fmt.Println("Invalid input parameter, please check!")
+				return
+			}
+			var err error
+			switch cmds[i] {
+			case "--port":
+				port, err = strconv.Atoi(cmds[i+1])
+				if err != nil || port <= 0 || port > 65535 {
+					fmt.Println("Invalid port, please check!")
+					return
+				}
+			case "--peer":
+				seeds = append(seeds, cmds[i+1])
+			case "--miner":
+				miner = cmds[i+1]
+			case "--ws":
+				wsPort, err = strconv.Atoi(cmds[i+1])
+				if err != nil || wsPort <= 0 || wsPort > 65535 {
+					fmt.Println("Invalid WebSocket port, please check!")
+					return
+				}
+			default:
+				fmt.Println("Invalid input parameter, please check!")
+				return
+			}
+		}
+		if port == 0 {
+			fmt.Println("The --port parameter is required!")
+			return
+		}
+		cli.startNode(port, seeds, miner, wsPort)
+	case "rpcserver":
+		fmt.Println("RPC server command called")
+		if len(cmds) != 2 {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		cli.rpcServer()
+	case "explorer":
+		fmt.Println("Explorer command called")
+		if len(cmds) != 4 || cmds[2] != "--port" {
+			fmt.Println("Invalid input parameter, please check!")
+			return
+		}
+		port, err := strconv.Atoi(cmds[3])
+		if err != nil || port <= 0 || port > 65535 {
+			fmt.Println("Invalid port, please check!")
+			return
+		}
+		cli.explorer(port)
 	default:
 		fmt.Println("Invalid input parameter, please check!")
-		fmt.Println(Usage)
+		fmt.Print(Usage)
 	}
 }
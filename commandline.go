@@ -1,6 +1,11 @@
 package main
 
-import "fmt"
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+)
 
 
 func (cli *CLI) addBlock(data string) {
@@ -30,17 +35,11 @@ func (cli *CLI) print() {
 	it := bc.NewIterator()
 	for {
 		block := it.Next()
-		fmt.Printf("\n++++++++++++++++++++++\n")
-		fmt.Printf("Version : %d\n", block.Version)
-		fmt.Printf("PrevHash : %x\n", block.PrevHash)
-		fmt.Printf("MerkleRoot : %x\n", block.MerkleRoot)
-		fmt.Printf("TimeStamp : %d\n", block.TimeStamp)
-		fmt.Printf("Bits : %d\n", block.Bits)
-		fmt.Printf("Nonce : %d\n", block.Nonce)
-		fmt.Printf("Hash : %x\n", block.Hash)
-		fmt.Printf("Data : %s\n", block.Transactions[0].TXInputs[0].ScriptSig)
-		pow := NewProofOfWork(block)
-		fmt.Printf("IsValid: %v\n", pow.IsValid())
+		if block == nil {
+			fmt.Println("print err: failed to read the block while walking the chain")
+			return
+		}
+		printBlock(bc, block)
 		if block.PrevHash == nil {
 			fmt.Println("Blockchain traversal is over!")
 			break
@@ -48,6 +47,21 @@ func (cli *CLI) print() {
 	}
 }
 
+func printBlock(bc *BlockChain, block *Block) {
+	fmt.Printf("\n++++++++++++++++++++++\n")
+	fmt.Printf("Version : %d\n", block.Version)
+	fmt.Printf("PrevHash : %x\n", block.PrevHash)
+	fmt.Printf("MerkleRoot : %x\n", block.MerkleRoot)
+	fmt.Printf("TimeStamp : %d\n", block.TimeStamp)
+	fmt.Printf("Bits : %08x\n", block.Bits)
+	fmt.Printf("Nonce : %d\n", block.Nonce)
+	fmt.Printf("Height : %d\n", block.Height)
+	fmt.Printf("Hash : %x\n", block.Hash)
+	fmt.Printf("Data : %s\n", block.Transactions[0].TXInputs[0].PubKey)
+	pow := NewProofOfWork(block)
+	fmt.Printf("IsValid: %v\n", pow.IsValid(bc.expectedBits(block)))
+}
+
 func (cli *CLI) getBalance(address string) {
 	if !isValidAddress(address) {
 		fmt.Println("The address is invalid, the invalid address is: ", address)
@@ -61,14 +75,14 @@ func (cli *CLI) getBalance(address string) {
 	defer bc.db.Close()
 	pubKeyHash := getPubKeyHashFromAddress(address)
 	utxoinfos := bc.FindMyUTXO(pubKeyHash)
-	total := 0.0
+	var total int64
 	for _, utxo := range utxoinfos {
 		total += utxo.TXOutput.Value
 	}
-	fmt.Printf("'%s''s amount is: %f\n", address, total)
+	fmt.Printf("'%s''s amount is: %s\n", address, formatAmount(total))
 }
 
-func (cli *CLI) send(from, to string, amount float64, miner, data string) {
+func (cli *CLI) send(from, to string, amount, fee int64, miner, data string) {
 	if !isValidAddress(from) {
         fmt.Println("from is invalid, the invalid address is: ", from)
 		return
@@ -87,24 +101,36 @@ func (cli *CLI) send(from, to string, amount float64, miner, data string) {
 		return
 	}
 	defer bc.db.Close()
-	coinbaseTx := NewCoinbaseTx(miner, data)
-	txs := []*Transaction{coinbaseTx}
-	tx := NewTransaction(from, to, amount, bc)
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		fmt.Println("send err:", err)
+		return
+	}
+	wm := openWallet()
+	if wm == nil {
+		return
+	}
+	var transfers []*Transaction
+	tx := NewTransaction(from, to, amount, fee, bc, wm)
 	if tx != nil {
 		fmt.Println("Found a valid transfer transaction!")
-		txs = append(txs, tx)
+		transfers = append(transfers, tx)
 	} else {
 		fmt.Println("Note that if an invalid transfer transaction is found, it will not be added to the block!")
+		fee = 0
 	}
+	coinbaseTx := NewCoinbaseTx(miner, data, height+1, fee)
+	txs := append([]*Transaction{coinbaseTx}, transfers...)
 	err = bc.AddBlock(txs)
 	if err != nil {
-		fmt.Println("Failed to add block, transfer failed!")
+		fmt.Println("Failed to add block, transfer failed:", err)
+		return
 	}
 	fmt.Println("The block is added successfully and the transfer is successful!")
 }
 
 func (cli *CLI) createWallet() {
-	wm := NewWalletManager()
+	wm := openWallet()
 	if wm == nil {
 		fmt.Println("createWallet failed!")
 		return
@@ -139,6 +165,10 @@ func (cli *CLI) printTx() {
 	it := bc.NewIterator()
 	for {
 		block := it.Next()
+		if block == nil {
+			fmt.Println("printTx err: failed to read the block while walking the chain")
+			return
+		}
 		fmt.Println("\n+++++++++++++++++ block +++++++++++++++")
 
 		for _, tx := range block.Transactions {
@@ -150,3 +180,628 @@ func (cli *CLI) printTx() {
 		}
 	}
 }
+
+func (cli *CLI) reindexUTXO() {
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("reindexUTXO err:", err)
+		return
+	}
+	defer bc.db.Close()
+	err = bc.ReindexUTXO()
+	if err != nil {
+		fmt.Println("ReindexUTXO failed:", err)
+		return
+	}
+	fmt.Printf("Finished! There are %d transactions in the UTXO set.\n", bc.CountUTXOTransactions())
+}
+
+func (cli *CLI) getTx(txidStr string) {
+	txid, err := hex.DecodeString(txidStr)
+	if err != nil {
+		fmt.Println("The txid is invalid:", err)
+		return
+	}
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("getTx err:", err)
+		return
+	}
+	defer bc.db.Close()
+	block, position := bc.findTransactionBlock(txid)
+	if block == nil {
+		fmt.Printf("Transaction %x was not found!\n", txid)
+		return
+	}
+	fmt.Println(block.Transactions[position])
+	fmt.Printf("\nContained in block %x at position %d\n", block.Hash, position)
+	printBlock(bc, block)
+}
+
+func (cli *CLI) getBlock(hashOrHeight string) {
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("getBlock err:", err)
+		return
+	}
+	defer bc.db.Close()
+	var block *Block
+	if height, err := strconv.ParseUint(hashOrHeight, 10, 64); err == nil && len(hashOrHeight) < 64 {
+		block = bc.GetBlockByHeight(height)
+	} else {
+		hash, err := hex.DecodeString(hashOrHeight)
+		if err != nil {
+			fmt.Println("The block hash is invalid:", err)
+			return
+		}
+		block = bc.GetBlockByHash(hash)
+	}
+	if block == nil {
+		fmt.Println("The block was not found:", hashOrHeight)
+		return
+	}
+	printBlock(bc, block)
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+}
+
+func (cli *CLI) getBlockCount() {
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("getBlockCount err:", err)
+		return
+	}
+	defer bc.db.Close()
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		return
+	}
+	fmt.Printf("Block count: %d, best height: %d\n", height+1, height)
+}
+
+func (cli *CLI) getTxProof(txidStr string) {
+	txid, err := hex.DecodeString(txidStr)
+	if err != nil {
+		fmt.Println("The txid is invalid:", err)
+		return
+	}
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("getTxProof err:", err)
+		return
+	}
+	defer bc.db.Close()
+	block, _ := bc.findTransactionBlock(txid)
+	if block == nil {
+		fmt.Printf("Transaction %x was not found!\n", txid)
+		return
+	}
+	proof, err := block.NewMerkleProof(txid)
+	if err != nil {
+		fmt.Println("NewMerkleProof failed:", err)
+		return
+	}
+	fmt.Printf("Block : %x\n", block.Hash)
+	fmt.Printf("MerkleRoot : %x\n", block.MerkleRoot)
+	fmt.Printf("Position : %d\n", proof.Position)
+	for i, hash := range proof.Branch {
+		fmt.Printf("Branch[%d] : %x\n", i, hash)
+	}
+	fmt.Printf("Proof : %s\n", proof)
+}
+
+func (cli *CLI) verifyTxProof(txidStr, blockHashStr, proofStr string) {
+	txid, err := hex.DecodeString(txidStr)
+	if err != nil {
+		fmt.Println("The txid is invalid:", err)
+		return
+	}
+	blockHash, err := hex.DecodeString(blockHashStr)
+	if err != nil {
+		fmt.Println("The block hash is invalid:", err)
+		return
+	}
+	proof, err := parseMerkleProof(txid, proofStr)
+	if err != nil {
+		fmt.Println("The proof is invalid:", err)
+		return
+	}
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("verifyTxProof err:", err)
+		return
+	}
+	defer bc.db.Close()
+	block := bc.GetBlockByHash(blockHash)
+	if block == nil {
+		fmt.Printf("Block %x was not found!\n", blockHash)
+		return
+	}
+	if proof.Verify(block.MerkleRoot) {
+		fmt.Printf("The proof is valid, transaction %x is included in block %x\n", txid, blockHash)
+	} else {
+		fmt.Printf("The proof is invalid for block %x\n", blockHash)
+	}
+}
+
+func (cli *CLI) migrate() {
+	err := MigrateBlockChain()
+	if err != nil {
+		fmt.Println("MigrateBlockChain failed:", err)
+		return
+	}
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("migrate err:", err)
+		return
+	}
+	defer bc.db.Close()
+	fmt.Println("Finished!")
+}
+
+func (cli *CLI) supply() {
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("supply err:", err)
+		return
+	}
+	defer bc.db.Close()
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		return
+	}
+	next := nextHalvingHeight(height)
+	fmt.Printf("Best height : %d\n", height)
+	fmt.Printf("Total issued : %s\n", formatAmount(totalSubsidy(height)))
+	fmt.Printf("Current subsidy : %s\n", formatAmount(blockSubsidy(height+1)))
+	fmt.Printf("Next halving height : %d (%d blocks left)\n", next, next-height)
+	fmt.Printf("Subsidy after halving : %s\n", formatAmount(blockSubsidy(next)))
+}
+
+func (cli *CLI) verifyChain() {
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("verifyChain err:", err)
+		return
+	}
+	defer bc.db.Close()
+	block, err := bc.VerifyChain()
+	if err != nil && block == nil {
+		fmt.Println("VerifyChain failed:", err)
+		return
+	}
+	if block != nil {
+		fmt.Printf("Invalid block at height %d, hash %x\n", block.Height, block.Hash)
+		fmt.Println("Reason:", err)
+		return
+	}
+	height, _ := bc.GetBestHeight()
+	fmt.Printf("All %d blocks are valid!\n", height+1)
+}
+
+func (cli *CLI) sendToMempool(from, to string, amount, fee int64) {
+	if !isValidAddress(from) {
+		fmt.Println("from is invalid, the invalid address is: ", from)
+		return
+	}
+	if !isValidAddress(to) {
+		fmt.Println("to is invalid, the invalid address is: ", to)
+		return
+	}
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("send err:", err)
+		return
+	}
+	defer bc.db.Close()
+	mp, err := NewMempool(bc)
+	if err != nil {
+		fmt.Println("NewMempool err:", err)
+		return
+	}
+	wm := openWallet()
+	if wm == nil {
+		return
+	}
+	tx := NewTransaction(from, to, amount, fee, bc, wm)
+	if tx == nil {
+		fmt.Println("Failed to create the transfer transaction!")
+		return
+	}
+	err = mp.AddTransaction(tx)
+	if err != nil {
+		fmt.Println("The transaction was rejected by the mempool:", err)
+		return
+	}
+	fmt.Printf("Transaction %x is waiting in the mempool to be mined!\n", tx.TXID)
+}
+
+func (cli *CLI) mine(miner, data string) {
+	if !isValidAddress(miner) {
+		fmt.Println("miner is invalid, the invalid address is: ", miner)
+		return
+	}
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("mine err:", err)
+		return
+	}
+	defer bc.db.Close()
+	block, err := bc.MinePendingTransactions(miner, data)
+	if err != nil {
+		fmt.Println("Failed to add block:", err)
+		return
+	}
+	fmt.Printf("The block is added successfully at height %d!\n", block.Height)
+}
+
+func (cli *CLI) printMempool() {
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("printMempool err:", err)
+		return
+	}
+	defer bc.db.Close()
+	mp, err := NewMempool(bc)
+	if err != nil {
+		fmt.Println("NewMempool err:", err)
+		return
+	}
+	txs := mp.Transactions()
+	fmt.Printf("There are %d pending transactions\n", len(txs))
+	for _, tx := range txs {
+		fmt.Println(tx)
+	}
+}
+
+func (cli *CLI) getChainTips() {
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("getChainTips err:", err)
+		return
+	}
+	defer bc.db.Close()
+	tips, err := bc.GetChainTips()
+	if err != nil {
+		fmt.Println("GetChainTips err:", err)
+		return
+	}
+	for _, tip := range tips {
+		fmt.Printf("height: %d, hash: %x, branchlen: %d, status: %s\n", tip.Height, tip.Hash, tip.BranchLen, tip.Status)
+	}
+}
+
+func (cli *CLI) startNode(port int, seeds []string, miner string, wsPort int) {
+	if miner != "" && !isValidAddress(miner) {
+		fmt.Println("miner is invalid, the invalid address is: ", miner)
+		return
+	}
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("startNode err:", err)
+		return
+	}
+	defer bc.db.Close()
+	if wsPort != 0 {
+		notifier, err := startNotifier(bc.events, wsPort)
+		if err != nil {
+			fmt.Println("startNode err:", err)
+			return
+		}
+		defer notifier.Close()
+	}
+	server := NewServer(bc, fmt.Sprintf("localhost:%d", port), miner)
+	err = server.Start(seeds)
+	if err != nil {
+		fmt.Println("startNode err:", err)
+	}
+}
+
+func (cli *CLI) rpcServer() {
+	config, err := loadRPCConfig()
+	if err != nil {
+		fmt.Println("rpcServer err:", err)
+		return
+	}
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("rpcServer err:", err)
+		return
+	}
+	defer bc.db.Close()
+	server := NewRPCServer(bc, config)
+	err = server.Start()
+	if err != nil {
+		fmt.Println("rpcServer err:", err)
+	}
+}
+
+func (cli *CLI) explorer(port int) {
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("explorer err:", err)
+		return
+	}
+	defer bc.db.Close()
+	err = NewExplorer(bc).Start(port)
+	if err != nil {
+		fmt.Println("explorer err:", err)
+	}
+}
+
+// openWallet opens wallet.dat and unlocks it with its passphrase if it is encrypted.
+func openWallet() *WalletManager {
+	wm := NewWalletManager()
+	if wm == nil {
+		fmt.Println("Failed to open wallet!")
+		return nil
+	}
+	if !wm.isEncrypted() {
+		return wm
+	}
+	passphrase, err := readPassphrase("Wallet passphrase: ")
+	if err != nil {
+		fmt.Println("Read passphrase err:", err)
+		return nil
+	}
+	err = wm.unlock(passphrase)
+	if err != nil {
+		fmt.Println("Unlock the wallet err:", err)
+		return nil
+	}
+	return wm
+}
+
+// askNewPassphrase asks for a new passphrase twice.
+func askNewPassphrase() (string, error) {
+	passphrase, err := askPassphrase("New wallet passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	again, err := askPassphrase("Repeat the new passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != again {
+		return "", errors.New("the passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+func (cli *CLI) encryptWallet() {
+	wm := NewWalletManager()
+	if wm == nil {
+		fmt.Println("Failed to open wallet!")
+		return
+	}
+	if wm.isEncrypted() {
+		fmt.Println("The wallet is already encrypted, use changePassphrase!")
+		return
+	}
+	passphrase, err := askNewPassphrase()
+	if err != nil {
+		fmt.Println("encryptWallet err:", err)
+		return
+	}
+	err = wm.encrypt(passphrase)
+	if err != nil {
+		fmt.Println("encryptWallet err:", err)
+		return
+	}
+	fmt.Printf("The %d private keys of the wallet are encrypted!\n", len(wm.Wallets))
+}
+
+func (cli *CLI) changePassphrase() {
+	wm := NewWalletManager()
+	if wm == nil {
+		fmt.Println("Failed to open wallet!")
+		return
+	}
+	if !wm.isEncrypted() {
+		fmt.Println("The wallet isn't encrypted, use encryptWallet!")
+		return
+	}
+	oldPassphrase, err := readPassphrase("Wallet passphrase: ")
+	if err != nil {
+		fmt.Println("changePassphrase err:", err)
+		return
+	}
+	err = wm.unlock(oldPassphrase)
+	if err != nil {
+		fmt.Println("changePassphrase err:", err)
+		return
+	}
+	newPassphrase, err := askNewPassphrase()
+	if err != nil {
+		fmt.Println("changePassphrase err:", err)
+		return
+	}
+	err = wm.changePassphrase(oldPassphrase, newPassphrase)
+	if err != nil {
+		fmt.Println("changePassphrase err:", err)
+		return
+	}
+	fmt.Println("The wallet passphrase is changed!")
+}
+
+// unlock checks the passphrase of an encrypted wallet. Every command that needs a
+// private key unlocks the wallet on its own, and so does the unlock RPC method for
+// the rpcserver.
+func (cli *CLI) unlock() {
+	wm := NewWalletManager()
+	if wm == nil {
+		fmt.Println("Failed to open wallet!")
+		return
+	}
+	if !wm.isEncrypted() {
+		fmt.Println("The wallet isn't encrypted!")
+		return
+	}
+	passphrase, err := readPassphrase("Wallet passphrase: ")
+	if err != nil {
+		fmt.Println("unlock err:", err)
+		return
+	}
+	err = wm.unlock(passphrase)
+	if err != nil {
+		fmt.Println("unlock err:", err)
+		return
+	}
+	fmt.Printf("The passphrase unlocks the %d private keys of the wallet!\n", len(wm.Wallets))
+}
+
+func (cli *CLI) newMnemonic(words int) {
+	wm := openWallet()
+	if wm == nil {
+		return
+	}
+	if wm.isHD() {
+		fmt.Println("The wallet already has an HD seed, its mnemonic can't be replaced!")
+		return
+	}
+	mnemonic, err := newMnemonic(words)
+	if err != nil {
+		fmt.Println("newMnemonic err:", err)
+		return
+	}
+	err = wm.setMnemonic(mnemonic)
+	if err != nil {
+		fmt.Println("newMnemonic err:", err)
+		return
+	}
+	address, err := wm.deriveAddress(0)
+	if err != nil {
+		fmt.Println("newMnemonic err:", err)
+		return
+	}
+	fmt.Println("Write down the mnemonic and keep it secret, it restores every address the wallet derives:")
+	fmt.Println(mnemonic)
+	fmt.Printf("The first address %s is: %s\n", hdPath(0), address)
+}
+
+// restoreWallet recovers the addresses of a mnemonic that were paid on the chain; the
+// mnemonic is read with readMnemonic.
+func (cli *CLI) restoreWallet() {
+	mnemonic, err := readMnemonic()
+	if err != nil {
+		fmt.Println("restoreWallet err:", err)
+		return
+	}
+	wm := openWallet()
+	if wm == nil {
+		return
+	}
+	err = wm.setMnemonic(mnemonic)
+	if err != nil {
+		fmt.Println("restoreWallet err:", err)
+		return
+	}
+	used := make(map[string]bool)
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("The chain can't be scanned, only the first address is restored:", err)
+	} else {
+		used, err = bc.usedPubKeyHashes()
+		bc.db.Close()
+		if err != nil {
+			fmt.Println("restoreWallet err:", err)
+			return
+		}
+	}
+	count, err := wm.discoverAddresses(used)
+	if err != nil {
+		fmt.Println("restoreWallet err:", err)
+		return
+	}
+	if wm.nextIndex == 0 {
+		_, err = wm.deriveAddress(0)
+		if err != nil {
+			fmt.Println("restoreWallet err:", err)
+			return
+		}
+	}
+	fmt.Printf("Found %d used addresses, the wallet holds the first %d addresses of the mnemonic:\n", count, wm.nextIndex)
+	for i := uint32(0); i < wm.nextIndex; i++ {
+		w, err := wm.deriveKey(i)
+		if err != nil {
+			fmt.Println("restoreWallet err:", err)
+			return
+		}
+		fmt.Printf("%s %s\n", hdPath(i), w.getAddress())
+	}
+}
+
+// deriveAddress adds the address at index to an HD wallet, or the next address when
+// index is negative.
+func (cli *CLI) deriveAddress(index int64) {
+	wm := openWallet()
+	if wm == nil {
+		return
+	}
+	if index < 0 {
+		index = int64(wm.nextIndex)
+	}
+	address, err := wm.deriveAddress(uint32(index))
+	if err != nil {
+		fmt.Println("deriveAddress err:", err)
+		return
+	}
+	fmt.Printf("The address %s is: %s\n", hdPath(uint32(index)), address)
+}
+
+func (cli *CLI) dumpPrivKey(address string) {
+	if !isValidAddress(address) {
+		fmt.Println("The address is invalid, the invalid address is: ", address)
+		return
+	}
+	wm := openWallet()
+	if wm == nil {
+		return
+	}
+	wif, err := wm.dumpPrivKey(address)
+	if err != nil {
+		fmt.Println("dumpPrivKey err:", err)
+		return
+	}
+	fmt.Println(wif)
+}
+
+// importPrivKey adds the key of wif to the wallet. With rescan the main chain is
+// scanned for the transactions of its address, whose balance is then printed.
+func (cli *CLI) importPrivKey(wif string, rescan bool) {
+	wm := openWallet()
+	if wm == nil {
+		return
+	}
+	address, err := wm.importPrivKey(wif)
+	if err != nil {
+		fmt.Println("importPrivKey err:", err)
+		return
+	}
+	fmt.Println("The imported address is:", address)
+	if !rescan {
+		return
+	}
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		fmt.Println("rescan err:", err)
+		return
+	}
+	defer bc.db.Close()
+	pubKeyHash := getPubKeyHashFromAddress(address)
+	history, err := bc.addressHistory(pubKeyHash)
+	if err != nil {
+		fmt.Println("rescan err:", err)
+		return
+	}
+	fmt.Printf("Found %d transactions of %s on the main chain\n", len(history), address)
+	for _, item := range history {
+		fmt.Printf("height: %d, txid: %s, received: %s, sent: %s\n", item.Height, item.Txid, item.Received, item.Sent)
+	}
+	var total int64
+	for _, utxo := range bc.FindMyUTXO(pubKeyHash) {
+		total += utxo.Value
+	}
+	fmt.Printf("'%s''s amount is: %s\n", address, formatAmount(total))
+}
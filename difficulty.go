@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+const (
+	// initialBits is the compact form of the fixed target used before retargeting existed.
+	initialBits = 0x1f010000
+	// powLimitBits is the compact form of the easiest target a block may use.
+	powLimitBits = 0x1f100000
+	// retargetInterval is the number of blocks between difficulty adjustments.
+	retargetInterval = 10
+	// targetBlockSpacing is the desired number of seconds between two blocks.
+	targetBlockSpacing = 10
+	// maxAdjustmentFactor bounds how much a single retarget may change the target.
+	maxAdjustmentFactor = 4
+)
+
+var powLimit = compactToBig(powLimitBits)
+
+// compactToBig converts Bitcoin's compact nBits representation to a big integer.
+// The high byte is the length of the number in bytes, the next bit is the sign
+// and the low 23 bits are the most significant bytes of the number.
+func compactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+	if isNegative {
+		bn = bn.Neg(bn)
+	}
+	return bn
+}
+
+// bigToCompact converts a big integer to Bitcoin's compact nBits representation.
+func bigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(new(big.Int).Abs(n).Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Abs(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Uint64())
+	}
+	// The sign bit is part of the mantissa, so shift it out of the way.
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// normalizeBits maps the Bits of blocks mined before retargeting existed, which
+// were stored as 0, to the fixed target they were actually mined against.
+func normalizeBits(bits uint64) uint64 {
+	if bits == 0 {
+		return initialBits
+	}
+	return bits
+}
+
+// calcNextBits returns the Bits a block built on top of prev must carry.
+// Every retargetInterval blocks the target is scaled by the ratio of the actual
+// time the last window took to the expected time, clamped to maxAdjustmentFactor.
+func (bc *BlockChain) calcNextBits(prev *Block) uint64 {
+	prevBits := normalizeBits(prev.Bits)
+	if (prev.Height+1)%retargetInterval != 0 {
+		return prevBits
+	}
+
+	first := prev
+	for i := 1; i < retargetInterval; i++ {
+		first = bc.headerBlock(first.PrevHash)
+		if first == nil {
+			fmt.Println("calcNextBits: the retarget window is incomplete, keep the previous bits")
+			return prevBits
+		}
+	}
+
+	expectedTimespan := int64(retargetInterval * targetBlockSpacing)
+	actualTimespan := int64(prev.TimeStamp) - int64(first.TimeStamp)
+	if actualTimespan < expectedTimespan/maxAdjustmentFactor {
+		actualTimespan = expectedTimespan / maxAdjustmentFactor
+	} else if actualTimespan > expectedTimespan*maxAdjustmentFactor {
+		actualTimespan = expectedTimespan * maxAdjustmentFactor
+	}
+
+	newTarget := compactToBig(uint32(prevBits))
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(expectedTimespan))
+	if newTarget.Cmp(powLimit) > 0 {
+		newTarget.Set(powLimit)
+	}
+	newBits := uint64(bigToCompact(newTarget))
+	fmt.Printf("Retarget at height %d: actual timespan %ds, expected %ds, bits %08x -> %08x\n",
+		prev.Height+1, actualTimespan, expectedTimespan, prevBits, newBits)
+	return newBits
+}
+
+// expectedBits returns the Bits block must carry according to its parent.
+func (bc *BlockChain) expectedBits(block *Block) uint64 {
+	if len(block.PrevHash) == 0 {
+		return initialBits
+	}
+	prev := bc.headerBlock(block.PrevHash)
+	if prev == nil {
+		fmt.Printf("expectedBits: the parent of block %x is not found\n", block.Hash)
+		return 0
+	}
+	return bc.calcNextBits(prev)
+}
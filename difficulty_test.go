@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	vectors := []struct {
+		compact uint32
+		target  string
+		// encoded is the canonical compact form of target, which differs from compact
+		// when compact isn't canonical.
+		encoded uint32
+	}{
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000", 0x1d00ffff},
+		{initialBits, "1" + strings.Repeat("0", 60), initialBits},
+		{0x05009234, "92340000", 0x05009234},
+		{0x02123456, "1234", 0x02123400},
+		{0x01003456, "0", 0},
+		// The sign bit makes the target negative.
+		{0x04923456, "-12345600", 0x04923456},
+		// An exponent of 34 bytes makes the target overflow 256 bits.
+		{0x22123456, "123456" + strings.Repeat("0", 62), 0x22123456},
+	}
+	for _, v := range vectors {
+		want, _ := new(big.Int).SetString(v.target, 16)
+		got := compactToBig(v.compact)
+		if got.Cmp(want) != 0 {
+			t.Fatalf("%08x decodes as %x, want %s", v.compact, got, v.target)
+		}
+		if encoded := bigToCompact(got); encoded != v.encoded {
+			t.Fatalf("%s encodes as %08x, want %08x", v.target, encoded, v.encoded)
+		}
+	}
+}
+
+func TestOutOfRangeTargetsAreInvalid(t *testing.T) {
+	// A negative, a zero and an overflowing target are rejected before the hash is.
+	for _, bits := range []uint64{0x04923456, 0x01003456, 0x22123456, powLimitBits + 1} {
+		block := &Block{Version: blockVersion, Bits: bits}
+		if NewProofOfWork(block).IsValid(bits) {
+			t.Fatalf("a block with bits %08x is valid", bits)
+		}
+	}
+}
+
+// storeTestHeaders stores a header chain of retargetInterval headers with the given
+// bits, spaced by spacing seconds, and returns the last one.
+func storeTestHeaders(t *testing.T, bc *BlockChain, bits uint64, spacing uint64) *Block {
+	t.Helper()
+	var prev *BlockHeader
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		for height := uint64(0); height < retargetInterval; height++ {
+			h := &BlockHeader{Version: blockVersion, Bits: bits, TimeStamp: 1000000 + height*spacing, Height: height}
+			if prev != nil {
+				h.PrevHash = prev.Hash
+			}
+			h.Hash = headerHash(h.toBlock())
+			err := tx.Bucket([]byte(bucketHeaders)).Put(h.Hash, h.Serialize())
+			if err != nil {
+				return err
+			}
+			prev = h
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prev.toBlock()
+}
+
+func TestRetarget(t *testing.T) {
+	bc := newTestChain(t, newWalletKeyPair().getAddress())
+	scaled := func(bits uint64, num, den int64) uint64 {
+		target := compactToBig(uint32(bits))
+		target.Mul(target, big.NewInt(num))
+		target.Div(target, big.NewInt(den))
+		return uint64(bigToCompact(target))
+	}
+	const bits = 0x1e7fff00
+	cases := []struct {
+		name    string
+		bits    uint64
+		spacing uint64
+		want    uint64
+	}{
+		// The window spans retargetInterval-1 spacings.
+		{"on schedule", bits, 100 / (retargetInterval - 1), scaled(bits, 99, 100)},
+		{"twice as slow", bits, 200 / (retargetInterval - 1), scaled(bits, 198, 100)},
+		{"clamped at a quarter", bits, 0, scaled(bits, 1, maxAdjustmentFactor)},
+		{"clamped at four times", bits, 1000, scaled(bits, maxAdjustmentFactor, 1)},
+		{"capped at the pow limit", powLimitBits, 1000, powLimitBits},
+	}
+	for _, c := range cases {
+		prev := storeTestHeaders(t, bc, c.bits, c.spacing)
+		if got := bc.calcNextBits(prev); got != c.want {
+			t.Fatalf("%s: the next bits are %08x, want %08x", c.name, got, c.want)
+		}
+	}
+
+	// Between retargets the bits stay the same.
+	prev := storeTestHeaders(t, bc, bits, 1000)
+	prev.Height--
+	if got := bc.calcNextBits(prev); got != bits {
+		t.Fatalf("the bits changed to %08x outside a retarget", got)
+	}
+}
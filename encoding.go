@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// The canonical encoding is the byte layout of transactions, blocks, block headers
+// and unspent outputs used for hashing, storage and the network. Fields are written
+// in the order below with these types:
+//
+//	uvarint  unsigned LEB128 varint, as written by binary.PutUvarint
+//	varint   zigzag signed varint, as written by binary.PutVarint
+//	uint64   8 bytes little-endian, int64 the same in two's complement
+//	bytes    uvarint length followed by the bytes; empty decodes as nil
+//
+// Varints must be minimally encoded, and nothing may follow the encoded value.
+//
+// Transaction:
+//
+//	Version     uvarint  legacyTxVersion or txVersion
+//	TimeStamp   uint64
+//	TXInputs    uvarint count, then per input:
+//	  Txid      bytes    empty in the coinbase
+//	  Index     varint   -1 in the coinbase
+//	  ScriptSig bytes
+//	  PubKey    bytes
+//	TXOutputs   uvarint count, then per output:
+//	  Value             int64
+//	  ScriptPubKeyHash  bytes
+//	TXID        bytes    legacyTxVersion only
+//
+// A txVersion transaction is identified by the sha256 of its encoding with every
+// ScriptSig except the coinbase's left empty, see computeTXID. A legacyTxVersion
+// transaction was hashed over its gob encoding, so its TXID is kept in the encoding
+// and never needs gob to be read.
+//
+// Block header:
+//
+//	Version     uint64
+//	PrevHash    bytes    empty in the genesis block
+//	MerkleRoot  bytes
+//	TimeStamp   uint64
+//	Bits        uint64
+//	Nonce       uint64
+//	Height      uvarint
+//
+// Block: the block header followed by a uvarint count of transactions and the
+// transactions. The block hash isn't encoded, it is the proof of work hash of the
+// header.
+//
+// Unspent outputs, as stored in the UTXO set and the undo data: a uvarint count,
+// then per output its Txid (bytes), Index (varint) and the output as above.
+//
+// Transaction location, as stored in the tx index: BlockHash (bytes), then
+// Position (varint).
+
+// Smallest possible encodings, used to reject counts larger than the rest of the input.
+const (
+	minEncodedInput  = 4
+	minEncodedOutput = 9
+	minEncodedTx     = 11
+	minEncodedUTXO   = 11
+)
+
+type canonicalWriter struct {
+	bytes.Buffer
+}
+
+func (w *canonicalWriter) putUvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (w *canonicalWriter) putVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (w *canonicalWriter) putUint64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *canonicalWriter) putBytes(b []byte) {
+	w.putUvarint(uint64(len(b)))
+	w.Write(b)
+}
+
+// canonicalReader decodes fields from src. The first error sticks: later reads
+// return zero values, and err reports where decoding stopped.
+type canonicalReader struct {
+	src []byte
+	err error
+}
+
+func (r *canonicalReader) fail(format string, a ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, a...)
+	}
+	r.src = nil
+}
+
+func (r *canonicalReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.src)
+	if n <= 0 {
+		r.fail("truncated or overflowing uvarint")
+		return 0
+	}
+	var b [binary.MaxVarintLen64]byte
+	if binary.PutUvarint(b[:], v) != n {
+		r.fail("uvarint %d isn't minimally encoded", v)
+		return 0
+	}
+	r.src = r.src[n:]
+	return v
+}
+
+func (r *canonicalReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.src)
+	if n <= 0 {
+		r.fail("truncated or overflowing varint")
+		return 0
+	}
+	var b [binary.MaxVarintLen64]byte
+	if binary.PutVarint(b[:], v) != n {
+		r.fail("varint %d isn't minimally encoded", v)
+		return 0
+	}
+	r.src = r.src[n:]
+	return v
+}
+
+func (r *canonicalReader) uint64() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.src) < 8 {
+		r.fail("truncated uint64")
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.src)
+	r.src = r.src[8:]
+	return v
+}
+
+// bytes returns a copy, since src may be memory owned by a bolt transaction.
+func (r *canonicalReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.src)) {
+		r.fail("byte string of %d bytes is longer than the remaining %d", n, len(r.src))
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	b := append([]byte(nil), r.src[:n]...)
+	r.src = r.src[n:]
+	return b
+}
+
+// count reads the number of elements that follow, each at least minSize bytes long.
+func (r *canonicalReader) count(minSize int) int {
+	n := r.uvarint()
+	if r.err != nil {
+		return 0
+	}
+	if n > uint64(len(r.src)/minSize) {
+		r.fail("count %d doesn't fit in the remaining %d bytes", n, len(r.src))
+		return 0
+	}
+	return int(n)
+}
+
+func (r *canonicalReader) finish() error {
+	if r.err == nil && len(r.src) != 0 {
+		r.fail("%d trailing bytes", len(r.src))
+	}
+	return r.err
+}
+
+func (output *TXOutput) encode(w *canonicalWriter) {
+	w.putUint64(uint64(output.Value))
+	w.putBytes(output.ScriptPubKeyHash)
+}
+
+func decodeTXOutput(r *canonicalReader) TXOutput {
+	value := int64(r.uint64())
+	return TXOutput{ScriptPubKeyHash: r.bytes(), Value: value}
+}
+
+func (tx *Transaction) encode(w *canonicalWriter) {
+	w.putUvarint(tx.Version)
+	w.putUint64(tx.TimeStamp)
+	w.putUvarint(uint64(len(tx.TXInputs)))
+	for _, input := range tx.TXInputs {
+		w.putBytes(input.Txid)
+		w.putVarint(input.Index)
+		w.putBytes(input.ScriptSig)
+		w.putBytes(input.PubKey)
+	}
+	w.putUvarint(uint64(len(tx.TXOutputs)))
+	for i := range tx.TXOutputs {
+		tx.TXOutputs[i].encode(w)
+	}
+	if tx.Version == legacyTxVersion {
+		w.putBytes(tx.TXID)
+	}
+}
+
+func decodeTransaction(r *canonicalReader) *Transaction {
+	tx := Transaction{Version: r.uvarint(), TimeStamp: r.uint64()}
+	if tx.Version != legacyTxVersion && tx.Version != txVersion {
+		r.fail("unknown transaction version %d", tx.Version)
+		return nil
+	}
+	for i, n := 0, r.count(minEncodedInput); i < n; i++ {
+		input := TXInput{Txid: r.bytes(), Index: r.varint()}
+		input.ScriptSig = r.bytes()
+		input.PubKey = r.bytes()
+		tx.TXInputs = append(tx.TXInputs, input)
+	}
+	for i, n := 0, r.count(minEncodedOutput); i < n; i++ {
+		tx.TXOutputs = append(tx.TXOutputs, decodeTXOutput(r))
+	}
+	if tx.Version == legacyTxVersion {
+		tx.TXID = r.bytes()
+	}
+	if r.err != nil {
+		return nil
+	}
+	if tx.Version != legacyTxVersion {
+		tx.TXID = tx.computeTXID()
+	}
+	return &tx
+}
+
+func (h *BlockHeader) encode(w *canonicalWriter) {
+	w.putUint64(h.Version)
+	w.putBytes(h.PrevHash)
+	w.putBytes(h.MerkleRoot)
+	w.putUint64(h.TimeStamp)
+	w.putUint64(h.Bits)
+	w.putUint64(h.Nonce)
+	w.putUvarint(h.Height)
+}
+
+func decodeHeader(r *canonicalReader) *BlockHeader {
+	h := BlockHeader{Version: r.uint64(), PrevHash: r.bytes(), MerkleRoot: r.bytes()}
+	h.TimeStamp = r.uint64()
+	h.Bits = r.uint64()
+	h.Nonce = r.uint64()
+	h.Height = r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	h.Hash = headerHash(h.toBlock())
+	return &h
+}
+
+// headerHash returns the proof of work hash of the header of block.
+func headerHash(block *Block) []byte {
+	hash := sha256.Sum256(NewProofOfWork(block).PrepareData(block.Nonce))
+	return hash[:]
+}
+
+func (b *Block) encode(w *canonicalWriter) {
+	b.Header().encode(w)
+	w.putUvarint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		tx.encode(w)
+	}
+}
+
+func decodeBlock(r *canonicalReader) *Block {
+	h := decodeHeader(r)
+	if h == nil {
+		return nil
+	}
+	block := h.toBlock()
+	for i, n := 0, r.count(minEncodedTx); i < n; i++ {
+		tx := decodeTransaction(r)
+		if tx == nil {
+			return nil
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+	if r.err != nil {
+		return nil
+	}
+	return block
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func newTestTransactions(t *testing.T) []*Transaction {
+	t.Helper()
+	from, to := newWalletKeyPair(), newWalletKeyPair()
+	coinbase := NewCoinbaseTx(from.getAddress(), "test", 7, 25)
+	spend := newTestSpend(t, from, coinbase, 0, to.getAddress())
+	legacy := &Transaction{
+		Version:   legacyTxVersion,
+		TXID:      bytes.Repeat([]byte{0xab}, 32),
+		TXInputs:  []TXInput{{Txid: coinbase.TXID, Index: 0, ScriptSig: []byte("sig"), PubKey: from.PubKey}},
+		TXOutputs: []TXOutput{newTXOutput(to.getAddress(), -1), newTXOutput(from.getAddress(), 1<<40)},
+		TimeStamp: 1 << 33,
+	}
+	return []*Transaction{coinbase, spend, legacy}
+}
+
+func newTestEncodedBlock(t *testing.T) *Block {
+	t.Helper()
+	block := NewBlock(newTestTransactions(t), bytes.Repeat([]byte{1}, 32), 300, initialBits, 0)
+	if block == nil {
+		t.Fatal("failed to mine the block")
+	}
+	return block
+}
+
+func TestTransactionRoundTrip(t *testing.T) {
+	for _, tx := range newTestTransactions(t) {
+		data := tx.Serialize()
+		decoded := DeserializeTransaction(data)
+		if !reflect.DeepEqual(decoded, tx) {
+			t.Fatalf("version %d transaction decoded as %+v, want %+v", tx.Version, decoded, tx)
+		}
+		if !bytes.Equal(decoded.Serialize(), data) {
+			t.Fatalf("version %d transaction encodes differently after a round trip", tx.Version)
+		}
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	block := newTestEncodedBlock(t)
+	data := block.Serialize()
+	decoded := Deserialize(data)
+	if !reflect.DeepEqual(decoded, block) {
+		t.Fatalf("block decoded as %+v, want %+v", decoded, block)
+	}
+	if !bytes.Equal(decoded.Serialize(), data) {
+		t.Fatal("the block encodes differently after a round trip")
+	}
+}
+
+func TestBlockHeaderRoundTrip(t *testing.T) {
+	h := newTestEncodedBlock(t).Header()
+	data := h.Serialize()
+	decoded := deserializeHeader(data)
+	if !reflect.DeepEqual(decoded, h) {
+		t.Fatalf("header decoded as %+v, want %+v", decoded, h)
+	}
+	if !bytes.Equal(decoded.Serialize(), data) {
+		t.Fatal("the header encodes differently after a round trip")
+	}
+}
+
+func TestUTXORoundTrip(t *testing.T) {
+	var utxos []UTXOInfo
+	for _, tx := range newTestTransactions(t) {
+		for i, output := range tx.TXOutputs {
+			utxos = append(utxos, UTXOInfo{tx.TXID, int64(i), output})
+		}
+	}
+	data := serializeUTXOs(utxos)
+	decoded := deserializeUTXOs(data)
+	if !reflect.DeepEqual(decoded, utxos) {
+		t.Fatalf("utxos decoded as %+v, want %+v", decoded, utxos)
+	}
+	if !bytes.Equal(serializeUTXOs(decoded), data) {
+		t.Fatal("the utxos encode differently after a round trip")
+	}
+}
+
+func TestTxLocationRoundTrip(t *testing.T) {
+	loc := &TxLocation{bytes.Repeat([]byte{2}, 32), 130}
+	decoded := deserializeTxLocation(loc.Serialize())
+	if !reflect.DeepEqual(decoded, loc) {
+		t.Fatalf("tx location decoded as %+v, want %+v", decoded, loc)
+	}
+}
+
+func TestNonMinimalVarintsAreRejected(t *testing.T) {
+	// The height is the last field of the header; 0x81 0x00 is a padded uvarint 1.
+	h := newTestEncodedBlock(t).Header()
+	h.Height = 1
+	data := h.Serialize()
+	if data[len(data)-1] != 0x01 {
+		t.Fatalf("the header ends with %x, want the height 01", data[len(data)-1])
+	}
+	padded := append(append([]byte{}, data[:len(data)-1]...), 0x81, 0x00)
+	if deserializeHeader(padded) != nil {
+		t.Fatal("a header with a non-minimal uvarint height was accepted")
+	}
+
+	// The position is the last field of the tx location; 0x86 0x00 is a padded varint 3.
+	data = (&TxLocation{[]byte{2}, 3}).Serialize()
+	padded = append(append([]byte{}, data[:len(data)-1]...), 0x86, 0x00)
+	if deserializeTxLocation(padded) != nil {
+		t.Fatal("a tx location with a non-minimal varint position was accepted")
+	}
+
+	r := canonicalReader{src: []byte{0x80, 0x80, 0x00}}
+	if r.uvarint(); r.err == nil {
+		t.Fatal("the uvarint 0 padded to 3 bytes was accepted")
+	}
+}
+
+func TestOversizedCountsAreRejected(t *testing.T) {
+	var w canonicalWriter
+	w.putUvarint(1000)
+	w.Write(make([]byte, 100))
+	if deserializeUTXOs(w.Bytes()) != nil {
+		t.Fatal("utxos with a count larger than the input were accepted")
+	}
+
+	h := newTestEncodedBlock(t).Header()
+	w.Reset()
+	h.encode(&w)
+	w.putUvarint(1 << 40)
+	if Deserialize(w.Bytes()) != nil {
+		t.Fatal("a block with a transaction count larger than the input was accepted")
+	}
+
+	w.Reset()
+	w.putUvarint(txVersion)
+	w.putUint64(0)
+	w.putUvarint(1 << 62)
+	if DeserializeTransaction(w.Bytes()) != nil {
+		t.Fatal("a transaction with an input count larger than the input was accepted")
+	}
+}
+
+func TestTrailingBytesAreRejected(t *testing.T) {
+	block := newTestEncodedBlock(t)
+	utxos := []UTXOInfo{{block.Transactions[0].TXID, 0, block.Transactions[0].TXOutputs[0]}}
+	cases := []struct {
+		name   string
+		data   []byte
+		decode func([]byte) bool
+	}{
+		{"block", block.Serialize(), func(b []byte) bool { return Deserialize(b) != nil }},
+		{"header", block.Header().Serialize(), func(b []byte) bool { return deserializeHeader(b) != nil }},
+		{"transaction", block.Transactions[1].Serialize(), func(b []byte) bool { return DeserializeTransaction(b) != nil }},
+		{"utxos", serializeUTXOs(utxos), func(b []byte) bool { return deserializeUTXOs(b) != nil }},
+		{"tx location", (&TxLocation{block.Hash, 1}).Serialize(), func(b []byte) bool { return deserializeTxLocation(b) != nil }},
+	}
+	for _, c := range cases {
+		if !c.decode(c.data) {
+			t.Fatalf("the %s doesn't decode", c.name)
+		}
+		if c.decode(append(c.data, 0)) {
+			t.Fatalf("the %s was accepted with a trailing byte", c.name)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// EventType names what happened to the chain or the mempool.
+type EventType string
+
+const (
+	EventBlockConnected    EventType = "blockconnected"
+	EventBlockDisconnected EventType = "blockdisconnected"
+	EventMempoolTx         EventType = "mempooltx"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before it is dropped.
+const subscriberBuffer = 256
+
+// Event carries the connected or disconnected Block, or the Tx that entered the mempool.
+type Event struct {
+	Type  EventType
+	Block *Block
+	Tx    *Transaction
+}
+
+// EventBus hands every published event to all subscribers. Events are published
+// after the bolt transaction making the change has been committed, in the order
+// the changes were made: a reorganization disconnects blocks from the tail down
+// before connecting the new ones.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]bool
+}
+
+// Subscription receives events on C until it is unsubscribed. C is closed when the
+// subscription ends, including when the subscriber falls too far behind.
+type Subscription struct {
+	C   chan *Event
+	bus *EventBus
+}
+
+func newEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[*Subscription]bool)}
+}
+
+func (bus *EventBus) Subscribe() *Subscription {
+	sub := &Subscription{C: make(chan *Event, subscriberBuffer), bus: bus}
+	bus.mu.Lock()
+	bus.subscribers[sub] = true
+	bus.mu.Unlock()
+	return sub
+}
+
+func (sub *Subscription) Unsubscribe() {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	if sub.bus.subscribers[sub] {
+		delete(sub.bus.subscribers, sub)
+		close(sub.C)
+	}
+}
+
+// publish never blocks the chain on a slow subscriber; one whose buffer is full is
+// unsubscribed instead of silently missing events.
+func (bus *EventBus) publish(event *Event) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for sub := range bus.subscribers {
+		select {
+		case sub.C <- event:
+		default:
+			delete(bus.subscribers, sub)
+			close(sub.C)
+		}
+	}
+}
+
+func (bc *BlockChain) publishBlocks(eventType EventType, blocks ...*Block) {
+	for _, block := range blocks {
+		bc.events.publish(&Event{Type: eventType, Block: block})
+	}
+}
+
+// touches reports whether tx pays to or spends from one of pubKeyHashes.
+func (tx *Transaction) touches(pubKeyHashes [][]byte) bool {
+	for _, pubKeyHash := range pubKeyHashes {
+		for _, output := range tx.TXOutputs {
+			if bytes.Equal(output.ScriptPubKeyHash, pubKeyHash) {
+				return true
+			}
+		}
+		if tx.isCoinbaseTx() {
+			continue
+		}
+		for _, input := range tx.TXInputs {
+			if bytes.Equal(getPubKeyHashFromPubKey(input.PubKey), pubKeyHash) {
+				return true
+			}
+		}
+	}
+	return false
+}
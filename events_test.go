@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	bus := newEventBus()
+	fast, slow := bus.Subscribe(), bus.Subscribe()
+	for i := 0; i < subscriberBuffer; i++ {
+		bus.publish(&Event{Type: EventBlockConnected, Block: &Block{Height: uint64(i)}})
+		<-fast.C
+	}
+	// The slow subscriber's buffer is full, so the next event drops it.
+	bus.publish(&Event{Type: EventBlockConnected, Block: &Block{Height: subscriberBuffer}})
+	if event := <-fast.C; event.Block.Height != subscriberBuffer {
+		t.Fatalf("the fast subscriber got the block at height %d", event.Block.Height)
+	}
+	for i := 0; i < subscriberBuffer; i++ {
+		event, ok := <-slow.C
+		if !ok || event.Block.Height != uint64(i) {
+			t.Fatalf("the slow subscriber lost the event %d it had buffered", i)
+		}
+	}
+	if _, ok := <-slow.C; ok {
+		t.Fatal("the slow subscriber's channel wasn't closed")
+	}
+	bus.mu.Lock()
+	subscribed := bus.subscribers[slow]
+	bus.mu.Unlock()
+	if subscribed {
+		t.Fatal("the slow subscriber is still subscribed")
+	}
+
+	// Unsubscribing a dropped subscriber doesn't close its channel again.
+	slow.Unsubscribe()
+	fast.Unsubscribe()
+	if _, ok := <-fast.C; ok {
+		t.Fatal("the unsubscribed channel wasn't closed")
+	}
+	bus.publish(&Event{Type: EventMempoolTx, Tx: &Transaction{}})
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The explorer serves read-only JSON about the local chain and the HTML pages in
+// the explorer directory, which browse it with these requests:
+//
+//	/blocks?count=<N>    -> summaries of the latest main chain blocks, newest first
+//	/block/<HASH>        -> a block with its decoded transactions
+//	/block/height/<N>    -> the main chain block at height N
+//	/tx/<TXID>           -> a decoded transaction from the main chain or the mempool
+//	/address/<ADDRESS>   -> the balance, unspent outputs and transaction history of an address
+const (
+	defaultExplorerBlocks = 20
+	maxExplorerBlocks     = 500
+)
+
+//go:embed explorer
+var explorerFiles embed.FS
+
+// Explorer answers HTTP requests on localhost with a read-only view of the chain.
+type Explorer struct {
+	bc *BlockChain
+	// quit is closed by Stop.
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+type explorerError struct {
+	status  int
+	message string
+}
+
+func (e *explorerError) Error() string {
+	return e.message
+}
+
+func notFound(format string, a ...interface{}) error {
+	return &explorerError{http.StatusNotFound, fmt.Sprintf(format, a...)}
+}
+
+func badRequest(format string, a ...interface{}) error {
+	return &explorerError{http.StatusBadRequest, fmt.Sprintf(format, a...)}
+}
+
+func NewExplorer(bc *BlockChain) *Explorer {
+	return &Explorer{bc: bc, quit: make(chan struct{})}
+}
+
+func (e *Explorer) handler() http.Handler {
+	mux := http.NewServeMux()
+	static, err := fs.Sub(explorerFiles, "explorer")
+	if err != nil {
+		panic(err)
+	}
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	mux.HandleFunc("/blocks", e.api(e.handleBlocks))
+	mux.HandleFunc("/block/", e.api(e.handleBlock))
+	mux.HandleFunc("/tx/", e.api(e.handleTx))
+	mux.HandleFunc("/address/", e.api(e.handleAddress))
+	return mux
+}
+
+// Start serves the explorer on localhost:port until the process is interrupted or
+// Stop is called, and returns once the requests being handled are done.
+func (e *Explorer) Start(port int) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: e.handler()}
+	fmt.Printf("Explorer is listening on http://%s/\n", ln.Addr())
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+	select {
+	case err = <-served:
+		return err
+	case <-interrupt:
+		fmt.Println("Shutting down the explorer...")
+	case <-e.quit:
+	}
+	// No request touches the chain once Shutdown returns, so the caller may close it.
+	err = server.Shutdown(context.Background())
+	<-served
+	return err
+}
+
+// Stop makes Start return. It may be called more than once.
+func (e *Explorer) Stop() {
+	e.stopOnce.Do(func() { close(e.quit) })
+}
+
+// api turns a handler returning a value or an error into a GET only JSON endpoint.
+func (e *Explorer) api(handle func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "the explorer is read-only"})
+			return
+		}
+		result, err := handle(r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			var explorerErr *explorerError
+			if errors.As(err, &explorerErr) {
+				status = explorerErr.status
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+type explorerBlockSummary struct {
+	Hash    string `json:"hash"`
+	Height  uint64 `json:"height"`
+	Time    uint64 `json:"time"`
+	TxCount int    `json:"txcount"`
+}
+
+func (e *Explorer) handleBlocks(r *http.Request) (interface{}, error) {
+	count := defaultExplorerBlocks
+	if value := r.URL.Query().Get("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxExplorerBlocks {
+			return nil, badRequest("count must be between 1 and %d", maxExplorerBlocks)
+		}
+		count = n
+	}
+	summaries := []explorerBlockSummary{}
+	it := e.bc.NewIterator()
+	for len(summaries) < count {
+		block := it.Next()
+		if block == nil {
+			return nil, errors.New("failed to read the main chain")
+		}
+		summaries = append(summaries, explorerBlockSummary{
+			Hash:    hex.EncodeToString(block.Hash),
+			Height:  block.Height,
+			Time:    block.TimeStamp,
+			TxCount: len(block.Transactions),
+		})
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	return summaries, nil
+}
+
+// explorerTx adds the text of Transaction.String to the decoded transaction.
+type explorerTx struct {
+	*rpcTransaction
+	Text string `json:"text"`
+}
+
+type explorerBlock struct {
+	*rpcBlock
+	Transactions []explorerTx `json:"transactions"`
+}
+
+func (e *Explorer) handleBlock(r *http.Request) (interface{}, error) {
+	id := strings.TrimPrefix(r.URL.Path, "/block/")
+	var block *Block
+	if strings.HasPrefix(id, "height/") {
+		height, err := strconv.ParseUint(strings.TrimPrefix(id, "height/"), 10, 64)
+		if err != nil {
+			return nil, badRequest("invalid height %q", strings.TrimPrefix(id, "height/"))
+		}
+		block = e.bc.GetBlockByHeight(height)
+		if block == nil {
+			return nil, notFound("no main chain block at height %d", height)
+		}
+	} else {
+		hash, err := hex.DecodeString(id)
+		if err != nil || len(hash) != 32 {
+			return nil, badRequest("invalid block hash %q", id)
+		}
+		block = e.bc.GetBlockByHash(hash)
+	}
+	if block == nil {
+		return nil, notFound("block %s not found", id)
+	}
+	result := explorerBlock{rpcBlock: newRPCBlock(e.bc, block), Transactions: []explorerTx{}}
+	for _, tx := range block.Transactions {
+		decoded := newRPCTransaction(tx)
+		decoded.setBlock(e.bc, block)
+		result.Transactions = append(result.Transactions, explorerTx{decoded, tx.String()})
+	}
+	return result, nil
+}
+
+func (e *Explorer) handleTx(r *http.Request) (interface{}, error) {
+	id := strings.TrimPrefix(r.URL.Path, "/tx/")
+	txid, err := hex.DecodeString(id)
+	if err != nil || len(txid) != 32 {
+		return nil, badRequest("invalid txid %q", id)
+	}
+	tx, block, err := e.bc.findAnyTransaction(txid)
+	if err != nil {
+		return nil, err
+	}
+	if tx == nil {
+		return nil, notFound("transaction %s not found", id)
+	}
+	decoded := newRPCTransaction(tx)
+	if block != nil {
+		decoded.setBlock(e.bc, block)
+	}
+	return explorerTx{decoded, tx.String()}, nil
+}
+
+type explorerUTXO struct {
+	Txid           string      `json:"txid"`
+	Vout           int64       `json:"vout"`
+	Value          json.Number `json:"value"`
+	SpentInMempool bool        `json:"spentinmempool"`
+}
+
+// explorerHistoryItem is a main chain transaction paying to or spending from an address.
+type explorerHistoryItem struct {
+	Txid      string      `json:"txid"`
+	BlockHash string      `json:"blockhash"`
+	Height    uint64      `json:"height"`
+	Time      uint64      `json:"time"`
+	Received  json.Number `json:"received"`
+	Sent      json.Number `json:"sent"`
+}
+
+type explorerAddress struct {
+	Address string                `json:"address"`
+	Balance json.Number           `json:"balance"`
+	UTXOs   []explorerUTXO        `json:"utxos"`
+	History []explorerHistoryItem `json:"history"`
+}
+
+func (e *Explorer) handleAddress(r *http.Request) (interface{}, error) {
+	address := strings.TrimPrefix(r.URL.Path, "/address/")
+	if !isValidAddress(address) {
+		return nil, badRequest("invalid address %q", address)
+	}
+	pubKeyHash := getPubKeyHashFromAddress(address)
+	mp, err := NewMempool(e.bc)
+	if err != nil {
+		return nil, err
+	}
+	result := explorerAddress{Address: address, UTXOs: []explorerUTXO{}}
+	var balance int64
+	for _, utxo := range e.bc.FindMyUTXO(pubKeyHash) {
+		balance += utxo.Value
+		result.UTXOs = append(result.UTXOs, explorerUTXO{
+			Txid:           hex.EncodeToString(utxo.Txid),
+			Vout:           utxo.Index,
+			Value:          amountResult(utxo.Value),
+			SpentInMempool: mp.IsSpent(utxo.Txid, utxo.Index),
+		})
+	}
+	result.Balance = amountResult(balance)
+	result.History, err = e.bc.addressHistory(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// addressHistory walks the main chain from the tail and returns every transaction
+// paying to or spending from pubKeyHash, newest first.
+func (bc *BlockChain) addressHistory(pubKeyHash []byte) ([]explorerHistoryItem, error) {
+	history := []explorerHistoryItem{}
+	it := bc.NewIterator()
+	for {
+		block := it.Next()
+		if block == nil {
+			return nil, errors.New("failed to read the main chain")
+		}
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
+			var received, sent int64
+			for _, output := range tx.TXOutputs {
+				if bytes.Equal(output.ScriptPubKeyHash, pubKeyHash) {
+					received += output.Value
+				}
+			}
+			if !tx.isCoinbaseTx() {
+				for _, input := range tx.TXInputs {
+					if !bytes.Equal(getPubKeyHashFromPubKey(input.PubKey), pubKeyHash) {
+						continue
+					}
+					prevTx := bc.findTransaction(input.Txid)
+					if prevTx == nil || input.Index < 0 || input.Index >= int64(len(prevTx.TXOutputs)) {
+						return nil, fmt.Errorf("the output %x:%d spent by %x was not found", input.Txid, input.Index, tx.TXID)
+					}
+					sent += prevTx.TXOutputs[input.Index].Value
+				}
+			}
+			if received == 0 && sent == 0 {
+				continue
+			}
+			history = append(history, explorerHistoryItem{
+				Txid:      hex.EncodeToString(tx.TXID),
+				BlockHash: hex.EncodeToString(block.Hash),
+				Height:    block.Height,
+				Time:      block.TimeStamp,
+				Received:  amountResult(received),
+				Sent:      amountResult(sent),
+			})
+		}
+		if len(block.PrevHash) == 0 {
+			return history, nil
+		}
+	}
+}
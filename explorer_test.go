@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testExplorerPort = 18015
+
+// getExplorer requests path and decodes the reply into reply unless the status
+// isn't the one wanted.
+func getExplorer(t *testing.T, server *httptest.Server, path string, status int, reply interface{}) {
+	t.Helper()
+	response, err := server.Client().Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != status {
+		t.Fatalf("%s returned status %d, want %d", path, response.StatusCode, status)
+	}
+	if reply != nil {
+		err = json.NewDecoder(response.Body).Decode(reply)
+		if err != nil {
+			t.Fatalf("the reply to %s doesn't decode: %v", path, err)
+		}
+	}
+}
+
+func TestExplorer(t *testing.T) {
+	miner, payee := newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	defer bc.db.Close()
+	genesis := bc.GetBlockByHash(bc.tail)
+	spend := newTestSpend(t, miner, genesis.Transactions[0], 0, payee.getAddress())
+	block := processTestBlock(t, bc, genesis, miner.getAddress(), spend)
+	pending := newTestSpend(t, miner, block.Transactions[0], 0, payee.getAddress())
+	err := newTestMempool(t, bc).AddTransaction(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewExplorer(bc).handler())
+	defer server.Close()
+
+	var summaries []explorerBlockSummary
+	getExplorer(t, server, "/blocks", http.StatusOK, &summaries)
+	if len(summaries) != 2 || summaries[0].Hash != hex.EncodeToString(block.Hash) || summaries[0].TxCount != 2 || summaries[1].Height != 0 {
+		t.Fatalf("/blocks returned %+v", summaries)
+	}
+	getExplorer(t, server, "/blocks?count=1", http.StatusOK, &summaries)
+	if len(summaries) != 1 || summaries[0].Height != 1 {
+		t.Fatalf("/blocks?count=1 returned %+v", summaries)
+	}
+	getExplorer(t, server, "/blocks?count=0", http.StatusBadRequest, nil)
+
+	for _, path := range []string{"/block/" + hex.EncodeToString(block.Hash), "/block/height/1"} {
+		var reply struct {
+			Hash         string
+			Height       uint64
+			Transactions []struct {
+				Txid string
+				Text string
+			}
+		}
+		getExplorer(t, server, path, http.StatusOK, &reply)
+		if reply.Hash != hex.EncodeToString(block.Hash) || reply.Height != 1 || len(reply.Transactions) != 2 {
+			t.Fatalf("%s returned block %s at height %d with %d transactions", path, reply.Hash, reply.Height, len(reply.Transactions))
+		}
+		if reply.Transactions[1].Txid != hex.EncodeToString(spend.TXID) || reply.Transactions[1].Text != spend.String() {
+			t.Fatalf("%s returned the transactions %+v", path, reply.Transactions)
+		}
+	}
+	getExplorer(t, server, "/block/xyz", http.StatusBadRequest, nil)
+	getExplorer(t, server, "/block/"+hex.EncodeToString(genesis.Hash[:16]), http.StatusBadRequest, nil)
+	getExplorer(t, server, "/block/height/-1", http.StatusBadRequest, nil)
+	getExplorer(t, server, "/block/"+hex.EncodeToString(bytes.Repeat([]byte{1}, 32)), http.StatusNotFound, nil)
+	getExplorer(t, server, "/block/height/2", http.StatusNotFound, nil)
+
+	var tx rpcTransaction
+	getExplorer(t, server, "/tx/"+hex.EncodeToString(spend.TXID), http.StatusOK, &tx)
+	if tx.BlockHash != hex.EncodeToString(block.Hash) || tx.Confirmations != 1 {
+		t.Fatalf("the mined transaction is in block %q with %d confirmations", tx.BlockHash, tx.Confirmations)
+	}
+	tx = rpcTransaction{}
+	getExplorer(t, server, "/tx/"+hex.EncodeToString(pending.TXID), http.StatusOK, &tx)
+	if tx.Txid != hex.EncodeToString(pending.TXID) || tx.BlockHash != "" || tx.Confirmations != 0 {
+		t.Fatalf("the pending transaction returned %+v", tx)
+	}
+	getExplorer(t, server, "/tx/abc", http.StatusBadRequest, nil)
+	getExplorer(t, server, "/tx/"+hex.EncodeToString(bytes.Repeat([]byte{1}, 32)), http.StatusNotFound, nil)
+
+	var address explorerAddress
+	getExplorer(t, server, "/address/"+miner.getAddress(), http.StatusOK, &address)
+	value := genesis.Transactions[0].TXOutputs[0].Value
+	mined := block.Transactions[0].TXOutputs[0].Value
+	if address.Balance != amountResult(mined) || len(address.UTXOs) != 1 || !address.UTXOs[0].SpentInMempool {
+		t.Fatalf("the miner's address returned a balance of %s and the outputs %+v", address.Balance, address.UTXOs)
+	}
+	want := []explorerHistoryItem{
+		{hex.EncodeToString(spend.TXID), hex.EncodeToString(block.Hash), 1, block.TimeStamp, amountResult(0), amountResult(value)},
+		{hex.EncodeToString(block.Transactions[0].TXID), hex.EncodeToString(block.Hash), 1, block.TimeStamp, amountResult(mined), amountResult(0)},
+		{hex.EncodeToString(genesis.Transactions[0].TXID), hex.EncodeToString(genesis.Hash), 0, genesis.TimeStamp, amountResult(value), amountResult(0)},
+	}
+	if fmt.Sprint(address.History) != fmt.Sprint(want) {
+		t.Fatalf("the miner's history is %+v, want %+v", address.History, want)
+	}
+	getExplorer(t, server, "/address/"+payee.getAddress(), http.StatusOK, &address)
+	if address.Balance != amountResult(value) || len(address.History) != 1 || address.History[0].Received != amountResult(value) {
+		t.Fatalf("the payee's address returned a balance of %s and the history %+v", address.Balance, address.History)
+	}
+	getExplorer(t, server, "/address/1notanaddress", http.StatusBadRequest, nil)
+
+	response, err := server.Client().Post(server.URL+"/blocks", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("a POST request returned status %d", response.StatusCode)
+	}
+}
+
+func TestExplorerStops(t *testing.T) {
+	bc := newTestChain(t, newWalletKeyPair().getAddress())
+	defer bc.db.Close()
+	e := NewExplorer(bc)
+
+	done := make(chan error, 1)
+	go func() { done <- e.Start(testExplorerPort) }()
+	waitFor(t, "the explorer to listen", func() bool {
+		response, err := http.Get(fmt.Sprintf("http://localhost:%d/blocks", testExplorerPort))
+		if err != nil {
+			return false
+		}
+		response.Body.Close()
+		return true
+	})
+	e.Stop()
+	e.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after Stop")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// An HD wallet derives its keys from a BIP39 mnemonic: the mnemonic is stretched
+// into a seed, the seed into a BIP32 master key, and the i-th address is the key at
+// the BIP44 path m/44'/0'/0'/0/i. Backing up the mnemonic once backs up every
+// address the wallet will ever derive. No BIP39 passphrase is used.
+const (
+	hdSeedLen        = 64
+	hardenedKeyStart = 0x80000000
+	hdGapLimit       = 20
+	// mnemonicEnvVar holds the mnemonic to restore, which is otherwise asked for. It
+	// is never taken from the command line, where it would be kept in the shell
+	// history and shown in the process list.
+	mnemonicEnvVar = "WALLET_MNEMONIC"
+)
+
+// hdAccountPath is the path of the external chain of the first account; the
+// addresses are its children.
+var hdAccountPath = []uint32{44 + hardenedKeyStart, 0 + hardenedKeyStart, 0 + hardenedKeyStart, 0}
+
+// extendedKey is a BIP32 extended private key.
+type extendedKey struct {
+	key       *btcec.PrivateKey
+	chainCode []byte
+}
+
+// newExtendedKey splits the HMAC-SHA512 sum into the key, which must be a valid
+// scalar, and the chain code.
+func newExtendedKey(sum []byte, parent *btcec.PrivateKey) (*extendedKey, error) {
+	var k btcec.ModNScalar
+	if k.SetByteSlice(sum[:32]) {
+		return nil, errors.New("the derived key is out of range")
+	}
+	if parent != nil {
+		k.Add(&parent.Key)
+	}
+	if k.IsZero() {
+		return nil, errors.New("the derived key is zero")
+	}
+	return &extendedKey{btcec.PrivKeyFromScalar(&k), sum[32:]}, nil
+}
+
+func newMasterKey(seed []byte) (*extendedKey, error) {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	return newExtendedKey(mac.Sum(nil), nil)
+}
+
+// child derives the child key at index, hardened from hardenedKeyStart on.
+func (k *extendedKey) child(index uint32) (*extendedKey, error) {
+	mac := hmac.New(sha512.New, k.chainCode)
+	if index >= hardenedKeyStart {
+		mac.Write([]byte{0})
+		mac.Write(k.key.Serialize())
+	} else {
+		mac.Write(k.key.PubKey().SerializeCompressed())
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], index)
+	mac.Write(b[:])
+	return newExtendedKey(mac.Sum(nil), k.key)
+}
+
+func hdPath(index uint32) string {
+	return fmt.Sprintf("m/44'/0'/0'/0/%d", index)
+}
+
+// normalizeMnemonic checks the words and checksum of mnemonic and returns it with
+// single spaces between lower case words.
+func normalizeMnemonic(mnemonic string) (string, error) {
+	mnemonic = strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+	_, err := bip39.EntropyFromMnemonic(mnemonic)
+	if err == bip39.ErrChecksumIncorrect {
+		return "", errors.New("the mnemonic checksum is incorrect")
+	}
+	if err != nil {
+		return "", errors.New("the mnemonic must be 12 to 24 words of the BIP39 English word list")
+	}
+	return mnemonic, nil
+}
+
+// newMnemonic returns a mnemonic of words words encoding fresh random entropy.
+func newMnemonic(words int) (string, error) {
+	if words < 12 || words > 24 || words%3 != 0 {
+		return "", errors.New("a mnemonic has 12, 15, 18, 21 or 24 words")
+	}
+	entropy, err := bip39.NewEntropy(words / 3 * 32)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// readMnemonic returns the mnemonic in WALLET_MNEMONIC or asks for it without echo.
+func readMnemonic() (string, error) {
+	if mnemonic, ok := os.LookupEnv(mnemonicEnvVar); ok {
+		return mnemonic, nil
+	}
+	return askPassphrase("Mnemonic: ")
+}
+
+func (wm *WalletManager) isHD() bool {
+	return wm.seed != nil
+}
+
+// setMnemonic makes wm an HD wallet deriving its keys from mnemonic. The keys wm
+// already holds are kept.
+func (wm *WalletManager) setMnemonic(mnemonic string) error {
+	if wm.isLocked() {
+		return errors.New("the wallet is locked")
+	}
+	if wm.isHD() {
+		return errors.New("the wallet already has an HD seed")
+	}
+	mnemonic, err := normalizeMnemonic(mnemonic)
+	if err != nil {
+		return err
+	}
+	wm.seed = bip39.NewSeed(mnemonic, "")
+	wm.nextIndex = 0
+	return nil
+}
+
+// deriveKey returns the key of the address at index.
+func (wm *WalletManager) deriveKey(index uint32) (*wallet, error) {
+	if !wm.isHD() {
+		return nil, errors.New("the wallet has no HD seed, create one with newMnemonic")
+	}
+	if index >= hardenedKeyStart {
+		return nil, fmt.Errorf("the index must be below %d", uint32(hardenedKeyStart))
+	}
+	k, err := newMasterKey(wm.seed)
+	for _, i := range append(hdAccountPath, index) {
+		if err != nil {
+			break
+		}
+		k, err = k.child(i)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s can't be derived: %v", hdPath(index), err)
+	}
+	return newWallet(k.key), nil
+}
+
+// deriveAddress adds the address at index to the wallet; later addresses are
+// derived after it.
+func (wm *WalletManager) deriveAddress(index uint32) (string, error) {
+	w, err := wm.deriveKey(index)
+	if err != nil {
+		return "", err
+	}
+	address := w.getAddress()
+	wm.Wallets[address] = w
+	if index >= wm.nextIndex {
+		wm.nextIndex = index + 1
+	}
+	if !wm.saveFile() {
+		return "", errors.New("failed to save the wallet")
+	}
+	return address, nil
+}
+
+// discoverAddresses derives addresses until hdGapLimit addresses in a row have never
+// been paid on the chain, and adds every address up to the last used one. It returns
+// how many were used. The scan is output based: an address is used when used holds
+// its public key hash, see usedPubKeyHashes.
+func (wm *WalletManager) discoverAddresses(used map[string]bool) (int, error) {
+	count := 0
+	gap := 0
+	for index := uint32(0); gap < hdGapLimit; index++ {
+		w, err := wm.deriveKey(index)
+		if err != nil {
+			return count, err
+		}
+		if !used[string(getPubKeyHashFromPubKey(w.PubKey))] {
+			gap++
+			continue
+		}
+		for i := index - uint32(gap); i <= index; i++ {
+			w, err := wm.deriveKey(i)
+			if err != nil {
+				return count, err
+			}
+			wm.Wallets[w.getAddress()] = w
+		}
+		wm.nextIndex = index + 1
+		gap = 0
+		count++
+	}
+	if !wm.saveFile() {
+		return count, errors.New("failed to save the wallet")
+	}
+	return count, nil
+}
+
+// usedPubKeyHashes returns the public key hashes every output of the main chain pays to.
+// Only outputs are looked at, since an address spends only after it was paid; payments
+// still in the mempool or on a side chain don't mark an address as used.
+func (bc *BlockChain) usedPubKeyHashes() (map[string]bool, error) {
+	used := make(map[string]bool)
+	it := bc.NewIterator()
+	for {
+		block := it.Next()
+		if block == nil {
+			return nil, errors.New("failed to read the main chain")
+		}
+		for _, tx := range block.Transactions {
+			for _, output := range tx.TXOutputs {
+				used[string(output.ScriptPubKeyHash)] = true
+			}
+		}
+		if len(block.PrevHash) == 0 {
+			return used, nil
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+const testMnemonic = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+func decodeTestHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// newTestHDWallet returns an HD wallet of testMnemonic saved in a temporary directory.
+func newTestHDWallet(t *testing.T) *WalletManager {
+	t.Helper()
+	chdirTemp(t)
+	wm := NewWalletManager()
+	err := wm.setMnemonic(testMnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wm
+}
+
+func TestBIP32Vector1(t *testing.T) {
+	k, err := newMasterKey(decodeTestHex(t, "000102030405060708090a0b0c0d0e0f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := []uint32{0 + hardenedKeyStart, 1, 2 + hardenedKeyStart, 2, 1000000000}
+	want := []struct{ name, chainCode, key string }{
+		{"m", "873dff81c02f525623fd1fe5167eac3a55a049de3d314bb42ee227ffed37d508", "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35"},
+		{"m/0'", "47fdacbd0f1097043b78c63c20c34ef4ed9a111d980047ad16282c7ae6236141", "edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea"},
+		{"m/0'/1", "2a7857631386ba23dacac34180dd1983734e444fdbf774041578e9b6adb37c19", "3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368"},
+		{"m/0'/1/2'", "04466b9cc8e161e966409ca52986c584f07e9dc81f735db683c3ff6ec7b1503f", "cbce0d719ecf7431d88e6a89fa1483e02e35092af60c042b1df2ff59fa424dca"},
+		{"m/0'/1/2'/2", "cfb71883f01676f587d023cc53a35bc7f88f724b1f8c2892ac1275ac822a3edd", "0f479245fb19a38a1954c5c7c0ebab2f9bdfd96a17563ef28a6a4b1a2a764ef4"},
+		{"m/0'/1/2'/2/1000000000", "c783e67b921d2beb8f6b389cc646d7263b4145701dadd2161548a8b078e65e9e", "471b76e389e528d6de6d816857e012c5455051cad6660850e58372a6c3e6e7c8"},
+	}
+	for i, w := range want {
+		if i > 0 {
+			k, err = k.child(path[i-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if hex.EncodeToString(k.chainCode) != w.chainCode || hex.EncodeToString(k.key.Serialize()) != w.key {
+			t.Fatalf("%s has the chain code %x and the key %x", w.name, k.chainCode, k.key.Serialize())
+		}
+	}
+}
+
+func TestBIP39Seed(t *testing.T) {
+	// The first vector of the reference implementation, whose passphrase is TREZOR.
+	seed := bip39.NewSeed(testMnemonic, "TREZOR")
+	want := "c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04"
+	if hex.EncodeToString(seed) != want {
+		t.Fatalf("the seed is %x", seed)
+	}
+
+	// The wallet uses no passphrase and accepts the words in any case and spacing.
+	chdirTemp(t)
+	wm := NewWalletManager()
+	err := wm.setMnemonic("  Abandon abandon abandon abandon abandon abandon\nabandon abandon abandon abandon abandon ABOUT ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "5eb00bbddcf069084889a8ab9155568165f5c453ccb85e70811aaed6f6da5fc19a5ac40b389cd370d086206dec8aa6c43daea6690f20ad3d8d48b2d2ce9e38e4"
+	if hex.EncodeToString(wm.seed) != want {
+		t.Fatalf("the wallet seed is %x", wm.seed)
+	}
+	// The well known first BIP44 address of the mnemonic.
+	address, err := wm.deriveAddress(0)
+	if err != nil || address != "1LqBGSKuX5yYUonjxT5qGfpUsXKYYWeabA" {
+		t.Fatalf("%s is %s: %v", hdPath(0), address, err)
+	}
+
+	for _, mnemonic := range []string{
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon bitcoins",
+	} {
+		if _, err := normalizeMnemonic(mnemonic); err == nil {
+			t.Fatalf("the mnemonic %q was accepted", mnemonic)
+		}
+	}
+	if wm.setMnemonic(testMnemonic) == nil {
+		t.Fatal("a second seed replaced the first")
+	}
+}
+
+func TestDiscoverAddressesAcrossAGap(t *testing.T) {
+	wm := newTestHDWallet(t)
+	var addresses []string
+	for index := uint32(0); index <= 5; index++ {
+		w, err := wm.deriveKey(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses = append(addresses, w.getAddress())
+	}
+	used := map[string]bool{
+		string(getPubKeyHashFromAddress(addresses[0])): true,
+		string(getPubKeyHashFromAddress(addresses[5])): true,
+	}
+
+	count, err := wm.discoverAddresses(used)
+	if err != nil || count != 2 {
+		t.Fatalf("%d used addresses were discovered: %v", count, err)
+	}
+	if len(wm.Wallets) != 6 || wm.nextIndex != 6 {
+		t.Fatalf("the wallet holds %d addresses and derives the next at %d, want 6 and 6", len(wm.Wallets), wm.nextIndex)
+	}
+	for index, address := range addresses {
+		if wm.Wallets[address] == nil {
+			t.Fatalf("the address %s at index %d wasn't restored", address, index)
+		}
+	}
+	next := wm.createWallet()
+	if w, _ := wm.deriveKey(6); next != w.getAddress() {
+		t.Fatal("the next address isn't derived at index 6")
+	}
+
+	// A used address after hdGapLimit unused ones isn't found.
+	wm = newTestHDWallet(t)
+	w, err := wm.deriveKey(5 + hdGapLimit + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used[string(getPubKeyHashFromPubKey(w.PubKey))] = true
+	count, err = wm.discoverAddresses(used)
+	if err != nil || count != 2 || wm.nextIndex != 6 {
+		t.Fatalf("%d used addresses were discovered up to index %d: %v", count, wm.nextIndex, err)
+	}
+}
+
+func TestEncryptedSeedRoundTrip(t *testing.T) {
+	wm := newTestHDWallet(t)
+	seed := wm.seed
+	derived := wm.createWallet()
+	imported, err := wm.importPrivKey(encodeWIF(newWalletKeyPair().PriKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wm.encrypt("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wm = NewWalletManager()
+	if !wm.isLocked() || wm.isHD() || wm.Wallets[derived] == nil || wm.Wallets[imported] == nil {
+		t.Fatal("the reloaded wallet isn't locked with the public keys of both addresses")
+	}
+	if wm.createWallet() != "" {
+		t.Fatal("the locked wallet derived an address")
+	}
+	enc := wm.encryption
+	wrongKey, err := deriveWalletKey("wrong", enc.salt, enc.n, enc.r, enc.p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wm.unlockWithKey(wrongKey) == nil || !wm.isLocked() {
+		t.Fatal("a wrong key unlocked the wallet")
+	}
+	key, err := deriveWalletKey("passphrase", enc.salt, enc.n, enc.r, enc.p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wm.unlockWithKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(wm.seed, seed) || wm.nextIndex != 1 {
+		t.Fatalf("the unsealed seed is %x with the next index %d", wm.seed, wm.nextIndex)
+	}
+	if w, _ := wm.deriveKey(0); !bytes.Equal(wm.Wallets[derived].PriKey.Serialize(), w.PriKey.Serialize()) {
+		t.Fatal("the derived key wasn't unsealed")
+	}
+	if wm.Wallets[imported].PriKey == nil {
+		t.Fatal("the imported key wasn't unsealed")
+	}
+
+	// Sealing again under the same key keeps the seed.
+	if wm.createWallet() == "" {
+		t.Fatal("the unlocked wallet didn't derive an address")
+	}
+	wm = NewWalletManager()
+	err = wm.unlockWithKey(key)
+	if err != nil || !bytes.Equal(wm.seed, seed) || wm.nextIndex != 2 || len(wm.Wallets) != 3 {
+		t.Fatalf("the wallet sealed again holds %d addresses with the next index %d: %v", len(wm.Wallets), wm.nextIndex, err)
+	}
+}
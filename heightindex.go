@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// bucketHeight maps a big-endian block height to the hash of the main chain block at that height.
+const bucketHeight = "bucketHeight"
+
+func heightToKey(height uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, height)
+	return key
+}
+
+// indexHeight records block as the main chain block at its height.
+// It must run inside the same bolt transaction that stores the block.
+func indexHeight(tx *bolt.Tx, block *Block) error {
+	bucket := tx.Bucket([]byte(bucketHeight))
+	if bucket == nil {
+		return errors.New("height bucket shouldn't be nil when indexing the block")
+	}
+	return bucket.Put(heightToKey(block.Height), block.Hash)
+}
+
+func (bc *BlockChain) GetBlockByHash(hash []byte) *Block {
+	var block *Block
+	bc.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(bucketBlock)).Get(hash)
+		if data != nil {
+			block = Deserialize(data)
+		}
+		return nil
+	})
+	return block
+}
+
+func (bc *BlockChain) GetBlockByHeight(height uint64) *Block {
+	var block *Block
+	bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketHeight))
+		if bucket == nil {
+			return nil
+		}
+		hash := bucket.Get(heightToKey(height))
+		if hash == nil {
+			return nil
+		}
+		data := tx.Bucket([]byte(bucketBlock)).Get(hash)
+		if data != nil {
+			block = Deserialize(data)
+		}
+		return nil
+	})
+	return block
+}
+
+// GetBestHeight returns the height of the tail block, read from the last key of the height index.
+func (bc *BlockChain) GetBestHeight() (uint64, error) {
+	var height uint64
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketHeight))
+		if bucket == nil {
+			return errors.New("height bucket shouldn't be nil")
+		}
+		key, _ := bucket.Cursor().Last()
+		if key == nil {
+			return errors.New("the height index is empty")
+		}
+		height = binary.BigEndian.Uint64(key)
+		return nil
+	})
+	if err != nil {
+		fmt.Println("GetBestHeight err:", err)
+	}
+	return height, err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestBlocksAreFoundByHeight(t *testing.T) {
+	miner := newWalletKeyPair().getAddress()
+	bc := newTestChain(t, miner)
+	genesis := bc.GetBlockByHash(bc.tail)
+	blocks := []*Block{genesis}
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, processTestBlock(t, bc, blocks[i], miner))
+	}
+
+	checkHeights := func() {
+		t.Helper()
+		for height, block := range blocks {
+			found := bc.GetBlockByHeight(uint64(height))
+			if found == nil || !bytes.Equal(found.Hash, block.Hash) || found.Height != uint64(height) {
+				t.Fatalf("the block at height %d isn't %x", height, block.Hash)
+			}
+		}
+		if bc.GetBlockByHeight(4) != nil {
+			t.Fatal("a block was found above the tail")
+		}
+		if height, err := bc.GetBestHeight(); height != 3 || err != nil {
+			t.Fatalf("the best height is %d: %v", height, err)
+		}
+	}
+	checkHeights()
+
+	// A missing index is rebuilt from the main chain when the chain is opened.
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(bucketHeight))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.db.Close()
+	bc, err = GetBlockChainInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHeights()
+	bc.db.Close()
+
+	cli := CLI{}
+	for _, id := range []string{"2", hex.EncodeToString(blocks[2].Hash)} {
+		output := captureStdout(t, func() { cli.getBlock(id) })
+		if !strings.Contains(output, hex.EncodeToString(blocks[2].Hash)) {
+			t.Fatalf("getBlock %s printed %q", id, output)
+		}
+	}
+	if output := captureStdout(t, func() { cli.getBlock("4") }); !strings.Contains(output, "The block was not found: 4") {
+		t.Fatalf("getBlock 4 printed %q", output)
+	}
+	if output := captureStdout(t, func() { cli.getBlockCount() }); !strings.Contains(output, "Block count: 4, best height: 3") {
+		t.Fatalf("getBlockCount printed %q", output)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// bucketMempool maps the txid of every pending transaction to the serialized transaction.
+const bucketMempool = "bucketMempool"
+
+// Mempool holds transactions that were validated against the UTXO set but aren't in a block yet.
+// No two pending transactions may spend the same output.
+type Mempool struct {
+	bc    *BlockChain
+	txs   map[string]*Transaction
+	spent map[string][]byte
+}
+
+func outpointKey(txid []byte, index int64) string {
+	return fmt.Sprintf("%x:%d", txid, index)
+}
+
+// NewMempool loads the pending transactions stored in the mempool bucket.
+func NewMempool(bc *BlockChain) (*Mempool, error) {
+	mp := Mempool{bc: bc, txs: make(map[string]*Transaction), spent: make(map[string][]byte)}
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		return mp.load(tx.Bucket([]byte(bucketMempool)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mp, nil
+}
+
+// load tracks the transactions stored in bucket, which may be nil.
+func (mp *Mempool) load(bucket *bolt.Bucket) error {
+	if bucket == nil {
+		return nil
+	}
+	return bucket.ForEach(func(k, v []byte) error {
+		transaction := DeserializeTransaction(v)
+		if transaction == nil {
+			return fmt.Errorf("failed to decode pending transaction %x", k)
+		}
+		mp.track(transaction)
+		return nil
+	})
+}
+
+// conflict reports the pending transaction that already spends an output tx spends.
+func (mp *Mempool) conflict(tx *Transaction) error {
+	for i, input := range tx.TXInputs {
+		if other := mp.spent[outpointKey(input.Txid, input.Index)]; other != nil {
+			return fmt.Errorf("input %d spends %x:%d, which pending transaction %x already spends",
+				i, input.Txid, input.Index, other)
+		}
+	}
+	return nil
+}
+
+func (mp *Mempool) track(tx *Transaction) {
+	mp.txs[string(tx.TXID)] = tx
+	for _, input := range tx.TXInputs {
+		mp.spent[outpointKey(input.Txid, input.Index)] = tx.TXID
+	}
+}
+
+func (mp *Mempool) untrack(tx *Transaction) {
+	delete(mp.txs, string(tx.TXID))
+	for _, input := range tx.TXInputs {
+		delete(mp.spent, outpointKey(input.Txid, input.Index))
+	}
+}
+
+// AddTransaction validates tx and stores it in the mempool.
+func (mp *Mempool) AddTransaction(tx *Transaction) error {
+	if tx.isCoinbaseTx() {
+		return errors.New("coinbase transactions can only appear in blocks")
+	}
+	if tx.Version != txVersion {
+		return fmt.Errorf("transaction version %d isn't the current version %d", tx.Version, txVersion)
+	}
+	if mp.txs[string(tx.TXID)] != nil {
+		return fmt.Errorf("transaction %x is already in the mempool", tx.TXID)
+	}
+	err := mp.conflict(tx)
+	if err != nil {
+		return err
+	}
+	if !mp.bc.verifyTransaction(tx) {
+		return fmt.Errorf("transaction %x failed verification", tx.TXID)
+	}
+	err = mp.bc.db.Update(func(boltTx *bolt.Tx) error {
+		bucket, err := boltTx.CreateBucketIfNotExists([]byte(bucketMempool))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(tx.TXID, tx.Serialize())
+	})
+	if err != nil {
+		return err
+	}
+	mp.track(tx)
+	mp.bc.events.publish(&Event{Type: EventMempoolTx, Tx: tx})
+	return nil
+}
+
+// Transactions returns the pending transactions, oldest first.
+func (mp *Mempool) Transactions() []*Transaction {
+	var txs []*Transaction
+	for _, tx := range mp.txs {
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		if txs[i].TimeStamp != txs[j].TimeStamp {
+			return txs[i].TimeStamp < txs[j].TimeStamp
+		}
+		return bytes.Compare(txs[i].TXID, txs[j].TXID) < 0
+	})
+	return txs
+}
+
+// IsSpent reports whether a pending transaction already spends txid:index.
+func (mp *Mempool) IsSpent(txid []byte, index int64) bool {
+	return mp.spent[outpointKey(txid, index)] != nil
+}
+
+// dependencyOrder returns txs with every transaction after the pending transactions
+// it spends from, which a reorganization can return to the mempool together.
+func (mp *Mempool) dependencyOrder(txs []*Transaction) []*Transaction {
+	var ordered []*Transaction
+	visited := make(map[string]bool)
+	var visit func(tx *Transaction)
+	visit = func(tx *Transaction) {
+		if visited[string(tx.TXID)] {
+			return
+		}
+		visited[string(tx.TXID)] = true
+		for _, input := range tx.TXInputs {
+			if parent := mp.txs[string(input.Txid)]; parent != nil {
+				visit(parent)
+			}
+		}
+		ordered = append(ordered, tx)
+	}
+	for _, tx := range txs {
+		visit(tx)
+	}
+	return ordered
+}
+
+// SelectTransactions revalidates the pending transactions against the UTXO set and
+// returns the ones that can go into the next block together with their total fee.
+// Transactions that are no longer valid are evicted.
+func (mp *Mempool) SelectTransactions() ([]*Transaction, int64) {
+	var selected, evicted []*Transaction
+	var fees int64
+	view := newUTXOView(mp.bc)
+	for _, tx := range mp.dependencyOrder(mp.Transactions()) {
+		prevTxs, err := mp.bc.checkInputs(tx, view)
+		var fee int64
+		if err == nil {
+			fee, err = tx.fee(prevTxs)
+		}
+		if err == nil && !tx.verify(prevTxs, blockVersion) {
+			err = errors.New("invalid signature")
+		}
+		total, ok := addAmount(fees, fee)
+		if err == nil && !ok {
+			err = errors.New("the total fee is out of range")
+		}
+		if err != nil {
+			fmt.Printf("Evict pending transaction %x: %v\n", tx.TXID, err)
+			evicted = append(evicted, tx)
+			continue
+		}
+		fees = total
+		view.connectTransaction(tx)
+		selected = append(selected, tx)
+	}
+	if len(evicted) != 0 {
+		err := mp.bc.db.Update(func(boltTx *bolt.Tx) error {
+			return removeFromMempool(boltTx, evicted)
+		})
+		if err != nil {
+			fmt.Println("Evict pending transactions err:", err)
+		}
+		for _, tx := range evicted {
+			mp.untrack(tx)
+		}
+	}
+	return selected, fees
+}
+
+// MinePendingTransactions mines a block on the tail that pays the subsidy and the
+// fees of the selected pending transactions to miner, and returns the new tail.
+func (bc *BlockChain) MinePendingTransactions(miner, data string) (*Block, error) {
+	txs, err := bc.pendingBlockTxs(miner, data)
+	if err != nil {
+		return nil, err
+	}
+	err = bc.AddBlock(txs)
+	if err != nil {
+		return nil, err
+	}
+	return bc.GetBlockByHash(bc.tail), nil
+}
+
+// pendingBlockTxs returns the transactions of the next block: a coinbase paying the
+// reward and fees to miner, followed by the selected pending transactions.
+func (bc *BlockChain) pendingBlockTxs(miner, data string) ([]*Transaction, error) {
+	mp, err := NewMempool(bc)
+	if err != nil {
+		return nil, err
+	}
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+	transfers, fees := mp.SelectTransactions()
+	fmt.Printf("Mining %d pending transactions with %s in fees\n", len(transfers), formatAmount(fees))
+	coinbaseTx := NewCoinbaseTx(miner, data, height+1, fees)
+	return append([]*Transaction{coinbaseTx}, transfers...), nil
+}
+
+// removeFromMempool deletes txs, and every pending transaction spending the same
+// outputs as one of them, from the mempool bucket.
+func removeFromMempool(tx *bolt.Tx, txs []*Transaction) error {
+	bucket := tx.Bucket([]byte(bucketMempool))
+	if bucket == nil {
+		return nil
+	}
+	spent := make(map[string]bool)
+	for _, transaction := range txs {
+		for _, input := range transaction.TXInputs {
+			spent[outpointKey(input.Txid, input.Index)] = true
+		}
+		err := bucket.Delete(transaction.TXID)
+		if err != nil {
+			return err
+		}
+	}
+	var conflicts [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		pending := DeserializeTransaction(v)
+		if pending == nil {
+			return nil
+		}
+		for _, input := range pending.TXInputs {
+			if spent[outpointKey(input.Txid, input.Index)] {
+				conflicts = append(conflicts, append([]byte{}, k...))
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, txid := range conflicts {
+		fmt.Printf("Drop pending transaction %x, it conflicts with the new block\n", txid)
+		err = bucket.Delete(txid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func newTestMempool(t *testing.T, bc *BlockChain) *Mempool {
+	t.Helper()
+	mp, err := NewMempool(bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mp
+}
+
+func TestMempoolRejectsConflictingSpends(t *testing.T) {
+	miner := newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesisCoinbase := bc.GetBlockByHash(bc.tail).Transactions[0]
+	spend := newTestSpend(t, miner, genesisCoinbase, 0, newWalletKeyPair().getAddress())
+	doubleSpend := newTestSpend(t, miner, genesisCoinbase, 0, newWalletKeyPair().getAddress())
+
+	mp := newTestMempool(t, bc)
+	err := mp.AddTransaction(spend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp.AddTransaction(spend) == nil {
+		t.Fatal("the same transaction was added twice")
+	}
+	if mp.AddTransaction(doubleSpend) == nil {
+		t.Fatal("a transaction spending a pending output was added")
+	}
+	if !mp.IsSpent(genesisCoinbase.TXID, 0) {
+		t.Fatal("the pending spend isn't tracked")
+	}
+	txs := newTestMempool(t, bc).Transactions()
+	if len(txs) != 1 || !bytes.Equal(txs[0].TXID, spend.TXID) {
+		t.Fatalf("the mempool holds %d transactions, want the first spend", len(txs))
+	}
+}
+
+func TestSelectTransactionsOrdersChildrenAfterParents(t *testing.T) {
+	miner, payee := newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesisCoinbase := bc.GetBlockByHash(bc.tail).Transactions[0]
+	parent := newTestSpend(t, miner, genesisCoinbase, 0, payee.getAddress())
+	// The child is older than its parent, so only the dependency order puts it last.
+	child := newTestSpend(t, payee, parent, 0, newWalletKeyPair().getAddress())
+	child.TimeStamp = parent.TimeStamp - 1
+	child.TXInputs[0].ScriptSig = nil
+	child.setHash()
+	if !child.sign(payee, map[string]*Transaction{string(parent.TXID): parent}) {
+		t.Fatal("failed to sign the child")
+	}
+
+	// A reorganization returns both to the mempool, which AddTransaction can't do
+	// for the child of a pending transaction.
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketMempool))
+		if err != nil {
+			return err
+		}
+		for _, transaction := range []*Transaction{child, parent} {
+			err = bucket.Put(transaction.TXID, transaction.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := newTestMempool(t, bc)
+	if txs := mp.Transactions(); len(txs) != 2 || !bytes.Equal(txs[0].TXID, child.TXID) {
+		t.Fatal("the child isn't the oldest pending transaction")
+	}
+	selected, fees := mp.SelectTransactions()
+	if len(selected) != 2 || !bytes.Equal(selected[0].TXID, parent.TXID) || !bytes.Equal(selected[1].TXID, child.TXID) || fees != 0 {
+		t.Fatalf("selected %d transactions with %d in fees, want the parent then the child", len(selected), fees)
+	}
+
+	_, err = bc.MinePendingTransactions(miner.getAddress(), "test")
+	if err != nil {
+		t.Fatal("the parent and child weren't mined:", err)
+	}
+	if len(newTestMempool(t, bc).Transactions()) != 0 {
+		t.Fatal("the mined transactions are still pending")
+	}
+}
+
+func TestConnectedBlockEvictsConflicts(t *testing.T) {
+	miner := newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesisCoinbase := bc.GetBlockByHash(bc.tail).Transactions[0]
+	pending := newTestSpend(t, miner, genesisCoinbase, 0, newWalletKeyPair().getAddress())
+	confirmed := newTestSpend(t, miner, genesisCoinbase, 0, newWalletKeyPair().getAddress())
+	err := newTestMempool(t, bc).AddTransaction(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.ProcessBlock(mineTestBlock(t, bc, miner.getAddress(), confirmed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := newTestMempool(t, bc)
+	if len(mp.Transactions()) != 0 || mp.IsSpent(genesisCoinbase.TXID, 0) {
+		t.Fatal("the spend conflicting with the block is still pending")
+	}
+}
+
+func TestMempoolPersistsAcrossReopening(t *testing.T) {
+	miner := newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesisCoinbase := bc.GetBlockByHash(bc.tail).Transactions[0]
+	spend := newTestSpend(t, miner, genesisCoinbase, 0, newWalletKeyPair().getAddress())
+	err := newTestMempool(t, bc).AddTransaction(spend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.db.Close()
+
+	bc, err = GetBlockChainInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.db.Close()
+	mp := newTestMempool(t, bc)
+	txs := mp.Transactions()
+	if len(txs) != 1 || !bytes.Equal(txs[0].Serialize(), spend.Serialize()) || !mp.IsSpent(genesisCoinbase.TXID, 0) {
+		t.Fatal("the pending transaction didn't survive reopening the chain")
+	}
+	if mp.AddTransaction(newTestSpend(t, miner, genesisCoinbase, 0, miner.getAddress())) == nil {
+		t.Fatal("the reopened mempool accepted a conflicting spend")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MerkleProof is the branch of sibling hashes linking a transaction to a block's MerkleRoot.
+// Bit i of Position tells whether the node at level i is a right child.
+type MerkleProof struct {
+	TXID     []byte
+	Position int64
+	Branch   [][]byte
+}
+
+func doubleSha256(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// merkleParent hashes two sibling nodes into their parent.
+func merkleParent(left, right []byte) []byte {
+	return doubleSha256(bytes.Join([][]byte{left, right}, []byte{}))
+}
+
+// nextMerkleLevel hashes a level of the tree into its parent level.
+// Like Bitcoin, an odd node out is paired with a copy of itself.
+func nextMerkleLevel(level [][]byte) [][]byte {
+	var parents [][]byte
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		parents = append(parents, merkleParent(level[i], right))
+	}
+	return parents
+}
+
+func merkleRoot(txids [][]byte) []byte {
+	if len(txids) == 0 {
+		return nil
+	}
+	level := txids
+	for len(level) > 1 {
+		level = nextMerkleLevel(level)
+	}
+	return level[0]
+}
+
+func (block *Block) txids() [][]byte {
+	var txids [][]byte
+	for _, tx := range block.Transactions {
+		txids = append(txids, tx.TXID)
+	}
+	return txids
+}
+
+// NewMerkleProof builds the branch proving that txid is included in block.
+func (block *Block) NewMerkleProof(txid []byte) (*MerkleProof, error) {
+	if block.Version < merkleTreeVersion {
+		return nil, errors.New("the block predates the merkle tree, no proof can be built")
+	}
+	level := block.txids()
+	position := -1
+	for i, id := range level {
+		if bytes.Equal(id, txid) {
+			position = i
+			break
+		}
+	}
+	if position < 0 {
+		return nil, fmt.Errorf("transaction %x is not in block %x", txid, block.Hash)
+	}
+
+	proof := MerkleProof{TXID: txid, Position: int64(position)}
+	index := position
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		proof.Branch = append(proof.Branch, level[sibling])
+		level = nextMerkleLevel(level)
+		index /= 2
+	}
+	return &proof, nil
+}
+
+// Verify recomputes the root from the branch and compares it with merkleRoot.
+func (proof *MerkleProof) Verify(merkleRoot []byte) bool {
+	if proof.Position < 0 || proof.Position >= 1<<uint(len(proof.Branch)) {
+		return false
+	}
+	hash := proof.TXID
+	index := proof.Position
+	for _, sibling := range proof.Branch {
+		if index&1 == 1 {
+			hash = merkleParent(sibling, hash)
+		} else {
+			hash = merkleParent(hash, sibling)
+		}
+		index >>= 1
+	}
+	return bytes.Equal(hash, merkleRoot)
+}
+
+// String encodes the proof as <POSITION>:<HASH>,<HASH>,... for the command line.
+func (proof *MerkleProof) String() string {
+	var hashes []string
+	for _, hash := range proof.Branch {
+		hashes = append(hashes, hex.EncodeToString(hash))
+	}
+	return fmt.Sprintf("%d:%s", proof.Position, strings.Join(hashes, ","))
+}
+
+func parseMerkleProof(txid []byte, src string) (*MerkleProof, error) {
+	parts := strings.SplitN(src, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("the proof should look like <POSITION>:<HASH>,<HASH>,...")
+	}
+	position, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	proof := MerkleProof{TXID: txid, Position: position}
+	if len(parts[1]) == 0 {
+		return &proof, nil
+	}
+	for _, hashStr := range strings.Split(parts[1], ",") {
+		hash, err := hex.DecodeString(hashStr)
+		if err != nil {
+			return nil, err
+		}
+		if len(hash) != sha256.Size {
+			return nil, fmt.Errorf("the branch hash %s should be %d bytes", hashStr, sha256.Size)
+		}
+		proof.Branch = append(proof.Branch, hash)
+	}
+	return &proof, nil
+}
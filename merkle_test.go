@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newTestMerkleBlock returns a block of n transactions whose txids are 1, 2, ... n
+// repeated over 32 bytes.
+func newTestMerkleBlock(n int) *Block {
+	block := &Block{Version: blockVersion}
+	for i := 1; i <= n; i++ {
+		block.Transactions = append(block.Transactions, &Transaction{TXID: bytes.Repeat([]byte{byte(i)}, 32)})
+	}
+	block.MerkleRoot = merkleRoot(block.txids())
+	return block
+}
+
+func TestMerkleRoot(t *testing.T) {
+	one := newTestMerkleBlock(1)
+	if !bytes.Equal(one.MerkleRoot, one.Transactions[0].TXID) {
+		t.Fatal("the root of a single transaction isn't its txid")
+	}
+
+	// The odd leaf out is paired with a copy of itself.
+	three := newTestMerkleBlock(3)
+	ids := three.txids()
+	want := merkleParent(merkleParent(ids[0], ids[1]), merkleParent(ids[2], ids[2]))
+	if !bytes.Equal(three.MerkleRoot, want) {
+		t.Fatalf("the root of 3 transactions is %x, want %x", three.MerkleRoot, want)
+	}
+	if !bytes.Equal(merkleRoot(append(ids, ids[2])), want) {
+		t.Fatal("duplicating the last of 3 transactions changed the root")
+	}
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 8} {
+		block := newTestMerkleBlock(n)
+		for i, tx := range block.Transactions {
+			proof, err := block.NewMerkleProof(tx.TXID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proof.Position != int64(i) || !proof.Verify(block.MerkleRoot) {
+				t.Fatalf("the proof of transaction %d of %d doesn't verify", i, n)
+			}
+			parsed, err := parseMerkleProof(tx.TXID, proof.String())
+			if err != nil || !parsed.Verify(block.MerkleRoot) {
+				t.Fatalf("the proof of transaction %d of %d doesn't verify after a round trip: %v", i, n, err)
+			}
+		}
+	}
+
+	block := newTestMerkleBlock(5)
+	if _, err := block.NewMerkleProof(bytes.Repeat([]byte{9}, 32)); err == nil {
+		t.Fatal("a proof was built for a transaction outside the block")
+	}
+	proof, _ := block.NewMerkleProof(block.Transactions[2].TXID)
+
+	flipped := *proof
+	flipped.Branch = append([][]byte{}, proof.Branch...)
+	flipped.Branch[1] = append([]byte{}, proof.Branch[1]...)
+	flipped.Branch[1][0] ^= 1
+	if flipped.Verify(block.MerkleRoot) {
+		t.Fatal("a proof with a flipped sibling verifies")
+	}
+
+	for _, position := range []int64{3, -1, 8} {
+		wrong := *proof
+		wrong.Position = position
+		if wrong.Verify(block.MerkleRoot) {
+			t.Fatalf("a proof with position %d verifies", position)
+		}
+	}
+
+	other := *proof
+	other.TXID = block.Transactions[3].TXID
+	if other.Verify(block.MerkleRoot) {
+		t.Fatal("the proof of a transaction verifies for another")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/boltdb/bolt"
+)
+
+// bucketMeta holds information about the database itself, such as its format version.
+const bucketMeta = "bucketMeta"
+const dbVersionKey = "dbVersionKey"
+
+// dbVersion is the current database format:
+//
+//	0: amounts stored as float64 coins
+//	1: amounts stored as int64 base units
+//	2: blocks, headers, transactions and unspent outputs stored in the canonical encoding
+const dbVersion = 2
+
+func readDBVersion(tx *bolt.Tx) uint64 {
+	bucket := tx.Bucket([]byte(bucketMeta))
+	if bucket == nil {
+		return 0
+	}
+	value := bucket.Get([]byte(dbVersionKey))
+	if len(value) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(value)
+}
+
+func writeDBVersion(tx *bolt.Tx, version uint64) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(bucketMeta))
+	if err != nil {
+		return err
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, version)
+	return bucket.Put([]byte(dbVersionKey), value)
+}
+
+type floatTXOutput struct {
+	ScriptPubKeyHash []byte
+	Value            float64
+}
+
+type floatTransaction struct {
+	TXID      []byte
+	TXInputs  []TXInput
+	TXOutputs []floatTXOutput
+	TimeStamp uint64
+}
+
+type floatBlock struct {
+	Version      uint64
+	PrevHash     []byte
+	MerkleRoot   []byte
+	TimeStamp    uint64
+	Bits         uint64
+	Nonce        uint64
+	Height       uint64
+	Hash         []byte
+	Transactions []*floatTransaction
+}
+
+// migrateFloatAmounts rewrites every stored block with its float64 coin values
+// converted to base units, still gob encoded as in version 1. TXIDs and block
+// hashes are kept as they were mined.
+func migrateFloatAmounts(tx *bolt.Tx) error {
+	bucket := tx.Bucket([]byte(bucketBlock))
+	updated := make(map[string][]byte)
+	err := bucket.ForEach(func(k, v []byte) error {
+		if bytes.Equal(k, []byte(lastBlockHashKey)) {
+			return nil
+		}
+		var old floatBlock
+		err := gob.NewDecoder(bytes.NewReader(v)).Decode(&old)
+		if err != nil {
+			return fmt.Errorf("decode block %x: %v", k, err)
+		}
+		block := Block{
+			Version:    old.Version,
+			PrevHash:   old.PrevHash,
+			MerkleRoot: old.MerkleRoot,
+			TimeStamp:  old.TimeStamp,
+			Bits:       old.Bits,
+			Nonce:      old.Nonce,
+			Height:     old.Height,
+			Hash:       old.Hash,
+		}
+		for _, oldTx := range old.Transactions {
+			newTx := Transaction{TXID: oldTx.TXID, TXInputs: oldTx.TXInputs, TimeStamp: oldTx.TimeStamp}
+			for _, output := range oldTx.TXOutputs {
+				value := math.Round(output.Value * float64(coinUnit))
+				if value < 0 || value > float64(maxMoney) {
+					return fmt.Errorf("output value %f in block %x is out of range", output.Value, k)
+				}
+				newTx.TXOutputs = append(newTx.TXOutputs, TXOutput{output.ScriptPubKeyHash, int64(value)})
+			}
+			block.Transactions = append(block.Transactions, &newTx)
+		}
+		var buffer bytes.Buffer
+		err = gob.NewEncoder(&buffer).Encode(&block)
+		if err != nil {
+			return fmt.Errorf("encode block %x: %v", k, err)
+		}
+		updated[string(k)] = buffer.Bytes()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return putAll(bucket, updated)
+}
+
+// migrateCanonicalEncoding rewrites the gob encoded blocks and headers in the
+// canonical encoding. Their transactions become legacyTxVersion transactions that
+// keep their TXIDs, and every block is read back to check that its hash and TXIDs
+// survive the new encoding. Pending transactions are dropped: as legacy transactions
+// they can no longer be mined. The tx index, like the other chain indexes, is
+// dropped by MigrateBlockChain and rebuilt in the canonical encoding.
+func migrateCanonicalEncoding(tx *bolt.Tx) error {
+	updated := make(map[string][]byte)
+	err := tx.Bucket([]byte(bucketBlock)).ForEach(func(k, v []byte) error {
+		if bytes.Equal(k, []byte(lastBlockHashKey)) {
+			return nil
+		}
+		var block Block
+		err := gob.NewDecoder(bytes.NewReader(v)).Decode(&block)
+		if err != nil {
+			return fmt.Errorf("decode block %x: %v", k, err)
+		}
+		data := block.Serialize()
+		decoded := Deserialize(data)
+		if decoded == nil || !bytes.Equal(decoded.Hash, block.Hash) || len(decoded.Transactions) != len(block.Transactions) {
+			return fmt.Errorf("block %x doesn't survive the canonical encoding", k)
+		}
+		for i, transaction := range block.Transactions {
+			if !bytes.Equal(decoded.Transactions[i].TXID, transaction.TXID) {
+				return fmt.Errorf("transaction %x of block %x doesn't survive the canonical encoding", transaction.TXID, k)
+			}
+		}
+		updated[string(k)] = data
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = putAll(tx.Bucket([]byte(bucketBlock)), updated)
+	if err != nil {
+		return err
+	}
+
+	if headers := tx.Bucket([]byte(bucketHeaders)); headers != nil {
+		updated = make(map[string][]byte)
+		err = headers.ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, []byte(bestHeaderKey)) {
+				return nil
+			}
+			var h BlockHeader
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&h)
+			if err != nil {
+				return fmt.Errorf("decode header %x: %v", k, err)
+			}
+			data := h.Serialize()
+			if decoded := deserializeHeader(data); decoded == nil || !bytes.Equal(decoded.Hash, h.Hash) {
+				return fmt.Errorf("header %x doesn't survive the canonical encoding", k)
+			}
+			updated[string(k)] = data
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = putAll(headers, updated)
+		if err != nil {
+			return err
+		}
+	}
+
+	if mempool := tx.Bucket([]byte(bucketMempool)); mempool != nil {
+		fmt.Printf("Dropping %d pending transactions...\n", mempool.Stats().KeyN)
+		err = tx.DeleteBucket([]byte(bucketMempool))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putAll(bucket *bolt.Bucket, values map[string][]byte) error {
+	for k, v := range values {
+		err := bucket.Put([]byte(k), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateBlockChain upgrades blockchain.db to dbVersion in place. The derived
+// indexes are dropped and rebuilt from the migrated blocks on the next open.
+func MigrateBlockChain() error {
+	if !isFileExist(blockchainDBFile) {
+		return errors.New("The flie is not existed, please create it!")
+	}
+	db, err := bolt.Open(blockchainDBFile, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketBlock)) == nil {
+			return errors.New("bucket shouldn't be nil")
+		}
+		version := readDBVersion(tx)
+		if version >= dbVersion {
+			fmt.Printf("The database is already at version %d\n", version)
+			return nil
+		}
+		if version < 1 {
+			fmt.Println("Migrating float amounts to base units...")
+			err := migrateFloatAmounts(tx)
+			if err != nil {
+				return err
+			}
+		}
+		if version < 2 {
+			fmt.Println("Migrating blocks and headers to the canonical encoding...")
+			err := migrateCanonicalEncoding(tx)
+			if err != nil {
+				return err
+			}
+		}
+		// The undo data is rebuilt together with the UTXO set.
+		buckets := []string{bucketUndo}
+		for _, index := range chainIndexes {
+			buckets = append(buckets, index.bucket)
+		}
+		for _, bucket := range buckets {
+			if tx.Bucket([]byte(bucket)) != nil {
+				err := tx.DeleteBucket([]byte(bucket))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return writeDBVersion(tx, dbVersion)
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// newFloatBlock returns a version 0 block holding txs on top of prev, with the
+// merkle root and hash such blocks were stored with.
+func newFloatBlock(prev *floatBlock, txs ...*floatTransaction) *floatBlock {
+	block := &floatBlock{Version: 0, TimeStamp: 1600000000, Bits: initialBits, Transactions: txs}
+	if prev != nil {
+		block.PrevHash, block.Height, block.TimeStamp = prev.Hash, prev.Height+1, prev.TimeStamp+1
+	}
+	var info [][]byte
+	for _, tx := range txs {
+		info = append(info, tx.TXID)
+	}
+	root := sha256.Sum256(bytes.Join(info, []byte{}))
+	block.MerkleRoot = root[:]
+	block.Hash = headerHash(&Block{
+		Version:    block.Version,
+		PrevHash:   block.PrevHash,
+		MerkleRoot: block.MerkleRoot,
+		TimeStamp:  block.TimeStamp,
+		Bits:       block.Bits,
+		Nonce:      block.Nonce,
+		Height:     block.Height,
+	})
+	return block
+}
+
+// writeFloatChain writes a dbVersion 0 blockchain.db holding blocks.
+func writeFloatChain(t *testing.T, blocks ...*floatBlock) {
+	t.Helper()
+	db, err := bolt.Open(blockchainDBFile, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte(bucketBlock))
+		if err != nil {
+			return err
+		}
+		for _, block := range blocks {
+			var buffer bytes.Buffer
+			err = gob.NewEncoder(&buffer).Encode(block)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put(block.Hash, buffer.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte(lastBlockHashKey), blocks[len(blocks)-1].Hash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateFloatAmounts(t *testing.T) {
+	chdirTemp(t)
+	a, b := newWalletKeyPair(), newWalletKeyPair()
+	hashA, hashB := getPubKeyHashFromPubKey(a.PubKey), getPubKeyHashFromPubKey(b.PubKey)
+	coinbase := &floatTransaction{
+		TXID:      bytes.Repeat([]byte{1}, 32),
+		TXInputs:  []TXInput{{Index: -1, ScriptSig: []byte("genesis")}},
+		TXOutputs: []floatTXOutput{{hashA, 12.5}},
+	}
+	genesis := newFloatBlock(nil, coinbase)
+	// 0.29 and 12.21 aren't exact in float64 and must round to the nearest base unit.
+	spend := &floatTransaction{
+		TXID:      bytes.Repeat([]byte{2}, 32),
+		TXInputs:  []TXInput{{Txid: coinbase.TXID, Index: 0, PubKey: a.PubKey}},
+		TXOutputs: []floatTXOutput{{hashB, 0.29}, {hashA, 12.21}},
+	}
+	coinbase1 := &floatTransaction{
+		TXID:      bytes.Repeat([]byte{3}, 32),
+		TXInputs:  []TXInput{{Index: -1, ScriptSig: []byte("block 1")}},
+		TXOutputs: []floatTXOutput{{hashB, 12.5}},
+	}
+	tip := newFloatBlock(genesis, coinbase1, spend)
+	writeFloatChain(t, genesis, tip)
+
+	if _, err := GetBlockChainInstance(); err == nil {
+		t.Fatal("a version 0 database was opened without a migration")
+	}
+	err := MigrateBlockChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.db.Close()
+
+	if !bytes.Equal(bc.tail, tip.Hash) {
+		t.Fatalf("the tail is %x, want %x", bc.tail, tip.Hash)
+	}
+	block := bc.GetBlockByHash(tip.Hash)
+	if block == nil || len(block.Transactions) != 2 || block.Transactions[1].Version != legacyTxVersion {
+		t.Fatal("the migrated block doesn't hold the legacy transactions")
+	}
+	if !bytes.Equal(block.Transactions[1].TXID, spend.TXID) {
+		t.Fatal("the migration changed a TXID")
+	}
+	if balance(bc, a) != 1221000000 || balance(bc, b) != 1250000000+29000000 {
+		t.Fatalf("the migrated UTXO set holds %d and %d", balance(bc, a), balance(bc, b))
+	}
+	if bc.GetBlockByHash(genesis.Hash) == nil || bc.GetBlockByHash(genesis.Hash).Transactions[0].TXOutputs[0].Value != 1250000000 {
+		t.Fatal("the genesis block wasn't migrated")
+	}
+	bc.db.Close()
+
+	// Migrating again leaves the database as it is.
+	err = MigrateBlockChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationRejectsOutOfRangeAmounts(t *testing.T) {
+	chdirTemp(t)
+	genesis := newFloatBlock(nil, &floatTransaction{
+		TXID:      bytes.Repeat([]byte{1}, 32),
+		TXInputs:  []TXInput{{Index: -1}},
+		TXOutputs: []floatTXOutput{{bytes.Repeat([]byte{4}, 20), -0.5}},
+	})
+	writeFloatChain(t, genesis)
+	if MigrateBlockChain() == nil {
+		t.Fatal("a negative amount was migrated")
+	}
+
+	// The failed migration left the database at version 0.
+	db, err := bolt.Open(blockchainDBFile, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.View(func(tx *bolt.Tx) error {
+		if version := readDBVersion(tx); version != 0 {
+			t.Fatalf("the database is at version %d after a failed migration", version)
+		}
+		return nil
+	})
+}
@@ -2,9 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ProofOfWork struct {
@@ -16,31 +24,132 @@ func NewProofOfWork(block *Block) *ProofOfWork {
 	pow := ProofOfWork{
 		block: block,
 	}
-	targetStr := "0001000000000000000000000000000000000000000000000000000000000000"
-	tmpBigInt := new(big.Int)
-	tmpBigInt.SetString(targetStr, 16)
-	pow.target = tmpBigInt
+	pow.target = compactToBig(uint32(normalizeBits(block.Bits)))
 	return &pow
 }
 
-func (pow *ProofOfWork) Run() ([]byte, uint64) {
-	var nonce uint64
-	var hash [32]byte
+// maxNonce is the largest nonce a block of timeRulesVersion may use, which makes
+// the header nonce effectively 32 bits wide.
+var maxNonce uint64 = math.MaxUint32
+
+var errNonceExhausted = errors.New("the nonce range is exhausted")
+
+// miningWorkers is the number of goroutines NewBlock mines with; 1 selects the
+// deterministic single-thread Run.
+var miningWorkers = runtime.NumCPU()
+
+// Run searches the nonces in order from 0 to maxNonce on the calling goroutine, so
+// the same block always yields the same nonce. Like RunParallel it stops when ctx is
+// cancelled and returns errNonceExhausted when no nonce works.
+func (pow *ProofOfWork) Run(ctx context.Context) ([]byte, uint64, error) {
+	var hashes uint64
 	fmt.Println("Start mining...")
-	for {
-		fmt.Printf("%x\r", hash[:])
-		data := pow.PrepareData(nonce)
-		hash = sha256.Sum256(data)
-		tmpInt := new(big.Int)
+	start := time.Now()
+	hash, nonce, ok := pow.search(ctx, 0, maxNonce, &hashes)
+	if !ok {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, errNonceExhausted
+	}
+	pow.report(hash, nonce, hashes, time.Since(start))
+	return hash, nonce, nil
+}
+
+// RunParallel splits the nonces from 0 to maxNonce into one range per worker and
+// stops every worker as soon as one of them finds a solution or parent is cancelled.
+// It returns errNonceExhausted when no nonce in the range works.
+func (pow *ProofOfWork) RunParallel(parent context.Context, workers int) ([]byte, uint64, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if uint64(workers) > maxNonce {
+		workers = int(maxNonce)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	type solution struct {
+		hash  []byte
+		nonce uint64
+	}
+	found := make(chan solution, workers)
+	var hashes uint64
+	var wg sync.WaitGroup
+	fmt.Printf("Start mining with %d workers...\n", workers)
+	start := time.Now()
+	span := maxNonce / uint64(workers)
+	for i := 0; i < workers; i++ {
+		first := uint64(i) * span
+		last := first + span - 1
+		if i == workers-1 {
+			last = maxNonce
+		}
+		wg.Add(1)
+		go func(first, last uint64) {
+			defer wg.Done()
+			hash, nonce, ok := pow.search(ctx, first, last, &hashes)
+			if ok {
+				found <- solution{hash, nonce}
+				cancel()
+			}
+		}(first, last)
+	}
+	wg.Wait()
+	close(found)
+
+	sol, ok := <-found
+	if !ok {
+		if parent.Err() != nil {
+			return nil, 0, parent.Err()
+		}
+		return nil, 0, errNonceExhausted
+	}
+	pow.report(sol.hash, sol.nonce, atomic.LoadUint64(&hashes), time.Since(start))
+	return sol.hash, sol.nonce, nil
+}
+
+// search tries the nonces from first to last inclusive and adds the number of
+// hashes it computed to counter.
+func (pow *ProofOfWork) search(ctx context.Context, first, last uint64, counter *uint64) ([]byte, uint64, bool) {
+	const batch = 4096
+	data := pow.PrepareData(0)
+	nonceBytes := data[len(data)-8:]
+	tmpInt := new(big.Int)
+	var done uint64
+	for nonce := first; ; nonce++ {
+		binary.LittleEndian.PutUint64(nonceBytes, nonce)
+		hash := sha256.Sum256(data)
+		done++
 		tmpInt.SetBytes(hash[:])
 		if tmpInt.Cmp(pow.target) == -1 {
-			fmt.Printf("Successful mining, hash : %x, nonce : %d\n", hash[:], nonce)
+			atomic.AddUint64(counter, done)
+			return hash[:], nonce, true
+		}
+		if nonce == last {
 			break
-		} else {
-			nonce++
 		}
+		if done == batch {
+			atomic.AddUint64(counter, done)
+			done = 0
+			if ctx.Err() != nil {
+				return nil, 0, false
+			}
+		}
+	}
+	atomic.AddUint64(counter, done)
+	return nil, 0, false
+}
+
+func (pow *ProofOfWork) report(hash []byte, nonce uint64, hashes uint64, elapsed time.Duration) {
+	fmt.Printf("Successful mining, hash : %x, nonce : %d\n", hash, nonce)
+	// A fast enough solution takes less time than the clock resolution.
+	if elapsed <= 0 {
+		fmt.Printf("%d hashes in %v\n", hashes, elapsed)
+		return
 	}
-	return hash[:], nonce
+	rate := float64(hashes) / elapsed.Seconds() / 1000
+	fmt.Printf("%d hashes in %v, hashrate : %.2f kH/s\n", hashes, elapsed.Round(time.Millisecond), rate)
 }
 
 func (pow *ProofOfWork) PrepareData(nonce uint64) []byte {
@@ -57,7 +166,16 @@ func (pow *ProofOfWork) PrepareData(nonce uint64) []byte {
 	return data
 }
 
-func (pow *ProofOfWork) IsValid() bool {
+// IsValid checks that the block carries expectedBits and that its hash meets the target derived from them.
+func (pow *ProofOfWork) IsValid(expectedBits uint64) bool {
+	if normalizeBits(pow.block.Bits) != expectedBits {
+		fmt.Printf("The block bits %08x don't match the expected bits %08x\n", pow.block.Bits, expectedBits)
+		return false
+	}
+	if pow.target.Sign() <= 0 || pow.target.Cmp(powLimit) > 0 {
+		fmt.Println("The block target is out of range")
+		return false
+	}
 	data := pow.PrepareData(pow.block.Nonce)
 	hash := sha256.Sum256(data)
 	tmpInt := new(big.Int)
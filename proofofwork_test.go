@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newTestBlockTxs() []*Transaction {
+	return []*Transaction{NewCoinbaseTx(newWalletKeyPair().getAddress(), "test", 1, 0)}
+}
+
+func setMiningWorkers(t *testing.T, n int) {
+	t.Helper()
+	old := miningWorkers
+	miningWorkers = n
+	t.Cleanup(func() { miningWorkers = old })
+}
+
+func TestSingleThreadMiningIsReproducible(t *testing.T) {
+	setMiningWorkers(t, 1)
+	txs := newTestBlockTxs()
+	// A TimeStamp in the future keeps NewBlock from taking it from the clock.
+	timeStamp := uint64(time.Now().Unix()) + 3600
+	first := NewBlock(txs, []byte("parent"), 1, initialBits, timeStamp)
+	second := NewBlock(txs, []byte("parent"), 1, initialBits, timeStamp)
+	if first == nil || second == nil {
+		t.Fatal("failed to mine the block")
+	}
+	if first.TimeStamp != timeStamp || second.TimeStamp != timeStamp {
+		t.Fatal("the TimeStamp changed while mining")
+	}
+	if first.Nonce != second.Nonce || !bytes.Equal(first.Hash, second.Hash) {
+		t.Fatalf("mining the same block found nonces %d and %d", first.Nonce, second.Nonce)
+	}
+	// Run searches from 0, so no smaller nonce meets the target.
+	pow := NewProofOfWork(first)
+	for nonce := uint64(0); nonce < first.Nonce; nonce++ {
+		hash := sha256.Sum256(pow.PrepareData(nonce))
+		if new(big.Int).SetBytes(hash[:]).Cmp(pow.target) < 0 {
+			t.Fatalf("nonce %d meets the target before %d", nonce, first.Nonce)
+		}
+	}
+}
+
+func TestParallelMiningMeetsTarget(t *testing.T) {
+	block := &Block{Version: blockVersion, PrevHash: []byte("parent"), TimeStamp: uint64(time.Now().Unix()),
+		Bits: initialBits, Height: 1, Transactions: newTestBlockTxs()}
+	block.HashTransactionMerkleRoot()
+	pow := NewProofOfWork(block)
+	hash, nonce, err := pow.RunParallel(context.Background(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(pow.PrepareData(nonce))
+	if !bytes.Equal(hash, sum[:]) {
+		t.Fatal("the returned hash isn't the hash of the header with the returned nonce")
+	}
+	block.Nonce = nonce
+	if !NewProofOfWork(block).IsValid(initialBits) {
+		t.Fatalf("nonce %d doesn't meet the target", nonce)
+	}
+}
+
+func TestMiningStopsWhenCancelled(t *testing.T) {
+	block := &Block{Version: blockVersion, Bits: initialBits, Transactions: newTestBlockTxs()}
+	block.HashTransactionMerkleRoot()
+	pow := NewProofOfWork(block)
+	// No hash is below 1, so only the cancellation ends the search.
+	pow.target = big.NewInt(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := pow.Run(ctx)
+	if err != context.Canceled {
+		t.Fatalf("Run returned %v, want %v", err, context.Canceled)
+	}
+	_, _, err = pow.RunParallel(ctx, 4)
+	if err != context.Canceled {
+		t.Fatalf("RunParallel returned %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// bucketChainWork maps a block hash to the total work of the chain ending in that block.
+const bucketChainWork = "bucketChainWork"
+
+// bucketTips holds the hash of every stored block that no other stored block builds on.
+const bucketTips = "bucketTips"
+
+// bucketInvalid holds the hashes of blocks whose transactions failed validation.
+const bucketInvalid = "bucketInvalid"
+
+var errKnownBlock = errors.New("the block is already stored")
+
+// blockWork returns the expected number of hashes needed to mine a block with bits,
+// 2^256 / (target + 1).
+func blockWork(bits uint64) *big.Int {
+	target := compactToBig(uint32(normalizeBits(bits)))
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// indexChainWork records the work of the chain ending in block; its parent must be indexed already.
+func indexChainWork(tx *bolt.Tx, block *Block) error {
+	bucket := tx.Bucket([]byte(bucketChainWork))
+	if bucket == nil {
+		return errors.New("chain work bucket shouldn't be nil when indexing the block")
+	}
+	work := blockWork(block.Bits)
+	if len(block.PrevHash) != 0 {
+		work.Add(work, new(big.Int).SetBytes(bucket.Get(block.PrevHash)))
+	}
+	return bucket.Put(block.Hash, work.Bytes())
+}
+
+// indexTip records block as a tip in place of its parent.
+func indexTip(tx *bolt.Tx, block *Block) error {
+	bucket := tx.Bucket([]byte(bucketTips))
+	if bucket == nil {
+		return errors.New("tips bucket shouldn't be nil when indexing the block")
+	}
+	if len(block.PrevHash) != 0 {
+		err := bucket.Delete(block.PrevHash)
+		if err != nil {
+			return err
+		}
+	}
+	return bucket.Put(block.Hash, []byte{1})
+}
+
+func (bc *BlockChain) getChainWork(hash []byte) *big.Int {
+	work := new(big.Int)
+	bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketChainWork))
+		if bucket != nil {
+			work.SetBytes(bucket.Get(hash))
+		}
+		return nil
+	})
+	return work
+}
+
+func (bc *BlockChain) isInvalidBlock(hash []byte) bool {
+	invalid := false
+	bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketInvalid))
+		invalid = bucket != nil && bucket.Get(hash) != nil
+		return nil
+	})
+	return invalid
+}
+
+// isMainChain reports whether block is part of the chain ending in the tail.
+func (bc *BlockChain) isMainChain(block *Block) bool {
+	mainBlock := bc.GetBlockByHeight(block.Height)
+	return mainBlock != nil && bytes.Equal(mainBlock.Hash, block.Hash)
+}
+
+func (bc *BlockChain) getUndo(hash []byte) []UTXOInfo {
+	var undo []UTXOInfo
+	bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketUndo))
+		if bucket == nil {
+			return nil
+		}
+		if data := bucket.Get(hash); data != nil {
+			undo = deserializeUTXOs(data)
+		}
+		return nil
+	})
+	return undo
+}
+
+// ProcessBlock accepts a block built on any stored block. A block extending the tail
+// is validated and connected right away; a block on a side chain is stored, and if
+// its chain now has more work than the main chain the chain is reorganized onto it.
+func (bc *BlockChain) ProcessBlock(block *Block) error {
+	if bc.hasBlock(block.Hash) {
+		return errKnownBlock
+	}
+	if len(block.PrevHash) == 0 {
+		return ruleError(ErrBadGenesis, "the chain already has a genesis block")
+	}
+	if bc.isInvalidBlock(block.PrevHash) {
+		return ruleError(ErrInvalidAncestor, "the parent block %x is invalid", block.PrevHash)
+	}
+	// The parent header alone isn't enough, the side chain must be complete to reorganize onto it.
+	if !bc.hasBlock(block.PrevHash) {
+		return ruleError(ErrOrphanBlock, "the parent block %x is unknown", block.PrevHash)
+	}
+	err := bc.checkBlockHeader(block)
+	if err != nil {
+		return err
+	}
+	// A body that doesn't match its merkle root says nothing about the block hash,
+	// so only blocks with invalid inputs are marked invalid below.
+	err = checkBlockTransactions(block)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(block.PrevHash, bc.tail) {
+		err = bc.checkBlockInputs(block, newUTXOView(bc))
+		if err != nil {
+			bc.markInvalid([]*Block{block})
+			return err
+		}
+		err = bc.db.Update(func(tx *bolt.Tx) error {
+			return connectBlock(tx, block)
+		})
+		if err != nil {
+			return err
+		}
+		// Only a committed update moves the tail.
+		bc.tail = block.Hash
+		bc.publishBlocks(EventBlockConnected, block)
+		return nil
+	}
+
+	err = bc.db.Update(func(tx *bolt.Tx) error {
+		return storeBlock(tx, block)
+	})
+	if err != nil {
+		return err
+	}
+	work := bc.getChainWork(block.Hash)
+	if work.Cmp(bc.getChainWork(bc.tail)) <= 0 {
+		fmt.Printf("Stored side chain block %x at height %d\n", block.Hash, block.Height)
+		return nil
+	}
+	return bc.reorganize(block)
+}
+
+// reorganize makes newTip the tail. The main chain blocks after the fork point are
+// disconnected and the side chain blocks are validated and connected in their place,
+// all in one bolt transaction. If a side chain block is invalid, it and its descendants
+// are marked invalid and the main chain is left untouched.
+func (bc *BlockChain) reorganize(newTip *Block) error {
+	var attach []*Block
+	fork := newTip
+	for !bc.isMainChain(fork) {
+		attach = append(attach, fork)
+		fork = bc.GetBlockByHash(fork.PrevHash)
+		if fork == nil {
+			return fmt.Errorf("the side chain of block %x doesn't reach the main chain", newTip.Hash)
+		}
+	}
+	var detach []*Block
+	for hash := bc.tail; !bytes.Equal(hash, fork.Hash); {
+		block := bc.GetBlockByHash(hash)
+		if block == nil {
+			return fmt.Errorf("failed to read main chain block %x", hash)
+		}
+		detach = append(detach, block)
+		hash = block.PrevHash
+	}
+
+	view := newUTXOView(bc)
+	for _, block := range detach {
+		err := view.disconnectBlock(block, bc.getUndo(block.Hash))
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(attach) - 1; i >= 0; i-- {
+		err := bc.checkBlockInputs(attach[i], view)
+		if err == nil {
+			continue
+		}
+		fmt.Printf("Side chain block %x is invalid: %v\n", attach[i].Hash, err)
+		bc.markInvalid(attach[:i+1])
+		return err
+	}
+
+	fmt.Printf("Reorganize at fork point %x (height %d): disconnect %d blocks, connect %d blocks\n",
+		fork.Hash, fork.Height, len(detach), len(attach))
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		for _, block := range detach {
+			err := disconnectBlock(tx, block)
+			if err != nil {
+				return err
+			}
+		}
+		for i := len(attach) - 1; i >= 0; i-- {
+			err := connectBlock(tx, attach[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bc.tail = newTip.Hash
+	bc.publishBlocks(EventBlockDisconnected, detach...)
+	for i := len(attach) - 1; i >= 0; i-- {
+		bc.publishBlocks(EventBlockConnected, attach[i])
+	}
+	return nil
+}
+
+// markInvalid records blocks as invalid so that no block or header building on them
+// is accepted. The best header may build on them too, so the tail becomes the best
+// header again until better headers arrive.
+func (bc *BlockChain) markInvalid(blocks []*Block) {
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketInvalid))
+		if err != nil {
+			return err
+		}
+		for _, block := range blocks {
+			err = bucket.Put(block.Hash, []byte{1})
+			if err != nil {
+				return err
+			}
+		}
+		headers := tx.Bucket([]byte(bucketHeaders))
+		if headers == nil {
+			return nil
+		}
+		return headers.Put([]byte(bestHeaderKey), bc.tail)
+	})
+	if err != nil {
+		fmt.Println("Mark invalid blocks err:", err)
+	}
+}
+
+// disconnectBlock removes block, which must be the tail, from the main chain: it undoes
+// its UTXO set changes, drops its transactions from the tx and height indexes, makes its
+// parent the tail and returns its transactions to the mempool, except those spending an
+// output a pending transaction already spends.
+// It must run inside the same bolt transaction as the rest of the reorganization.
+func disconnectBlock(tx *bolt.Tx, block *Block) error {
+	utxoBucket := tx.Bucket([]byte(bucketUTXO))
+	txIndexBucket := tx.Bucket([]byte(bucketTxIndex))
+	heightBucket := tx.Bucket([]byte(bucketHeight))
+	if utxoBucket == nil || txIndexBucket == nil || heightBucket == nil {
+		return errors.New("the chain indexes shouldn't be nil when disconnecting a block")
+	}
+	undoBucket, err := tx.CreateBucketIfNotExists([]byte(bucketUndo))
+	if err != nil {
+		return err
+	}
+	mempoolBucket, err := tx.CreateBucketIfNotExists([]byte(bucketMempool))
+	if err != nil {
+		return err
+	}
+	pending := Mempool{txs: make(map[string]*Transaction), spent: make(map[string][]byte)}
+	err = pending.load(mempoolBucket)
+	if err != nil {
+		return err
+	}
+	var undo []UTXOInfo
+	if data := undoBucket.Get(block.Hash); data != nil {
+		undo = deserializeUTXOs(data)
+	}
+
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		transaction := block.Transactions[i]
+		err = utxoBucket.Delete(transaction.TXID)
+		if err != nil {
+			return err
+		}
+		err = txIndexBucket.Delete(transaction.TXID)
+		if err != nil {
+			return err
+		}
+		if transaction.isCoinbaseTx() {
+			continue
+		}
+		for j := len(transaction.TXInputs) - 1; j >= 0; j-- {
+			utxo, err := popUndo(&undo, transaction.TXInputs[j])
+			if err != nil {
+				return fmt.Errorf("block %x: %v", block.Hash, err)
+			}
+			var utxos []UTXOInfo
+			if data := utxoBucket.Get(utxo.Txid); data != nil {
+				utxos = deserializeUTXOs(data)
+			}
+			utxos = append(utxos, utxo)
+			sort.Slice(utxos, func(i, j int) bool { return utxos[i].Index < utxos[j].Index })
+			err = utxoBucket.Put(utxo.Txid, serializeUTXOs(utxos))
+			if err != nil {
+				return err
+			}
+		}
+		// New blocks can't hold legacy transactions, so they aren't worth keeping.
+		if transaction.Version != txVersion {
+			fmt.Printf("Drop legacy transaction %x\n", transaction.TXID)
+			continue
+		}
+		err = pending.conflict(transaction)
+		if err != nil {
+			fmt.Printf("Drop transaction %x instead of returning it to the mempool: %v\n", transaction.TXID, err)
+			continue
+		}
+		fmt.Printf("Return transaction %x to the mempool\n", transaction.TXID)
+		err = mempoolBucket.Put(transaction.TXID, transaction.Serialize())
+		if err != nil {
+			return err
+		}
+		pending.track(transaction)
+	}
+
+	err = undoBucket.Delete(block.Hash)
+	if err != nil {
+		return err
+	}
+	err = heightBucket.Delete(heightToKey(block.Height))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(bucketBlock)).Put([]byte(lastBlockHashKey), block.PrevHash)
+}
+
+// ChainTip is a block that no other stored block builds on.
+type ChainTip struct {
+	Height    uint64
+	Hash      []byte
+	BranchLen uint64
+	Status    string
+}
+
+// GetChainTips returns every known tip, the highest first. BranchLen is the number of
+// blocks between the tip and the main chain; Status is "active" for the tail, "invalid"
+// when the branch contains an invalid block and "valid-fork" otherwise.
+func (bc *BlockChain) GetChainTips() ([]ChainTip, error) {
+	var hashes [][]byte
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketTips))
+		if bucket == nil {
+			return errors.New("tips bucket shouldn't be nil")
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			hashes = append(hashes, append([]byte{}, k...))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var tips []ChainTip
+	for _, hash := range hashes {
+		block := bc.GetBlockByHash(hash)
+		if block == nil {
+			return nil, fmt.Errorf("failed to read tip %x", hash)
+		}
+		tip := ChainTip{Height: block.Height, Hash: block.Hash, Status: "valid-fork"}
+		for !bc.isMainChain(block) {
+			if bc.isInvalidBlock(block.Hash) {
+				tip.Status = "invalid"
+			}
+			tip.BranchLen++
+			block = bc.GetBlockByHash(block.PrevHash)
+			if block == nil {
+				return nil, fmt.Errorf("the branch of tip %x doesn't reach the main chain", hash)
+			}
+		}
+		if tip.BranchLen == 0 {
+			tip.Status = "active"
+		}
+		tips = append(tips, tip)
+	}
+	sort.Slice(tips, func(i, j int) bool { return tips[i].Height > tips[j].Height })
+	return tips, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// processTestBlocks mines a block per miner on top of parent, each on the one before,
+// hands them to ProcessBlock and returns the last one.
+func processTestBlocks(t *testing.T, bc *BlockChain, parent *Block, miners ...string) *Block {
+	t.Helper()
+	for _, miner := range miners {
+		parent = processTestBlock(t, bc, parent, miner)
+	}
+	return parent
+}
+
+func processTestBlock(t *testing.T, bc *BlockChain, parent *Block, miner string, txs ...*Transaction) *Block {
+	t.Helper()
+	block := mineTestBlockOn(t, bc, parent, miner, txs...)
+	err := bc.ProcessBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// checkMainChain checks that blocks follow genesis on the main chain, in the tail,
+// the height index and the tx index.
+func checkMainChain(t *testing.T, bc *BlockChain, blocks ...*Block) {
+	t.Helper()
+	tail := blocks[len(blocks)-1]
+	if !bytes.Equal(bc.tail, tail.Hash) {
+		t.Fatalf("the tail is %x, want %x at height %d", bc.tail, tail.Hash, tail.Height)
+	}
+	if height, _ := bc.GetBestHeight(); height != tail.Height {
+		t.Fatalf("the best height is %d, want %d", height, tail.Height)
+	}
+	for _, block := range blocks {
+		if main := bc.GetBlockByHeight(block.Height); main == nil || !bytes.Equal(main.Hash, block.Hash) {
+			t.Fatalf("the height index doesn't hold block %x at height %d", block.Hash, block.Height)
+		}
+		for _, tx := range block.Transactions {
+			if found, _ := bc.findTransactionBlock(tx.TXID); found == nil || !bytes.Equal(found.Hash, block.Hash) {
+				t.Fatalf("the tx index doesn't find %x in block %x", tx.TXID, block.Hash)
+			}
+		}
+	}
+}
+
+// checkDetached checks that no index still finds blocks.
+func checkDetached(t *testing.T, bc *BlockChain, blocks ...*Block) {
+	t.Helper()
+	for _, block := range blocks {
+		if bc.isMainChain(block) {
+			t.Fatalf("block %x at height %d is still on the main chain", block.Hash, block.Height)
+		}
+		if bc.getUTXOs(block.Transactions[0].TXID) != nil {
+			t.Fatalf("the coinbase of block %x is still unspent", block.Hash)
+		}
+		for _, tx := range block.Transactions {
+			if found, _ := bc.findTransactionBlock(tx.TXID); found != nil && bytes.Equal(found.Hash, block.Hash) {
+				t.Fatalf("the tx index still finds %x in block %x", tx.TXID, block.Hash)
+			}
+		}
+	}
+}
+
+func checkMempool(t *testing.T, bc *BlockChain, want ...*Transaction) {
+	t.Helper()
+	txs := newTestMempool(t, bc).Transactions()
+	pending := make(map[string]bool)
+	for _, tx := range txs {
+		pending[string(tx.TXID)] = true
+	}
+	for _, tx := range want {
+		if !pending[string(tx.TXID)] {
+			t.Fatalf("transaction %x isn't pending", tx.TXID)
+		}
+	}
+	if len(txs) != len(want) {
+		t.Fatalf("the mempool holds %d transactions, want %d", len(txs), len(want))
+	}
+}
+
+func checkChainTips(t *testing.T, bc *BlockChain, want ...ChainTip) {
+	t.Helper()
+	tips, err := bc.GetChainTips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tips) != len(want) {
+		t.Fatalf("there are %d chain tips, want %d", len(tips), len(want))
+	}
+	for i, tip := range tips {
+		if i > 0 && tip.Height > tips[i-1].Height {
+			t.Fatal("the chain tips aren't sorted by height")
+		}
+		found := false
+		for _, w := range want {
+			if bytes.Equal(tip.Hash, w.Hash) {
+				found = true
+				if tip.Height != w.Height || tip.BranchLen != w.BranchLen || tip.Status != w.Status {
+					t.Fatalf("chain tip %x is %+v, want %+v", tip.Hash, tip, w)
+				}
+			}
+		}
+		if !found {
+			t.Fatalf("unexpected chain tip %x", tip.Hash)
+		}
+	}
+}
+
+func TestReorganizeBackAndForth(t *testing.T) {
+	minerA, minerB := newWalletKeyPair(), newWalletKeyPair()
+	payee, other := newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, minerA.getAddress())
+	genesis := bc.GetBlockByHash(bc.tail)
+	common := processTestBlock(t, bc, genesis, minerA.getAddress())
+
+	// Branch a spends both outputs, branch b pays the genesis output elsewhere.
+	spend := newTestSpend(t, minerA, genesis.Transactions[0], 0, payee.getAddress())
+	unrelated := newTestSpend(t, minerA, common.Transactions[0], 0, payee.getAddress())
+	conflict := newTestSpend(t, minerA, genesis.Transactions[0], 0, other.getAddress())
+	a2 := processTestBlock(t, bc, common, minerA.getAddress(), spend, unrelated)
+	a3 := processTestBlock(t, bc, a2, minerA.getAddress())
+	b2 := processTestBlock(t, bc, common, minerB.getAddress(), conflict)
+	b3 := processTestBlock(t, bc, b2, minerB.getAddress())
+
+	// Equal work doesn't move the tail.
+	checkMainChain(t, bc, genesis, common, a2, a3)
+	checkChainTips(t, bc,
+		ChainTip{a3.Height, a3.Hash, 0, "active"},
+		ChainTip{b3.Height, b3.Hash, 2, "valid-fork"})
+
+	b4 := processTestBlock(t, bc, b3, minerB.getAddress())
+	checkMainChain(t, bc, genesis, common, b2, b3, b4)
+	checkDetached(t, bc, a2, a3)
+	if balance(bc, payee) != 0 || balance(bc, other) != genesis.Transactions[0].TXOutputs[0].Value {
+		t.Fatal("the UTXO set still holds the spends of the old branch")
+	}
+	if balance(bc, minerA) != blockSubsidy(1) || balance(bc, minerB) != 3*blockSubsidy(2) {
+		t.Fatalf("the UTXO set pays %d to miner a and %d to miner b", balance(bc, minerA), balance(bc, minerB))
+	}
+	// The conflicting spend is dropped, the other one is pending again.
+	checkMempool(t, bc, unrelated)
+	checkChainTips(t, bc,
+		ChainTip{b4.Height, b4.Hash, 0, "active"},
+		ChainTip{a3.Height, a3.Hash, 2, "valid-fork"})
+
+	a5 := processTestBlocks(t, bc, a3, minerA.getAddress(), minerA.getAddress())
+	a4 := bc.GetBlockByHash(a5.PrevHash)
+	checkMainChain(t, bc, genesis, common, a2, a3, a4, a5)
+	checkDetached(t, bc, b2, b3, b4)
+	paid := genesis.Transactions[0].TXOutputs[0].Value + common.Transactions[0].TXOutputs[0].Value
+	if balance(bc, payee) != paid || balance(bc, other) != 0 || balance(bc, minerB) != 0 {
+		t.Fatal("the UTXO set wasn't restored by the reverse reorganization")
+	}
+	checkMempool(t, bc)
+	checkChainTips(t, bc,
+		ChainTip{a5.Height, a5.Hash, 0, "active"},
+		ChainTip{b4.Height, b4.Hash, 3, "valid-fork"})
+	if block, err := bc.VerifyChain(); block != nil || err != nil {
+		t.Fatalf("the reorganized chain doesn't verify at %v: %v", block, err)
+	}
+}
+
+func TestInvalidBlockIsNeverReconnected(t *testing.T) {
+	miner, thief := newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesis := bc.GetBlockByHash(bc.tail)
+	a1 := processTestBlock(t, bc, genesis, miner.getAddress())
+
+	// The side chain spends the genesis output with a foreign key. It is only
+	// validated once it has more work than the main chain.
+	theft := newTestSpend(t, thief, genesis.Transactions[0], 0, thief.getAddress())
+	b1 := processTestBlock(t, bc, genesis, thief.getAddress(), theft)
+	b2 := mineTestBlockOn(t, bc, b1, thief.getAddress())
+	err := bc.ProcessBlock(b2)
+	if ruleErr, ok := err.(RuleError); !ok || ruleErr.ErrorCode != ErrBadPubKeyHash {
+		t.Fatalf("the reorganization onto the invalid branch returned %v, want %v", err, ErrBadPubKeyHash)
+	}
+	checkMainChain(t, bc, genesis, a1)
+	if !bc.isInvalidBlock(b1.Hash) || !bc.isInvalidBlock(b2.Hash) {
+		t.Fatal("the invalid branch wasn't marked invalid")
+	}
+	checkChainTips(t, bc,
+		ChainTip{b2.Height, b2.Hash, 2, "invalid"},
+		ChainTip{a1.Height, a1.Hash, 0, "active"})
+
+	// Building on the invalid branch or sending its blocks again connects nothing.
+	b3 := mineTestBlockOn(t, bc, b2, thief.getAddress())
+	err = bc.ProcessBlock(b3)
+	if ruleErr, ok := err.(RuleError); !ok || ruleErr.ErrorCode != ErrInvalidAncestor {
+		t.Fatalf("a block on the invalid branch returned %v, want %v", err, ErrInvalidAncestor)
+	}
+	for _, block := range []*Block{b1, b2} {
+		if bc.ProcessBlock(block) == nil {
+			t.Fatalf("invalid block %x was accepted again", block.Hash)
+		}
+	}
+	if best := bc.BestHeader(); best == nil || !bytes.Equal(best.Hash, a1.Hash) {
+		t.Fatal("the best header is on the invalid branch")
+	}
+
+	a3 := processTestBlocks(t, bc, a1, miner.getAddress(), miner.getAddress())
+	checkMainChain(t, bc, genesis, a1, bc.GetBlockByHash(a3.PrevHash), a3)
+	checkDetached(t, bc, b1, b2)
+	if balance(bc, thief) != 0 {
+		t.Fatal("the invalid branch paid the thief")
+	}
+}
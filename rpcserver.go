@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rpcConfigFile configures the rpcserver command with one key=value pair per line;
+// lines starting with # are comments:
+//
+//	rpcuser=<USER>
+//	rpcpassword=<PASSWORD>
+//	rpcport=<PORT>
+//
+// rpcuser and rpcpassword are required, rpcport defaults to defaultRPCPort.
+const rpcConfigFile = "rpc.conf"
+const defaultRPCPort = 8332
+const maxRPCRequestSize = 1 << 20
+const maxUnlockTimeout = 100000000
+
+// Error codes of the JSON-RPC 2.0 specification.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+)
+
+// Application error codes, numbered like the ones of Bitcoin Core.
+const (
+	rpcWalletError         = -4
+	rpcInvalidAddressOrKey = -5
+	rpcInsufficientFunds   = -6
+	rpcInvalidParameter    = -8
+	rpcWalletUnlockNeeded  = -13
+	rpcWalletPassphrase    = -14
+	rpcWalletWrongEncState = -15
+	rpcVerifyRejected      = -26
+)
+
+type rpcConfig struct {
+	User     string
+	Password string
+	Port     int
+}
+
+func loadRPCConfig() (*rpcConfig, error) {
+	file, err := os.Open(rpcConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("%v, please create %s with rpcuser and rpcpassword", err, rpcConfigFile)
+	}
+	defer file.Close()
+	config := rpcConfig{Port: defaultRPCPort}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s line %d: expected key=value", rpcConfigFile, line)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "rpcuser":
+			config.User = value
+		case "rpcpassword":
+			config.Password = value
+		case "rpcport":
+			config.Port, err = strconv.Atoi(value)
+			if err != nil || config.Port <= 0 || config.Port > 65535 {
+				return nil, fmt.Errorf("%s line %d: invalid rpcport %q", rpcConfigFile, line, value)
+			}
+		default:
+			return nil, fmt.Errorf("%s line %d: unknown key %q", rpcConfigFile, line, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if config.User == "" || config.Password == "" {
+		return nil, fmt.Errorf("%s must set rpcuser and rpcpassword", rpcConfigFile)
+	}
+	return &config, nil
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func newRPCError(code int, format string, a ...interface{}) *rpcError {
+	return &rpcError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcMethod lists the parameter names of a method, of which the first required
+// ones must be given, either by position or by name.
+type rpcMethod struct {
+	params   []string
+	required int
+	handler  func(s *RPCServer, params []json.RawMessage) (interface{}, *rpcError)
+}
+
+var rpcMethods = map[string]rpcMethod{
+	"getbalance":        {[]string{"address"}, 0, (*RPCServer).getBalance},
+	"sendtoaddress":     {[]string{"from", "to", "amount", "fee"}, 3, (*RPCServer).sendToAddress},
+	"getblock":          {[]string{"block"}, 1, (*RPCServer).getBlock},
+	"getrawtransaction": {[]string{"txid", "verbose"}, 1, (*RPCServer).getRawTransaction},
+	"getnewaddress":     {nil, 0, (*RPCServer).getNewAddress},
+	"listaddresses":     {nil, 0, (*RPCServer).listAddresses},
+	"getblockcount":     {nil, 0, (*RPCServer).getBlockCount},
+	"unlock":            {[]string{"passphrase", "timeout"}, 2, (*RPCServer).unlock},
+}
+
+// RPCServer answers JSON-RPC 2.0 requests sent over HTTP, one request at a time.
+type RPCServer struct {
+	bc     *BlockChain
+	config *rpcConfig
+	mu     sync.Mutex
+	// walletKey unlocks an encrypted wallet until walletKeyExpiry.
+	walletKey       []byte
+	walletKeyExpiry time.Time
+	// quit is closed by Stop.
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewRPCServer(bc *BlockChain, config *rpcConfig) *RPCServer {
+	return &RPCServer{bc: bc, config: config, quit: make(chan struct{})}
+}
+
+// Start serves requests on localhost until the process is interrupted or Stop is
+// called, and returns once the requests being handled are done.
+func (s *RPCServer) Start() error {
+	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", s.config.Port))
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: s}
+	fmt.Printf("RPC server is listening on %s\n", ln.Addr())
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+	select {
+	case err = <-served:
+		return err
+	case <-interrupt:
+		fmt.Println("Shutting down the RPC server...")
+	case <-s.quit:
+	}
+	// Serve returns as soon as the listener is closed, Shutdown once no request is left.
+	err = server.Shutdown(context.Background())
+	<-served
+	return err
+}
+
+// Stop makes Start return. It may be called more than once.
+func (s *RPCServer) Stop() {
+	s.stopOnce.Do(func() { close(s.quit) })
+}
+
+func (s *RPCServer) authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.config.User)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.config.Password)) == 1
+	return userOK && passwordOK
+}
+
+func (s *RPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requests must be sent with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := readRPCBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var reply interface{}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			reply = errorResponse(nil, newRPCError(rpcParseError, "parse error: %v", err))
+		} else if len(batch) == 0 {
+			reply = errorResponse(nil, newRPCError(rpcInvalidRequest, "empty batch"))
+		} else {
+			var responses []*rpcResponse
+			for _, raw := range batch {
+				if response := s.handle(raw); response != nil {
+					responses = append(responses, response)
+				}
+			}
+			if len(responses) == 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			reply = responses
+		}
+	} else {
+		response := s.handle(trimmed)
+		if response == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		reply = response
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func readRPCBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var buffer bytes.Buffer
+	_, err := buffer.ReadFrom(http.MaxBytesReader(w, r.Body, maxRPCRequestSize))
+	return buffer.Bytes(), err
+}
+
+func errorResponse(id json.RawMessage, rpcErr *rpcError) *rpcResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: "2.0", Error: rpcErr, ID: id}
+}
+
+// handle runs a single request and returns its response, or nil for a notification,
+// which is a request without an id.
+func (s *RPCServer) handle(raw []byte) *rpcResponse {
+	var request rpcRequest
+	if err := json.Unmarshal(raw, &request); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return errorResponse(nil, newRPCError(rpcParseError, "parse error: %v", err))
+		}
+		return errorResponse(nil, newRPCError(rpcInvalidRequest, "invalid request: %v", err))
+	}
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		return errorResponse(request.ID, newRPCError(rpcInvalidRequest, "the request must set jsonrpc to \"2.0\" and a method"))
+	}
+	result, rpcErr := s.call(request.Method, request.Params)
+	if len(request.ID) == 0 {
+		return nil
+	}
+	if rpcErr != nil {
+		return errorResponse(request.ID, rpcErr)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(request.ID, newRPCError(rpcInternalError, "encode result: %v", err))
+	}
+	return &rpcResponse{JSONRPC: "2.0", Result: data, ID: request.ID}
+}
+
+func (s *RPCServer) call(name string, rawParams json.RawMessage) (interface{}, *rpcError) {
+	method, ok := rpcMethods[name]
+	if !ok {
+		return nil, newRPCError(rpcMethodNotFound, "method %q not found", name)
+	}
+	params, rpcErr := method.bind(rawParams)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return method.handler(s, params)
+}
+
+// bind returns the parameters in the order of method.params, with nil for the
+// optional ones that weren't given.
+func (method rpcMethod) bind(rawParams json.RawMessage) ([]json.RawMessage, *rpcError) {
+	params := make([]json.RawMessage, len(method.params))
+	trimmed := bytes.TrimSpace(rawParams)
+	switch {
+	case len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")):
+	case trimmed[0] == '[':
+		var positional []json.RawMessage
+		if err := json.Unmarshal(trimmed, &positional); err != nil {
+			return nil, newRPCError(rpcInvalidParams, "invalid params: %v", err)
+		}
+		if len(positional) > len(params) {
+			return nil, newRPCError(rpcInvalidParams, "expected at most %d params, got %d", len(params), len(positional))
+		}
+		copy(params, positional)
+	case trimmed[0] == '{':
+		var named map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &named); err != nil {
+			return nil, newRPCError(rpcInvalidParams, "invalid params: %v", err)
+		}
+		for key, value := range named {
+			i := indexOf(method.params, key)
+			if i < 0 {
+				return nil, newRPCError(rpcInvalidParams, "unknown param %q", key)
+			}
+			params[i] = value
+		}
+	default:
+		return nil, newRPCError(rpcInvalidParams, "params must be an array or an object")
+	}
+	for i := range params {
+		if bytes.Equal(bytes.TrimSpace(params[i]), []byte("null")) {
+			params[i] = nil
+		}
+		if i < method.required && params[i] == nil {
+			return nil, newRPCError(rpcInvalidParams, "missing param %q", method.params[i])
+		}
+	}
+	return params, nil
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func stringParam(raw json.RawMessage, name string) (string, *rpcError) {
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", newRPCError(rpcInvalidParams, "param %q must be a string", name)
+	}
+	return value, nil
+}
+
+func addressParam(raw json.RawMessage, name string) (string, *rpcError) {
+	address, rpcErr := stringParam(raw, name)
+	if rpcErr != nil {
+		return "", rpcErr
+	}
+	if !isValidAddress(address) {
+		return "", newRPCError(rpcInvalidAddressOrKey, "invalid address %q", address)
+	}
+	return address, nil
+}
+
+func hashParam(raw json.RawMessage, name string) ([]byte, *rpcError) {
+	value, rpcErr := stringParam(raw, name)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	hash, err := hex.DecodeString(value)
+	if err != nil || len(hash) != 32 {
+		return nil, newRPCError(rpcInvalidParameter, "param %q must be a 32 byte hex string", name)
+	}
+	return hash, nil
+}
+
+// amountParam accepts a JSON number or string such as 0.5 or "0.5", read with
+// parseAmount, or with parseFee when zero is allowed.
+func amountParam(raw json.RawMessage, name string, allowZero bool) (int64, *rpcError) {
+	text := string(bytes.TrimSpace(raw))
+	if strings.HasPrefix(text, `"`) {
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return 0, newRPCError(rpcInvalidParams, "param %q must be an amount", name)
+		}
+	}
+	parse := parseAmount
+	if allowZero {
+		parse = parseFee
+	}
+	amount, err := parse(text)
+	if err != nil {
+		return 0, newRPCError(rpcInvalidParameter, "invalid %s: %v", name, err)
+	}
+	return amount, nil
+}
+
+func amountResult(amount int64) json.Number {
+	return json.Number(formatAmount(amount))
+}
+
+func (s *RPCServer) getBalance(params []json.RawMessage) (interface{}, *rpcError) {
+	var addresses []string
+	if params[0] != nil {
+		address, rpcErr := addressParam(params[0], "address")
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		addresses = append(addresses, address)
+	} else {
+		wm := NewWalletManager()
+		if wm == nil {
+			return nil, newRPCError(rpcWalletError, "failed to open the wallet")
+		}
+		addresses = wm.listAddresses()
+	}
+	var total int64
+	for _, address := range addresses {
+		for _, utxo := range s.bc.FindMyUTXO(getPubKeyHashFromAddress(address)) {
+			total += utxo.Value
+		}
+	}
+	return amountResult(total), nil
+}
+
+// sendToAddress adds a transaction paying amount from a wallet address to the
+// mempool and returns its txid.
+func (s *RPCServer) sendToAddress(params []json.RawMessage) (interface{}, *rpcError) {
+	from, rpcErr := addressParam(params[0], "from")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	to, rpcErr := addressParam(params[1], "to")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	amount, rpcErr := amountParam(params[2], "amount", false)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	var fee int64
+	if params[3] != nil {
+		fee, rpcErr = amountParam(params[3], "fee", true)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+	}
+	wm, rpcErr := s.openWallet()
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	if wm.Wallets[from] == nil {
+		return nil, newRPCError(rpcWalletError, "the wallet has no private key for %s", from)
+	}
+	if wm.isLocked() {
+		return nil, newRPCError(rpcWalletUnlockNeeded, "the wallet is locked, call unlock first")
+	}
+	need, ok := addAmount(amount, fee)
+	if !ok {
+		return nil, newRPCError(rpcInvalidParameter, "the amount plus fee is out of range")
+	}
+	if _, available := s.bc.findNeedUTXO(getPubKeyHashFromAddress(from), need); available < need {
+		return nil, newRPCError(rpcInsufficientFunds, "%s has %s available, %s is needed",
+			from, formatAmount(available), formatAmount(need))
+	}
+	tx := NewTransaction(from, to, amount, fee, s.bc, wm)
+	if tx == nil {
+		return nil, newRPCError(rpcWalletError, "failed to create the transaction")
+	}
+	mp, err := NewMempool(s.bc)
+	if err != nil {
+		return nil, newRPCError(rpcInternalError, "open the mempool: %v", err)
+	}
+	err = mp.AddTransaction(tx)
+	if err != nil {
+		return nil, newRPCError(rpcVerifyRejected, "the transaction was rejected by the mempool: %v", err)
+	}
+	return hex.EncodeToString(tx.TXID), nil
+}
+
+type rpcBlock struct {
+	Hash              string   `json:"hash"`
+	Confirmations     int64    `json:"confirmations"`
+	Height            uint64   `json:"height"`
+	Version           uint64   `json:"version"`
+	MerkleRoot        string   `json:"merkleroot"`
+	Time              uint64   `json:"time"`
+	Bits              string   `json:"bits"`
+	Nonce             uint64   `json:"nonce"`
+	PreviousBlockHash string   `json:"previousblockhash,omitempty"`
+	NextBlockHash     string   `json:"nextblockhash,omitempty"`
+	Tx                []string `json:"tx"`
+}
+
+// confirmations returns how many main chain blocks, counting itself, are built on
+// block, or -1 for a block off the main chain.
+func (bc *BlockChain) confirmations(block *Block) int64 {
+	if !bc.isMainChain(block) {
+		return -1
+	}
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		return 0
+	}
+	return int64(height-block.Height) + 1
+}
+
+// getBlock looks the block up by hash, given as a hex string, or by main chain
+// height, given as a number.
+func (s *RPCServer) getBlock(params []json.RawMessage) (interface{}, *rpcError) {
+	var block *Block
+	var height uint64
+	if err := json.Unmarshal(params[0], &height); err == nil {
+		block = s.bc.GetBlockByHeight(height)
+	} else {
+		hash, rpcErr := hashParam(params[0], "block")
+		if rpcErr != nil {
+			return nil, newRPCError(rpcInvalidParams, "param \"block\" must be a block hash or a height")
+		}
+		block = s.bc.GetBlockByHash(hash)
+	}
+	if block == nil {
+		return nil, newRPCError(rpcInvalidAddressOrKey, "block not found")
+	}
+	return newRPCBlock(s.bc, block), nil
+}
+
+func newRPCBlock(bc *BlockChain, block *Block) *rpcBlock {
+	result := rpcBlock{
+		Hash:          hex.EncodeToString(block.Hash),
+		Confirmations: bc.confirmations(block),
+		Height:        block.Height,
+		Version:       block.Version,
+		MerkleRoot:    hex.EncodeToString(block.MerkleRoot),
+		Time:          block.TimeStamp,
+		Bits:          fmt.Sprintf("%08x", block.Bits),
+		Nonce:         block.Nonce,
+		Tx:            []string{},
+	}
+	if len(block.PrevHash) != 0 {
+		result.PreviousBlockHash = hex.EncodeToString(block.PrevHash)
+	}
+	if result.Confirmations > 1 {
+		if next := bc.GetHeaderByHeight(block.Height + 1); next != nil {
+			result.NextBlockHash = hex.EncodeToString(next.Hash)
+		}
+	}
+	for _, tx := range block.Transactions {
+		result.Tx = append(result.Tx, hex.EncodeToString(tx.TXID))
+	}
+	return &result
+}
+
+type rpcTxInput struct {
+	Coinbase  string `json:"coinbase,omitempty"`
+	Txid      string `json:"txid,omitempty"`
+	Vout      int64  `json:"vout"`
+	ScriptSig string `json:"scriptsig,omitempty"`
+	PubKey    string `json:"pubkey,omitempty"`
+}
+
+type rpcTxOutput struct {
+	Value      json.Number `json:"value"`
+	N          int         `json:"n"`
+	PubKeyHash string      `json:"pubkeyhash"`
+	Address    string      `json:"address"`
+}
+
+type rpcTransaction struct {
+	Txid          string        `json:"txid"`
+	Hex           string        `json:"hex"`
+	Time          uint64        `json:"time"`
+	Vin           []rpcTxInput  `json:"vin"`
+	Vout          []rpcTxOutput `json:"vout"`
+	BlockHash     string        `json:"blockhash,omitempty"`
+	BlockHeight   uint64        `json:"blockheight,omitempty"`
+	Confirmations int64         `json:"confirmations"`
+}
+
+func newRPCTransaction(tx *Transaction) *rpcTransaction {
+	result := rpcTransaction{
+		Txid: hex.EncodeToString(tx.TXID),
+		Hex:  hex.EncodeToString(tx.Serialize()),
+		Time: tx.TimeStamp,
+		Vin:  []rpcTxInput{},
+		Vout: []rpcTxOutput{},
+	}
+	for _, input := range tx.TXInputs {
+		if tx.isCoinbaseTx() {
+			result.Vin = append(result.Vin, rpcTxInput{Coinbase: hex.EncodeToString(input.PubKey), Vout: input.Index})
+			continue
+		}
+		result.Vin = append(result.Vin, rpcTxInput{
+			Txid:      hex.EncodeToString(input.Txid),
+			Vout:      input.Index,
+			ScriptSig: hex.EncodeToString(input.ScriptSig),
+			PubKey:    hex.EncodeToString(input.PubKey),
+		})
+	}
+	for i, output := range tx.TXOutputs {
+		result.Vout = append(result.Vout, rpcTxOutput{
+			Value:      amountResult(output.Value),
+			N:          i,
+			PubKeyHash: hex.EncodeToString(output.ScriptPubKeyHash),
+			Address:    getAddressFromPubKeyHash(output.ScriptPubKeyHash),
+		})
+	}
+	return &result
+}
+
+func (result *rpcTransaction) setBlock(bc *BlockChain, block *Block) {
+	result.BlockHash = hex.EncodeToString(block.Hash)
+	result.BlockHeight = block.Height
+	result.Confirmations = bc.confirmations(block)
+}
+
+// getRawTransaction returns the serialized transaction as hex, or a decoded
+// transaction when verbose is true. Pending transactions are found as well.
+func (s *RPCServer) getRawTransaction(params []json.RawMessage) (interface{}, *rpcError) {
+	txid, rpcErr := hashParam(params[0], "txid")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	verbose := false
+	if params[1] != nil {
+		if err := json.Unmarshal(params[1], &verbose); err != nil {
+			return nil, newRPCError(rpcInvalidParams, "param \"verbose\" must be a boolean")
+		}
+	}
+	tx, block, err := s.bc.findAnyTransaction(txid)
+	if err != nil {
+		return nil, newRPCError(rpcInternalError, "%v", err)
+	}
+	if tx == nil {
+		return nil, newRPCError(rpcInvalidAddressOrKey, "no such mempool or blockchain transaction")
+	}
+	if !verbose {
+		return hex.EncodeToString(tx.Serialize()), nil
+	}
+	result := newRPCTransaction(tx)
+	if block != nil {
+		result.setBlock(s.bc, block)
+	}
+	return result, nil
+}
+
+// findAnyTransaction looks txid up in the main chain and then in the mempool, returning
+// the block containing it, or nil for a pending transaction.
+func (bc *BlockChain) findAnyTransaction(txid []byte) (*Transaction, *Block, error) {
+	block, position := bc.findTransactionBlock(txid)
+	if block != nil {
+		return block.Transactions[position], block, nil
+	}
+	mp, err := NewMempool(bc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mp.txs[string(txid)], nil, nil
+}
+
+func (s *RPCServer) getNewAddress(params []json.RawMessage) (interface{}, *rpcError) {
+	wm, rpcErr := s.openWallet()
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	if wm.isLocked() {
+		return nil, newRPCError(rpcWalletUnlockNeeded, "the wallet is locked, call unlock first")
+	}
+	address := wm.createWallet()
+	if len(address) == 0 {
+		return nil, newRPCError(rpcWalletError, "failed to create a wallet")
+	}
+	return address, nil
+}
+
+func (s *RPCServer) listAddresses(params []json.RawMessage) (interface{}, *rpcError) {
+	wm := NewWalletManager()
+	if wm == nil {
+		return nil, newRPCError(rpcWalletError, "failed to open the wallet")
+	}
+	addresses := wm.listAddresses()
+	if addresses == nil {
+		addresses = []string{}
+	}
+	return addresses, nil
+}
+
+func (s *RPCServer) getBlockCount(params []json.RawMessage) (interface{}, *rpcError) {
+	height, err := s.bc.GetBestHeight()
+	if err != nil {
+		return nil, newRPCError(rpcInternalError, "%v", err)
+	}
+	return height, nil
+}
+
+// openWallet opens wallet.dat, unlocked if an unlock call is still in effect.
+func (s *RPCServer) openWallet() (*WalletManager, *rpcError) {
+	wm := NewWalletManager()
+	if wm == nil {
+		return nil, newRPCError(rpcWalletError, "failed to open the wallet")
+	}
+	if wm.isEncrypted() && s.walletKey != nil {
+		if time.Now().After(s.walletKeyExpiry) {
+			s.walletKey = nil
+			return wm, nil
+		}
+		err := wm.unlockWithKey(s.walletKey)
+		if err != nil {
+			return nil, newRPCError(rpcWalletError, "unlock the wallet: %v", err)
+		}
+	}
+	return wm, nil
+}
+
+// unlock keeps an encrypted wallet unlocked for timeout seconds. Only the key derived
+// from the passphrase is kept, in memory.
+func (s *RPCServer) unlock(params []json.RawMessage) (interface{}, *rpcError) {
+	passphrase, rpcErr := stringParam(params[0], "passphrase")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	var timeout int64
+	if err := json.Unmarshal(params[1], &timeout); err != nil || timeout <= 0 || timeout > maxUnlockTimeout {
+		return nil, newRPCError(rpcInvalidParams, "param \"timeout\" must be between 1 and %d seconds", maxUnlockTimeout)
+	}
+	wm := NewWalletManager()
+	if wm == nil {
+		return nil, newRPCError(rpcWalletError, "failed to open the wallet")
+	}
+	if !wm.isEncrypted() {
+		return nil, newRPCError(rpcWalletWrongEncState, "the wallet isn't encrypted")
+	}
+	err := wm.unlock(passphrase)
+	if err != nil {
+		return nil, newRPCError(rpcWalletPassphrase, "%v", err)
+	}
+	s.walletKey = wm.encryption.key
+	s.walletKeyExpiry = time.Now().Add(time.Duration(timeout) * time.Second)
+	return nil, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRPCPort = 18014
+
+func newTestRPCServer(t *testing.T, bc *BlockChain) (*RPCServer, *httptest.Server) {
+	t.Helper()
+	s := NewRPCServer(bc, &rpcConfig{User: "user", Password: "secret", Port: testRPCPort})
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+// postRPC sends body with the test credentials and decodes the reply into reply.
+func postRPC(t *testing.T, server *httptest.Server, body string, reply interface{}) *http.Response {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetBasicAuth("user", "secret")
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if reply != nil {
+		err = json.NewDecoder(response.Body).Decode(reply)
+		if err != nil {
+			t.Fatalf("the reply to %s doesn't decode: %v", body, err)
+		}
+	}
+	return response
+}
+
+func checkRPCError(t *testing.T, server *httptest.Server, body string, code int) {
+	t.Helper()
+	var response rpcResponse
+	postRPC(t, server, body, &response)
+	if response.Error == nil || response.Error.Code != code || response.Result != nil {
+		t.Fatalf("%s returned %+v, want error %d", body, response.Error, code)
+	}
+}
+
+func TestRPCRequiresBasicAuth(t *testing.T) {
+	bc := newTestChain(t, newWalletKeyPair().getAddress())
+	defer bc.db.Close()
+	_, server := newTestRPCServer(t, bc)
+
+	body := `{"jsonrpc":"2.0","method":"getblockcount","id":1}`
+	for _, auth := range [][]string{nil, {"user", "wrong"}, {"other", "secret"}} {
+		request, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		if auth != nil {
+			request.SetBasicAuth(auth[0], auth[1])
+		}
+		response, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized || response.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("a request authenticated with %v got status %d", auth, response.StatusCode)
+		}
+	}
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	request.SetBasicAuth("user", "secret")
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("a GET request got status %d", response.StatusCode)
+	}
+}
+
+func TestRPCErrors(t *testing.T) {
+	bc := newTestChain(t, newWalletKeyPair().getAddress())
+	defer bc.db.Close()
+	_, server := newTestRPCServer(t, bc)
+
+	checkRPCError(t, server, `{"jsonrpc":"2.0","method":"getblocks","id":1}`, rpcMethodNotFound)
+	checkRPCError(t, server, `{"jsonrpc":"2.0","method":"getblock","id":1}`, rpcInvalidParams)
+	checkRPCError(t, server, `{"jsonrpc":"2.0","method":"getblock","params":[true],"id":1}`, rpcInvalidParams)
+	checkRPCError(t, server, `{"jsonrpc":"2.0","method":"getblock","params":[0,1],"id":1}`, rpcInvalidParams)
+	checkRPCError(t, server, `{"jsonrpc":"2.0","method":"getblock","params":{"hash":0},"id":1}`, rpcInvalidParams)
+	checkRPCError(t, server, `{"jsonrpc":"2.0","method":"getblock","params":[1],"id":1}`, rpcInvalidAddressOrKey)
+	checkRPCError(t, server, `{"jsonrpc":"1.0","method":"getblockcount","id":1}`, rpcInvalidRequest)
+	checkRPCError(t, server, `{"jsonrpc":"2.0","method":`, rpcParseError)
+	checkRPCError(t, server, `[]`, rpcInvalidRequest)
+
+	// A notification gets no reply.
+	response := postRPC(t, server, `{"jsonrpc":"2.0","method":"getblockcount"}`, nil)
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("a notification got status %d", response.StatusCode)
+	}
+}
+
+func TestRPCGetBlock(t *testing.T) {
+	miner := newWalletKeyPair().getAddress()
+	bc := newTestChain(t, miner)
+	defer bc.db.Close()
+	_, server := newTestRPCServer(t, bc)
+	genesis := bc.GetBlockByHash(bc.tail)
+
+	var count struct{ Result uint64 }
+	postRPC(t, server, `{"jsonrpc":"2.0","method":"getblockcount","id":1}`, &count)
+	if count.Result != 0 {
+		t.Fatalf("getblockcount returned %d on the genesis block", count.Result)
+	}
+	block := mineTestBlock(t, bc, miner)
+	err := bc.ProcessBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postRPC(t, server, `{"jsonrpc":"2.0","method":"getblockcount","id":1}`, &count)
+	if count.Result != 1 {
+		t.Fatalf("getblockcount returned %d, want 1", count.Result)
+	}
+
+	for _, params := range []string{`[0]`, `["` + hex.EncodeToString(genesis.Hash) + `"]`, `{"block":0}`} {
+		var reply struct{ Result rpcBlock }
+		postRPC(t, server, `{"jsonrpc":"2.0","method":"getblock","params":`+params+`,"id":1}`, &reply)
+		got := reply.Result
+		if got.Hash != hex.EncodeToString(genesis.Hash) || got.Height != 0 || got.Confirmations != 2 {
+			t.Fatalf("getblock %s returned block %s at height %d with %d confirmations", params, got.Hash, got.Height, got.Confirmations)
+		}
+		if got.NextBlockHash != hex.EncodeToString(block.Hash) || len(got.Tx) != 1 || got.Tx[0] != hex.EncodeToString(genesis.Transactions[0].TXID) {
+			t.Fatalf("getblock %s returned %+v", params, got)
+		}
+	}
+}
+
+func TestRPCBatch(t *testing.T) {
+	bc := newTestChain(t, newWalletKeyPair().getAddress())
+	defer bc.db.Close()
+	_, server := newTestRPCServer(t, bc)
+
+	var responses []rpcResponse
+	postRPC(t, server, `[
+		{"jsonrpc":"2.0","method":"getblockcount","id":"a"},
+		{"jsonrpc":"2.0","method":"getblockcount"},
+		{"jsonrpc":"2.0","method":"nosuchmethod","id":2},
+		{"jsonrpc":"2.0","method":"getblock","params":[0],"id":3}
+	]`, &responses)
+	if len(responses) != 3 {
+		t.Fatalf("the batch got %d responses, want 3", len(responses))
+	}
+	if string(responses[0].ID) != `"a"` || string(responses[0].Result) != "0" || responses[0].Error != nil {
+		t.Fatalf("the first response is %+v", responses[0])
+	}
+	if string(responses[1].ID) != "2" || responses[1].Error == nil || responses[1].Error.Code != rpcMethodNotFound {
+		t.Fatalf("the second response is %+v", responses[1])
+	}
+	if string(responses[2].ID) != "3" || responses[2].Error != nil || responses[2].Result == nil {
+		t.Fatalf("the third response is %+v", responses[2])
+	}
+
+	// A batch of notifications gets no reply.
+	response := postRPC(t, server, `[{"jsonrpc":"2.0","method":"getblockcount"}]`, nil)
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("a batch of notifications got status %d", response.StatusCode)
+	}
+}
+
+func TestRPCServerStops(t *testing.T) {
+	bc := newTestChain(t, newWalletKeyPair().getAddress())
+	defer bc.db.Close()
+	s, _ := newTestRPCServer(t, bc)
+
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+	waitFor(t, "the RPC server to listen", func() bool {
+		response, err := http.Get(fmt.Sprintf("http://localhost:%d/", testRPCPort))
+		if err != nil {
+			return false
+		}
+		response.Body.Close()
+		return true
+	})
+	s.Stop()
+	s.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after Stop")
+	}
+	if !s.mu.TryLock() {
+		t.Fatal("Start returned holding the lock")
+	}
+	s.mu.Unlock()
+}
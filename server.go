@@ -0,0 +1,831 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// Every message is sent on its own TCP connection: a command name padded to
+// commandLength bytes followed by the gob encoded payload. Blocks, headers and
+// transactions inside the payload are in the canonical encoding of encoding.go. A node only talks to
+// peers that completed the handshake by sending a version message:
+//
+//	version    -> the peer's protocol version, best height and address; answered with verack
+//	getheaders -> a block locator; answered with the main chain headers after the fork point
+//	headers    -> serialized headers that are validated and stored before their blocks are requested
+//	inv        -> block or tx hashes the peer has; unknown ones are requested with getdata
+//	getdata    -> answered with a block or tx message
+//	block, tx  -> a serialized block or transaction, relayed to the other peers once accepted
+//
+// Peers older than canonicalEncodingVersion sent gob encoded blocks and are refused.
+const (
+	protocolVersion          = 3
+	minProtocolVersion       = canonicalEncodingVersion
+	canonicalEncodingVersion = 3
+	commandLength            = 12
+	maxInvItems              = 500
+	maxHeadersPerMsg         = 2000
+	maxBlocksPerPeer         = 16
+	blockStallTimeout        = 10 * time.Second
+	maxOrphanBlocks          = 100
+	maxEarlyMessages         = 100
+	maxMessageSize           = 32 << 20
+	dialTimeout              = 5 * time.Second
+	readTimeout              = 30 * time.Second
+)
+
+const (
+	invTypeBlock = "block"
+	invTypeTx    = "tx"
+)
+
+type versionMsg struct {
+	Version    int
+	BestHeight uint64
+	AddrFrom   string
+}
+
+type verackMsg struct {
+	AddrFrom string
+}
+
+type getHeadersMsg struct {
+	AddrFrom string
+	Locator  [][]byte
+}
+
+type headersMsg struct {
+	AddrFrom string
+	Headers  [][]byte
+}
+
+type invMsg struct {
+	AddrFrom string
+	Type     string
+	Items    [][]byte
+}
+
+type getDataMsg struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
+type blockMsg struct {
+	AddrFrom string
+	Block    []byte
+}
+
+type txMsg struct {
+	AddrFrom    string
+	Transaction []byte
+}
+
+type peer struct {
+	Version    int
+	BestHeight uint64
+	Verified   bool
+}
+
+// Server is a node that keeps bc in sync with its peers. mu serializes every access
+// to the chain and the mempool, since messages are handled concurrently.
+type Server struct {
+	bc    *BlockChain
+	addr  string
+	miner string
+	mu    sync.Mutex
+	ln    net.Listener
+	peers map[string]*peer
+	// versionSent holds the addresses we sent a version to and haven't heard back from.
+	versionSent map[string]bool
+	// inFlight maps the hash of every requested block to the request.
+	inFlight map[string]*blockRequest
+	// orphans maps the missing parent hash of a received block to the block.
+	orphans map[string]*Block
+	// early holds the messages of peers whose version is still on its way.
+	early map[string][]earlyMsg
+	// outbox holds the messages to send once s.mu is released.
+	outbox []outMsg
+	// mining is set while the pending transactions are mined, and mineAgain when
+	// more arrived meanwhile.
+	mining    bool
+	mineAgain bool
+	// quit is closed by Stop; wg counts the goroutines that may still touch the chain.
+	quit     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+type blockRequest struct {
+	peer string
+	sent time.Time
+}
+
+type outMsg struct {
+	addr    string
+	command string
+	payload []byte
+}
+
+type earlyMsg struct {
+	command string
+	payload []byte
+}
+
+func NewServer(bc *BlockChain, addr, miner string) *Server {
+	return &Server{
+		bc:          bc,
+		addr:        addr,
+		miner:       miner,
+		peers:       make(map[string]*peer),
+		versionSent: make(map[string]bool),
+		inFlight:    make(map[string]*blockRequest),
+		orphans:     make(map[string]*Block),
+		early:       make(map[string][]earlyMsg),
+		quit:        make(chan struct{}),
+	}
+}
+
+func commandToBytes(command string) []byte {
+	var b [commandLength]byte
+	copy(b[:], command)
+	return b[:]
+}
+
+func bytesToCommand(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+func gobEncode(payload interface{}) []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(payload)
+	if err != nil {
+		fmt.Println("Encode message err:", err)
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+func gobDecode(data []byte, payload interface{}) error {
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	return decoder.Decode(payload)
+}
+
+// Start listens on the node address and sends a version message to every seed
+// peer. It blocks until the process is interrupted or Stop is called, and returns
+// once no goroutine of the server touches the chain any more.
+func (s *Server) Start(seeds []string) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.stopped() {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	// The accept loop counts as well, so no Add happens while Stop waits on zero.
+	s.wg.Add(3)
+	s.ln = ln
+	s.mu.Unlock()
+	defer s.wg.Wait()
+	defer s.wg.Done()
+	fmt.Printf("Node %s is listening, best height %d\n", s.addr, s.bestHeight())
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		defer s.wg.Done()
+		defer signal.Stop(interrupt)
+		select {
+		case <-interrupt:
+			fmt.Println("Shutting down the node...")
+			s.shutdown()
+		case <-s.quit:
+		}
+	}()
+
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(blockStallTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.quit:
+				return
+			}
+			s.mu.Lock()
+			s.requestBlocks()
+			s.mu.Unlock()
+			s.flush()
+		}
+	}()
+
+	s.mu.Lock()
+	for _, seed := range seeds {
+		// Peers are known by the IP they connect from, so resolve the seed names.
+		addr, err := net.ResolveTCPAddr("tcp", seed)
+		if err != nil {
+			fmt.Printf("Can't resolve seed %s: %v\n", seed, err)
+			continue
+		}
+		s.sendVersion(addr.String())
+	}
+	s.mu.Unlock()
+	s.flush()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.stopped() {
+				return nil
+			}
+			s.shutdown()
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// shutdown closes quit and the listener without waiting for anything.
+func (s *Server) shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+		s.mu.Lock()
+		ln := s.ln
+		s.mu.Unlock()
+		if ln != nil {
+			ln.Close()
+		}
+	})
+}
+
+// Stop makes Start return and waits until the messages being handled and the block
+// being mined are done. It may be called more than once.
+func (s *Server) Stop() {
+	s.shutdown()
+	s.wg.Wait()
+}
+
+func (s *Server) stopped() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) bestHeight() uint64 {
+	tail := s.bc.GetBlockByHash(s.bc.tail)
+	if tail == nil {
+		return 0
+	}
+	return tail.Height
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	request, err := io.ReadAll(io.LimitReader(conn, maxMessageSize))
+	if err != nil {
+		fmt.Println("Read message err:", err)
+		return
+	}
+	if len(request) < commandLength {
+		fmt.Println("Drop a message shorter than the command")
+		return
+	}
+	command := bytesToCommand(request[:commandLength])
+	payload := request[commandLength:]
+	var msg struct{ AddrFrom string }
+	if err := gobDecode(payload, &msg); err != nil {
+		fmt.Printf("Drop %s message: %v\n", command, err)
+		return
+	}
+	from, err := peerAddr(conn.RemoteAddr(), msg.AddrFrom)
+	if err != nil {
+		fmt.Printf("Drop %s message from %s: %v\n", command, conn.RemoteAddr(), err)
+		return
+	}
+
+	s.mu.Lock()
+	s.dispatch(from, command, payload)
+	s.mu.Unlock()
+	s.flush()
+}
+
+// peerAddr returns the address a peer listens on: the host it connected from and the
+// port it advertises in addrFrom, since every message comes from a fresh port. The
+// host of addrFrom is ignored, so a peer can't claim the address of another node.
+func peerAddr(remote net.Addr, addrFrom string) (string, error) {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return "", err
+	}
+	_, port, err := net.SplitHostPort(addrFrom)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// dispatch handles a message from the peer listening on from. Every connection carries
+// a single message, so messages can overtake each other; the ones a peer sends right
+// after its version are queued until the version has been handled.
+func (s *Server) dispatch(from, command string, payload []byte) {
+	if command != "version" && s.peers[from] == nil {
+		if s.versionSent[from] && len(s.early[from]) < maxEarlyMessages {
+			s.early[from] = append(s.early[from], earlyMsg{command, payload})
+			return
+		}
+		fmt.Printf("Ignore %s from %s before the version handshake\n", command, from)
+		return
+	}
+
+	var err error
+	switch command {
+	case "version":
+		var msg versionMsg
+		if err = gobDecode(payload, &msg); err == nil {
+			s.handleVersion(from, &msg)
+			early := s.early[from]
+			delete(s.early, from)
+			for _, m := range early {
+				s.dispatch(from, m.command, m.payload)
+			}
+		}
+	case "verack":
+		s.peers[from].Verified = true
+		fmt.Printf("Handshake with %s complete\n", from)
+	case "getheaders":
+		var msg getHeadersMsg
+		if err = gobDecode(payload, &msg); err == nil {
+			s.handleGetHeaders(from, &msg)
+		}
+	case "headers":
+		var msg headersMsg
+		if err = gobDecode(payload, &msg); err == nil {
+			s.handleHeaders(from, &msg)
+		}
+	case "inv":
+		var msg invMsg
+		if err = gobDecode(payload, &msg); err == nil {
+			s.handleInv(from, &msg)
+		}
+	case "getdata":
+		var msg getDataMsg
+		if err = gobDecode(payload, &msg); err == nil {
+			s.handleGetData(from, &msg)
+		}
+	case "block":
+		var msg blockMsg
+		if err = gobDecode(payload, &msg); err == nil {
+			s.handleBlock(from, &msg)
+		}
+	case "tx":
+		var msg txMsg
+		if err = gobDecode(payload, &msg); err == nil {
+			s.handleTx(from, &msg)
+		}
+	default:
+		fmt.Printf("Unknown command %q\n", command)
+	}
+	if err != nil {
+		fmt.Printf("Drop %s message: %v\n", command, err)
+	}
+}
+
+// send queues a message to addr. The queue is delivered by flush once s.mu is
+// released, so that no handler holds the lock while dialing a slow peer.
+func (s *Server) send(addr, command string, payload interface{}) {
+	s.outbox = append(s.outbox, outMsg{addr, command, gobEncode(payload)})
+}
+
+// flush delivers the queued messages in order and disconnects the peers that can't
+// be reached. It must be called without s.mu.
+func (s *Server) flush() {
+	s.mu.Lock()
+	out := s.outbox
+	s.outbox = nil
+	s.mu.Unlock()
+
+	unreachable := make(map[string]bool)
+	for _, m := range out {
+		if unreachable[m.addr] {
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", m.addr, dialTimeout)
+		if err != nil {
+			fmt.Printf("Peer %s is not available: %v\n", m.addr, err)
+			unreachable[m.addr] = true
+			continue
+		}
+		_, err = conn.Write(append(commandToBytes(m.command), m.payload...))
+		conn.Close()
+		if err != nil {
+			fmt.Printf("Send %s to %s err: %v\n", m.command, m.addr, err)
+		}
+	}
+	if len(unreachable) == 0 {
+		return
+	}
+	s.mu.Lock()
+	for addr := range unreachable {
+		s.disconnect(addr)
+	}
+	s.mu.Unlock()
+}
+
+// broadcast sends an inv of one item to every peer except skip.
+func (s *Server) broadcast(invType string, id []byte, skip string) {
+	for addr := range s.peers {
+		if addr != skip {
+			s.send(addr, "inv", invMsg{s.addr, invType, [][]byte{id}})
+		}
+	}
+}
+
+// disconnect forgets addr and the blocks requested from it.
+func (s *Server) disconnect(addr string) {
+	delete(s.peers, addr)
+	delete(s.versionSent, addr)
+	delete(s.early, addr)
+	for hash, req := range s.inFlight {
+		if req.peer == addr {
+			delete(s.inFlight, hash)
+		}
+	}
+}
+
+func (s *Server) sendVersion(addr string) {
+	s.versionSent[addr] = true
+	s.send(addr, "version", versionMsg{protocolVersion, s.bestHeight(), s.addr})
+}
+
+func (s *Server) sendGetHeaders(addr string) {
+	s.send(addr, "getheaders", getHeadersMsg{s.addr, s.bc.blockLocator()})
+}
+
+func (s *Server) requestBlock(hash []byte, addr string) {
+	s.inFlight[string(hash)] = &blockRequest{addr, time.Now()}
+	s.send(addr, "getdata", getDataMsg{s.addr, invTypeBlock, hash})
+}
+
+// requestBlocks asks the peers for the missing blocks of the best header chain, lowest
+// first. The requests go to the least busy peers that have reached the height of the
+// block, with at most maxBlocksPerPeer blocks in flight per peer, so a long chain is
+// downloaded from all peers in parallel. Requests that aren't answered within
+// blockStallTimeout are sent again.
+func (s *Server) requestBlocks() {
+	busy := make(map[string]int)
+	for hash, req := range s.inFlight {
+		if time.Since(req.sent) > blockStallTimeout {
+			fmt.Printf("Peer %s didn't deliver block %x in time\n", req.peer, hash)
+			delete(s.inFlight, hash)
+			continue
+		}
+		busy[req.peer]++
+	}
+	if len(s.peers) == 0 {
+		return
+	}
+	for _, h := range s.bc.blocksToDownload(maxBlocksPerPeer * len(s.peers)) {
+		if s.inFlight[string(h.Hash)] != nil {
+			continue
+		}
+		target := ""
+		for addr, p := range s.peers {
+			if p.BestHeight < h.Height || busy[addr] >= maxBlocksPerPeer {
+				continue
+			}
+			if target == "" || busy[addr] < busy[target] {
+				target = addr
+			}
+		}
+		if target == "" {
+			return
+		}
+		s.requestBlock(h.Hash, target)
+		busy[target]++
+	}
+}
+
+func (s *Server) handleVersion(from string, msg *versionMsg) {
+	fmt.Printf("Received version %d from %s, best height %d\n", msg.Version, from, msg.BestHeight)
+	if msg.Version < minProtocolVersion {
+		fmt.Printf("Disconnect %s, protocol version %d is older than %d\n", from, msg.Version, minProtocolVersion)
+		return
+	}
+	s.peers[from] = &peer{Version: msg.Version, BestHeight: msg.BestHeight}
+	// Answer with our own version unless this message already answers ours.
+	if s.versionSent[from] {
+		delete(s.versionSent, from)
+	} else {
+		s.send(from, "version", versionMsg{protocolVersion, s.bestHeight(), s.addr})
+	}
+	s.send(from, "verack", verackMsg{s.addr})
+
+	if msg.BestHeight > s.bc.BestHeader().Height {
+		s.sendGetHeaders(from)
+	}
+	s.requestBlocks()
+	mp, err := NewMempool(s.bc)
+	if err != nil {
+		fmt.Println("NewMempool err:", err)
+		return
+	}
+	var txids [][]byte
+	for _, tx := range mp.Transactions() {
+		txids = append(txids, tx.TXID)
+	}
+	if len(txids) != 0 {
+		s.send(from, "inv", invMsg{s.addr, invTypeTx, txids})
+	}
+}
+
+func (s *Server) handleGetHeaders(from string, msg *getHeadersMsg) {
+	height := s.bc.findForkHeight(msg.Locator)
+	var headers [][]byte
+	for len(headers) < maxHeadersPerMsg {
+		height++
+		h := s.bc.GetHeaderByHeight(height)
+		if h == nil {
+			break
+		}
+		headers = append(headers, h.Serialize())
+	}
+	fmt.Printf("Received getheaders from %s, send %d headers\n", from, len(headers))
+	s.send(from, "headers", headersMsg{s.addr, headers})
+}
+
+func (s *Server) handleHeaders(from string, msg *headersMsg) {
+	if len(msg.Headers) > maxHeadersPerMsg {
+		fmt.Printf("Drop headers from %s with more than %d headers\n", from, maxHeadersPerMsg)
+		return
+	}
+	var headers []*BlockHeader
+	for _, data := range msg.Headers {
+		h := deserializeHeader(data)
+		if h == nil {
+			fmt.Printf("Reject undecodable headers from %s, disconnect it\n", from)
+			s.disconnect(from)
+			return
+		}
+		headers = append(headers, h)
+	}
+	added, err := s.bc.ProcessHeaders(headers)
+	ruleErr, isRuleErr := err.(RuleError)
+	switch {
+	case isRuleErr && ruleErr.ErrorCode == ErrOrphanBlock:
+		fmt.Printf("The headers from %s don't connect, ask again\n", from)
+		s.sendGetHeaders(from)
+		return
+	case err != nil:
+		fmt.Printf("Reject headers from %s: %v, disconnect it\n", from, err)
+		s.disconnect(from)
+		return
+	}
+	if n := len(headers); n != 0 {
+		p := s.peers[from]
+		if last := headers[n-1]; p != nil && last.Height > p.BestHeight {
+			p.BestHeight = last.Height
+		}
+	}
+	fmt.Printf("Received %d headers from %s, %d new, best header height %d\n",
+		len(msg.Headers), from, added, s.bc.BestHeader().Height)
+	if len(msg.Headers) == maxHeadersPerMsg {
+		s.sendGetHeaders(from)
+	}
+	s.requestBlocks()
+}
+
+func (s *Server) handleInv(from string, msg *invMsg) {
+	fmt.Printf("Received inv with %d %s items from %s\n", len(msg.Items), msg.Type, from)
+	if len(msg.Items) > maxInvItems {
+		fmt.Printf("Drop inv from %s with more than %d items\n", from, maxInvItems)
+		return
+	}
+	switch msg.Type {
+	case invTypeBlock:
+		for _, hash := range msg.Items {
+			if s.inFlight[string(hash)] != nil || s.bc.hasBlock(hash) {
+				continue
+			}
+			s.requestBlock(hash, from)
+		}
+	case invTypeTx:
+		mp, err := NewMempool(s.bc)
+		if err != nil {
+			fmt.Println("NewMempool err:", err)
+			return
+		}
+		for _, txid := range msg.Items {
+			if mp.txs[string(txid)] != nil || s.bc.findTransaction(txid) != nil {
+				continue
+			}
+			s.send(from, "getdata", getDataMsg{s.addr, invTypeTx, txid})
+		}
+	}
+}
+
+func (s *Server) handleGetData(from string, msg *getDataMsg) {
+	switch msg.Type {
+	case invTypeBlock:
+		block := s.bc.GetBlockByHash(msg.ID)
+		if block == nil {
+			fmt.Printf("Peer %s asked for unknown block %x\n", from, msg.ID)
+			return
+		}
+		s.send(from, "block", blockMsg{s.addr, block.Serialize()})
+	case invTypeTx:
+		mp, err := NewMempool(s.bc)
+		if err != nil {
+			fmt.Println("NewMempool err:", err)
+			return
+		}
+		tx := mp.txs[string(msg.ID)]
+		if tx == nil {
+			fmt.Printf("Peer %s asked for unknown transaction %x\n", from, msg.ID)
+			return
+		}
+		s.send(from, "tx", txMsg{s.addr, tx.Serialize()})
+	}
+}
+
+func (s *Server) handleBlock(from string, msg *blockMsg) {
+	block := Deserialize(msg.Block)
+	if block == nil {
+		fmt.Printf("Drop an undecodable block from %s\n", from)
+		return
+	}
+	delete(s.inFlight, string(block.Hash))
+	fmt.Printf("Received block %x at height %d from %s\n", block.Hash, block.Height, from)
+	height := block.Height
+
+	// Connect the block and then every orphan that was waiting for it.
+	for block != nil {
+		err := s.bc.ProcessBlock(block)
+		ruleErr, isRuleErr := err.(RuleError)
+		switch {
+		case err == errKnownBlock:
+		case isRuleErr && ruleErr.ErrorCode == ErrOrphanBlock:
+			if len(s.orphans) < maxOrphanBlocks {
+				s.orphans[string(block.PrevHash)] = block
+			}
+			if s.inFlight[string(block.PrevHash)] == nil {
+				fmt.Printf("Block %x is an orphan, ask %s for the missing blocks\n", block.Hash, from)
+				s.sendGetHeaders(from)
+			}
+		case err != nil:
+			fmt.Printf("Reject block %x: %v, disconnect %s\n", block.Hash, err, from)
+			s.disconnect(from)
+			return
+		default:
+			if bytes.Equal(s.bc.tail, block.Hash) {
+				fmt.Printf("Block %x is the new tail at height %d\n", block.Hash, block.Height)
+				s.broadcast(invTypeBlock, block.Hash, from)
+			}
+		}
+		next := s.orphans[string(block.Hash)]
+		delete(s.orphans, string(block.Hash))
+		block = next
+	}
+
+	p := s.peers[from]
+	if p == nil {
+		return
+	}
+	if height > p.BestHeight {
+		p.BestHeight = height
+	}
+	tailHeight := s.bestHeight()
+	if best := s.bc.BestHeader(); best.Height > tailHeight {
+		fmt.Printf("Sync progress: height %d of %d (%.1f%%)\n",
+			tailHeight, best.Height, float64(tailHeight)*100/float64(best.Height))
+	}
+	s.requestBlocks()
+}
+
+func (s *Server) handleTx(from string, msg *txMsg) {
+	tx := DeserializeTransaction(msg.Transaction)
+	if tx == nil {
+		fmt.Printf("Drop an undecodable transaction from %s\n", from)
+		return
+	}
+	mp, err := NewMempool(s.bc)
+	if err != nil {
+		fmt.Println("NewMempool err:", err)
+		return
+	}
+	err = mp.AddTransaction(tx)
+	if err != nil {
+		fmt.Printf("Reject transaction %x: %v\n", tx.TXID, err)
+		return
+	}
+	fmt.Printf("Transaction %x from %s is added to the mempool\n", tx.TXID, from)
+	s.broadcast(invTypeTx, tx.TXID, from)
+
+	if s.miner == "" {
+		return
+	}
+	if s.mining {
+		s.mineAgain = true
+		return
+	}
+	s.mining = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.mine()
+	}()
+}
+
+// mine mines the pending transactions until no more arrive meanwhile. The proof of
+// work runs without s.mu, so the node keeps handling messages; a block that no longer
+// extends the tail is stored as a side chain block, or rejected if another block
+// already confirmed its transactions.
+func (s *Server) mine() {
+	for {
+		s.mu.Lock()
+		s.mineAgain = false
+		txs, err := s.bc.pendingBlockTxs(s.miner, "")
+		var template *Block
+		if err == nil {
+			template, err = s.bc.newBlockTemplate(txs)
+		}
+		s.mu.Unlock()
+
+		var block *Block
+		if err == nil {
+			block = NewBlock(template.Transactions, template.PrevHash, template.Height, template.Bits, template.TimeStamp)
+			if block == nil {
+				err = errors.New("failed to mine the block")
+			}
+		}
+
+		s.mu.Lock()
+		if err != nil {
+			fmt.Println("Failed to mine the pending transactions:", err)
+		} else if err = s.bc.ProcessBlock(block); err != nil {
+			fmt.Printf("Drop mined block %x: %v\n", block.Hash, err)
+		} else if bytes.Equal(s.bc.tail, block.Hash) {
+			fmt.Printf("Mined block %x at height %d\n", block.Hash, block.Height)
+			s.broadcast(invTypeBlock, block.Hash, "")
+		}
+		again := s.mineAgain
+		s.mining = again
+		s.mu.Unlock()
+		s.flush()
+		if !again || s.stopped() {
+			return
+		}
+	}
+}
+
+// blockLocator returns hashes of the best header chain from its tip back to genesis,
+// one per block for the last 10 blocks and then doubling the step, so a peer can
+// find the fork point.
+func (bc *BlockChain) blockLocator() [][]byte {
+	var locator [][]byte
+	step := 1
+	for h := bc.BestHeader(); h != nil; {
+		locator = append(locator, h.Hash)
+		if len(h.PrevHash) == 0 {
+			break
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		// Never step past genesis, so the locator always ends with it.
+		for i := 0; i < step && h != nil && len(h.PrevHash) != 0; i++ {
+			h = bc.GetHeaderByHash(h.PrevHash)
+		}
+	}
+	return locator
+}
+
+// findForkHeight returns the height of the first locator hash on the main chain, or 0.
+func (bc *BlockChain) findForkHeight(locator [][]byte) uint64 {
+	for _, hash := range locator {
+		h := bc.GetHeaderByHash(hash)
+		if h != nil && bc.isMainChain(h.toBlock()) {
+			return h.Height
+		}
+	}
+	return 0
+}
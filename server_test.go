@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The nodes of the tests listen on these localhost ports.
+const (
+	testPortA = 18011
+	testPortB = 18012
+	testPortC = 18013
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// startTestNode starts a node for bc on port and stops it when the test ends.
+func startTestNode(t *testing.T, bc *BlockChain, port int, miner string, seeds ...string) *Server {
+	t.Helper()
+	s := NewServer(bc, fmt.Sprintf("localhost:%d", port), miner)
+	done := make(chan error, 1)
+	go func() { done <- s.Start(seeds) }()
+	waitFor(t, "the node to listen", func() bool {
+		select {
+		case err := <-done:
+			t.Fatal("the node failed to start:", err)
+		default:
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.ln != nil
+	})
+	// Stop waits for the handlers, so none touches the chain once it is closed.
+	t.Cleanup(func() {
+		s.Stop()
+		if err := <-done; err != nil {
+			t.Error("the node stopped with", err)
+		}
+	})
+	return s
+}
+
+// nodeTail returns the tail and best header of the chain of s.
+func nodeTail(s *Server) (*Block, *BlockHeader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bc.GetBlockByHash(s.bc.tail), s.bc.BestHeader()
+}
+
+func TestNodesSyncAndRelay(t *testing.T) {
+	miner, payee := newWalletKeyPair(), newWalletKeyPair()
+	bcA := newTestChain(t, miner.getAddress())
+	genesisCoinbase := bcA.GetBlockByHash(bcA.tail).Transactions[0]
+
+	// B starts from a copy of the genesis block, A mines 3 more blocks.
+	dirB := t.TempDir()
+	err := bcA.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(filepath.Join(dirB, blockchainDBFile), 0600)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, dirB)
+	bcB, err := GetBlockChainInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bcB.db.Close() })
+	for i := 0; i < 3; i++ {
+		err = bcA.ProcessBlock(mineTestBlock(t, bcA, miner.getAddress()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tipA := bcA.GetBlockByHash(bcA.tail)
+
+	nodeA := startTestNode(t, bcA, testPortA, miner.getAddress())
+	nodeB := startTestNode(t, bcB, testPortB, "", fmt.Sprintf("localhost:%d", testPortA))
+
+	waitFor(t, "B to download the chain of A", func() bool {
+		tail, _ := nodeTail(nodeB)
+		return tail.Height == tipA.Height
+	})
+	tail, header := nodeTail(nodeB)
+	if !bytes.Equal(tail.Hash, tipA.Hash) || !bytes.Equal(header.Hash, tipA.Hash) {
+		t.Fatalf("B synced to block %x with best header %x, want %x", tail.Hash, header.Hash, tipA.Hash)
+	}
+	nodeB.mu.Lock()
+	p := nodeB.peers[fmt.Sprintf("127.0.0.1:%d", testPortA)]
+	nodeB.mu.Unlock()
+	if p == nil || p.Version != protocolVersion {
+		t.Fatal("B didn't sync headers first from A")
+	}
+
+	// A transaction B relays reaches A, whose miner confirms it in a block B receives.
+	spend := newTestSpend(t, miner, genesisCoinbase, 0, payee.getAddress())
+	nodeB.mu.Lock()
+	nodeB.handleTx("", &txMsg{Transaction: spend.Serialize()})
+	nodeB.mu.Unlock()
+	nodeB.flush()
+
+	waitFor(t, "B to receive the block of A confirming the transaction", func() bool {
+		tail, _ := nodeTail(nodeB)
+		return tail.Height == tipA.Height+1
+	})
+	tail, _ = nodeTail(nodeB)
+	tailA, _ := nodeTail(nodeA)
+	if !bytes.Equal(tail.Hash, tailA.Hash) {
+		t.Fatalf("B is at block %x, A at %x", tail.Hash, tailA.Hash)
+	}
+	nodeB.mu.Lock()
+	defer nodeB.mu.Unlock()
+	if nodeB.bc.findTransaction(spend.TXID) == nil {
+		t.Fatal("the relayed transaction isn't in the chain of B")
+	}
+	if balance(nodeB.bc, payee) != genesisCoinbase.TXOutputs[0].Value {
+		t.Fatal("the relayed transaction didn't pay the payee")
+	}
+}
+
+func TestStopLeavesNoGoroutines(t *testing.T) {
+	miner := newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	before := runtime.NumGoroutine()
+
+	s := NewServer(bc, fmt.Sprintf("localhost:%d", testPortC), miner.getAddress())
+	done := make(chan error, 1)
+	go func() { done <- s.Start(nil) }()
+	waitFor(t, "the node to listen", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.ln != nil
+	})
+	// A version from an unreachable address keeps a handler busy dialing it back.
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", testPortC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(commandToBytes("version"), gobEncode(versionMsg{protocolVersion, 0, "localhost:1"})...))
+	conn.Close()
+
+	s.Stop()
+	s.Stop()
+	if err := <-done; err != nil {
+		t.Fatal("Start returned", err)
+	}
+	if !s.mu.TryLock() {
+		t.Fatal("Start returned holding the server lock")
+	}
+	s.mu.Unlock()
+	waitFor(t, "the goroutines of the node to exit", func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+
+	// A stopped node doesn't start again.
+	err = s.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", testPortC)); err == nil {
+		t.Fatal("the stopped node listens again")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import "fmt"
+
+// initialSubsidy is the mining subsidy of the first blocks in base units.
+var initialSubsidy = 125 * coinUnit / 10
+
+// halvingInterval is the number of blocks after which the subsidy is cut in half.
+var halvingInterval uint64 = 210000
+
+// setSubsidySchedule replaces the subsidy chain parameters. Both must be positive and
+// all the coins ever issued must fit in maxMoney.
+func setSubsidySchedule(subsidy int64, interval uint64) error {
+	if subsidy <= 0 || interval == 0 {
+		return fmt.Errorf("the subsidy %d and the halving interval %d must be positive", subsidy, interval)
+	}
+	// The halvings issue less than twice the coins of the first interval.
+	if uint64(subsidy) > uint64(maxMoney)/2/interval {
+		return fmt.Errorf("a subsidy of %s halved every %d blocks issues more than %s", formatAmount(subsidy), interval, formatAmount(maxMoney))
+	}
+	initialSubsidy, halvingInterval = subsidy, interval
+	return nil
+}
+
+// blockSubsidy returns the subsidy a miner may claim for the block at height.
+func blockSubsidy(height uint64) int64 {
+	halvings := height / halvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return initialSubsidy >> halvings
+}
+
+// totalSubsidy returns the coins issued by the blocks from genesis up to and including height.
+func totalSubsidy(height uint64) int64 {
+	var total int64
+	for start := uint64(0); start <= height; start += halvingInterval {
+		subsidy := blockSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+		end := start + halvingInterval - 1
+		if end > height {
+			end = height
+		}
+		total += subsidy * int64(end-start+1)
+	}
+	return total
+}
+
+// nextHalvingHeight returns the first height after height whose subsidy is halved.
+func nextHalvingHeight(height uint64) uint64 {
+	return (height/halvingInterval + 1) * halvingInterval
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func setTestSubsidySchedule(t *testing.T, subsidy int64, interval uint64) {
+	t.Helper()
+	oldSubsidy, oldInterval := initialSubsidy, halvingInterval
+	err := setSubsidySchedule(subsidy, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { initialSubsidy, halvingInterval = oldSubsidy, oldInterval })
+}
+
+func TestSubsidyScheduleIsValidated(t *testing.T) {
+	oldSubsidy, oldInterval := initialSubsidy, halvingInterval
+	for _, c := range []struct {
+		subsidy  int64
+		interval uint64
+	}{{0, 210000}, {-1, 210000}, {initialSubsidy, 0}, {50*coinUnit + 1, 210000}, {maxMoney, 2}} {
+		if setSubsidySchedule(c.subsidy, c.interval) == nil {
+			t.Fatalf("the subsidy %d halved every %d blocks was accepted", c.subsidy, c.interval)
+		}
+	}
+	if initialSubsidy != oldSubsidy || halvingInterval != oldInterval {
+		t.Fatal("a rejected schedule replaced the subsidy parameters")
+	}
+	// Bitcoin's schedule is the largest one issuing at most maxMoney.
+	setTestSubsidySchedule(t, 50*coinUnit, 210000)
+	setTestSubsidySchedule(t, maxMoney/2, 1)
+}
+
+func TestBlockSubsidyHalves(t *testing.T) {
+	setTestSubsidySchedule(t, 50*coinUnit, 210000)
+	cases := map[uint64]int64{
+		0:       50 * coinUnit,
+		209999:  50 * coinUnit,
+		210000:  25 * coinUnit,
+		419999:  25 * coinUnit,
+		420000:  125 * coinUnit / 10,
+		630000:  625 * coinUnit / 100,
+		6929999: 1,
+		6930000: 0,
+	}
+	for height, want := range cases {
+		if got := blockSubsidy(height); got != want {
+			t.Fatalf("the subsidy at height %d is %d, want %d", height, got, want)
+		}
+	}
+	if next := nextHalvingHeight(209999); next != 210000 {
+		t.Fatalf("the next halving after 209999 is at %d", next)
+	}
+	if next := nextHalvingHeight(210000); next != 420000 {
+		t.Fatalf("the next halving after 210000 is at %d", next)
+	}
+}
+
+func TestSubsidyStopsAfter63Halvings(t *testing.T) {
+	// Halved every block, the largest subsidy runs out after 50 halvings.
+	setTestSubsidySchedule(t, maxMoney/2, 1)
+	if blockSubsidy(49) != 1 || blockSubsidy(50) != 0 {
+		t.Fatalf("the subsidy is %d at height 49 and %d at 50", blockSubsidy(49), blockSubsidy(50))
+	}
+	for _, height := range []uint64{62, 63, 64, 1 << 40, math.MaxUint64} {
+		if blockSubsidy(height) != 0 {
+			t.Fatalf("the subsidy at height %d is %d", height, blockSubsidy(height))
+		}
+	}
+	if total := totalSubsidy(math.MaxUint64); total > maxMoney {
+		t.Fatalf("the schedule issues %d", total)
+	}
+
+	// Beyond 63 halvings a shift no longer divides, so the subsidy is cut off there.
+	setTestSubsidySchedule(t, 50*coinUnit, 210000)
+	for _, halvings := range []uint64{63, 64, 100} {
+		if subsidy := blockSubsidy(halvings * halvingInterval); subsidy != 0 {
+			t.Fatalf("the subsidy after %d halvings is %d", halvings, subsidy)
+		}
+	}
+}
+
+func TestTotalSubsidy(t *testing.T) {
+	setTestSubsidySchedule(t, 50*coinUnit, 210000)
+	var want int64
+	for height := uint64(0); height <= 420001; height++ {
+		want += blockSubsidy(height)
+		if height%210000 <= 1 || height%210000 == 209999 {
+			if got := totalSubsidy(height); got != want {
+				t.Fatalf("the total at height %d is %d, want %d", height, got, want)
+			}
+		}
+	}
+	if got := totalSubsidy(209999); got != 210000*50*coinUnit {
+		t.Fatalf("the first interval issues %d", got)
+	}
+	// Bitcoin's schedule famously issues a little less than 21 million coins.
+	if got := totalSubsidy(math.MaxUint64); got != 2099999997690000 {
+		t.Fatalf("the schedule issues %d in total", got)
+	}
+}
@@ -1,19 +1,26 @@
 package main
 
 import (
+	"errors"
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"fmt"
-	"math/big"
+	"io"
 	"strings"
 	"time"
 )
 
+// Transactions in blocks older than canonicalTxVersion are legacyTxVersion
+// transactions, hashed and signed over their gob encoding; newer blocks only hold
+// txVersion transactions, hashed and signed over the canonical encoding.
+const (
+	legacyTxVersion = 0
+	txVersion       = 1
+)
+
 type Transaction struct {
+	Version   uint64
 	TXID      []byte     
 	TXInputs  []TXInput  
 	TXOutputs []TXOutput 
@@ -29,35 +36,95 @@ type TXInput struct {
 
 type TXOutput struct {
 	ScriptPubKeyHash []byte  
-	Value            float64 
+	Value            int64 
+}
+
+// gob numbers types in the order a process first encodes them and the numbers are
+// part of the encoding that legacyHash hashes, so the legacy transaction is encoded
+// once at startup to give it the same type numbers in every process, whatever else
+// is encoded first.
+func init() {
+	gob.NewEncoder(io.Discard).Encode(legacyGobTransaction(&Transaction{}))
+}
+
+// legacyGobTransaction returns tx as the Transaction type legacyTxVersion transactions
+// were gob encoded with. gob writes the type and field names into its encoding, so
+// the type keeps the old name and fields.
+func legacyGobTransaction(tx *Transaction) interface{} {
+	type Transaction struct {
+		TXID      []byte
+		TXInputs  []TXInput
+		TXOutputs []TXOutput
+		TimeStamp uint64
+	}
+	return &Transaction{tx.TXID, tx.TXInputs, tx.TXOutputs, tx.TimeStamp}
+}
+
+// legacyHash hashes tx the way legacyTxVersion transactions were hashed, over their
+// gob encoding including the current TXID.
+func (tx *Transaction) legacyHash() ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(legacyGobTransaction(tx))
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(buffer.Bytes())
+	return hash[:], nil
 }
 
-func newTXOutput(address string, amount float64) TXOutput {
+func newTXOutput(address string, amount int64) TXOutput {
 	output := TXOutput{Value: amount}
 	pubKeyHash := getPubKeyHashFromAddress(address)
 	output.ScriptPubKeyHash = pubKeyHash
 	return output
 }
 
-func (tx *Transaction) setHash() error {
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(tx)
+// Serialize returns the canonical encoding of tx.
+func (tx *Transaction) Serialize() []byte {
+	var w canonicalWriter
+	tx.encode(&w)
+	return w.Bytes()
+}
+
+func DeserializeTransaction(src []byte) *Transaction {
+	r := canonicalReader{src: src}
+	tx := decodeTransaction(&r)
+	err := r.finish()
 	if err != nil {
-		fmt.Println("encode err:", err)
-		return err
+		fmt.Println("Decode transaction err:", err)
+		return nil
 	}
-	hash := sha256.Sum256(buffer.Bytes())
+	return tx
+}
+
+// setHash sets TXID to the hash of tx, which leaves TXID out of the hash except
+// for legacyTxVersion transactions.
+func (tx *Transaction) setHash() error {
+	if tx.Version == legacyTxVersion {
+		hash, err := tx.legacyHash()
+		if err != nil {
+			fmt.Println("encode err:", err)
+			return err
+		}
+		tx.TXID = hash
+		return nil
+	}
+	hash := sha256.Sum256(tx.Serialize())
 	tx.TXID = hash[:]
 	return nil
 }
 
-var reward = 12.5
-func NewCoinbaseTx(miner string, data string) *Transaction {
-	input := TXInput{Txid: nil, Index: -1, ScriptSig: nil, PubKey: []byte(data)}
-	output := newTXOutput(miner, reward)
+// NewCoinbaseTx creates the mining reward transaction of the block at height.
+// Like BIP34 the height goes into the coinbase input, so two coinbases paying the
+// same miner with the same data never share a TXID.
+// The miner is paid the subsidy for height plus fees, the total fee of the other transactions in the block.
+func NewCoinbaseTx(miner string, data string, height uint64, fees int64) *Transaction {
+	input := TXInput{Txid: nil, Index: -1, ScriptSig: uintToByte(height), PubKey: []byte(data)}
+	output := newTXOutput(miner, blockSubsidy(height)+fees)
 	timeStamp := time.Now().Unix()
 	tx := Transaction{
+		Version:   txVersion,
 		TXID:      nil,
 		TXInputs:  []TXInput{input},
 		TXOutputs: []TXOutput{output},
@@ -67,6 +134,20 @@ func NewCoinbaseTx(miner string, data string) *Transaction {
 	return &tx
 }
 
+// computeTXID hashes tx the way setHash did when tx was created: with no TXID
+// and, except for the coinbase, before any input was signed.
+func (tx *Transaction) computeTXID() []byte {
+	txCopy := Transaction{tx.Version, nil, nil, tx.TXOutputs, tx.TimeStamp}
+	for _, input := range tx.TXInputs {
+		if !tx.isCoinbaseTx() {
+			input.ScriptSig = nil
+		}
+		txCopy.TXInputs = append(txCopy.TXInputs, input)
+	}
+	txCopy.setHash()
+	return txCopy.TXID
+}
+
 func (tx *Transaction) isCoinbaseTx() bool {
 	inputs := tx.TXInputs
 	if len(inputs) == 1 && inputs[0].Txid == nil && inputs[0].Index == -1 {
@@ -75,26 +156,30 @@ func (tx *Transaction) isCoinbaseTx() bool {
 	return false
 }
 
-func NewTransaction(from, to string, amount float64, bc *BlockChain) *Transaction {
-	wm := NewWalletManager()
-	if wm == nil {
-		fmt.Println("Failed to open wallet!")
-		return nil
-	}
-
+// NewTransaction pays amount to to and leaves fee for the miner; any remainder returns to from as change.
+// The private key of from is taken from wm, which must be unlocked if it is encrypted.
+func NewTransaction(from, to string, amount, fee int64, bc *BlockChain, wm *WalletManager) *Transaction {
 	wallet, ok := wm.Wallets[from]
 	if !ok {
 		fmt.Println("The private key corresponding to the address was not found!")
 		return nil
 	}
+	if wallet.isLocked() {
+		fmt.Println("The wallet is locked, unlock it with its passphrase!")
+		return nil
+	}
 	fmt.Println("Find the private and public keys of the payer, ready to create the transaction...")
-	priKey := wallet.PriKey 
 	pubKey := wallet.PubKey
 	pubKeyHash := getPubKeyHashFromPubKey(pubKey)
 	var spentUTXO = make(map[string][]int64)
-	var retValue float64
-	spentUTXO, retValue = bc.findNeedUTXO(pubKeyHash, amount)
-	if retValue < amount {
+	var retValue int64
+	need, ok := addAmount(amount, fee)
+	if !ok {
+		fmt.Println("The amount plus fee is out of range, failed to create transaction!")
+		return nil
+	}
+	spentUTXO, retValue = bc.findNeedUTXO(pubKeyHash, need)
+	if retValue < need {
 		fmt.Println("Insufficient amount, failed to create transaction!")
 		return nil
 	}
@@ -108,21 +193,54 @@ func NewTransaction(from, to string, amount float64, bc *BlockChain) *Transactio
 	}
 	output1 := newTXOutput(to, amount)
 	outputs = append(outputs, output1)
-	if retValue > amount {
-		output2 := newTXOutput(from, retValue-amount)
+	if retValue > need {
+		output2 := newTXOutput(from, retValue-need)
 		outputs = append(outputs, output2)
 	}
 	timeStamp := time.Now().Unix()
-	tx := Transaction{nil, inputs, outputs, uint64(timeStamp)}
+	tx := Transaction{txVersion, nil, inputs, outputs, uint64(timeStamp)}
 	tx.setHash()
-	if !bc.signTransaction(&tx, priKey) {
+	if !bc.signTransaction(&tx, wallet) {
 		fmt.Println("Transaction signing failed")
 		return nil
 	}
 	return &tx
 }
 
-func (tx *Transaction) sign(priKey *ecdsa.PrivateKey, prevTxs map[string]*Transaction) bool {
+// fee returns how much the inputs of tx exceed its outputs, given the transactions its inputs reference.
+func (tx *Transaction) fee(prevTxs map[string]*Transaction) (int64, error) {
+	if tx.isCoinbaseTx() {
+		return 0, nil
+	}
+	var inputValue, outputValue int64
+	var ok bool
+	for _, input := range tx.TXInputs {
+		prevTx := prevTxs[string(input.Txid)]
+		if prevTx == nil || input.Index < 0 || input.Index >= int64(len(prevTx.TXOutputs)) {
+			return 0, fmt.Errorf("input %x:%d references a missing output", input.Txid, input.Index)
+		}
+		inputValue, ok = addAmount(inputValue, prevTx.TXOutputs[input.Index].Value)
+		if !ok {
+			return 0, errors.New("the input value is out of range")
+		}
+	}
+	for i, output := range tx.TXOutputs {
+		if output.Value <= 0 {
+			return 0, fmt.Errorf("output %d has a non-positive value", i)
+		}
+		outputValue, ok = addAmount(outputValue, output.Value)
+		if !ok {
+			return 0, errors.New("the output value is out of range")
+		}
+	}
+	if inputValue < outputValue {
+		return 0, fmt.Errorf("the outputs spend %s but the inputs only provide %s",
+			formatAmount(outputValue), formatAmount(inputValue))
+	}
+	return inputValue - outputValue, nil
+}
+
+func (tx *Transaction) sign(w *wallet, prevTxs map[string]*Transaction) bool {
 	fmt.Println("Specific to the transaction signature sign...")
 	if tx.isCoinbaseTx() {
 		fmt.Println("Find mining transactions, no signature required!")
@@ -135,18 +253,16 @@ func (tx *Transaction) sign(priKey *ecdsa.PrivateKey, prevTxs map[string]*Transa
 		if prevTx == nil {
 			return false
 		}
+		if input.Index < 0 || input.Index >= int64(len(prevTx.TXOutputs)) {
+			fmt.Printf("input[%d] references output %d of %x which doesn't exist\n", i, input.Index, input.Txid)
+			return false
+		}
 		output := prevTx.TXOutputs[input.Index]
 		txCopy.TXInputs[i].PubKey = output.ScriptPubKeyHash
 		txCopy.setHash()
 		txCopy.TXInputs[i].PubKey = nil
 		hashData := txCopy.TXID 
-		r, s, err := ecdsa.Sign(rand.Reader, priKey, hashData)
-		if err != nil {
-			fmt.Println("Signature failed!")
-			return false
-		}
-		signature := append(r.Bytes(), s.Bytes()...)
-		tx.TXInputs[i].ScriptSig = signature
+		tx.TXInputs[i].ScriptSig = w.sign(hashData)
 	}
 	fmt.Println("Transaction signing successful!")
 	return true
@@ -165,34 +281,31 @@ func (tx *Transaction) trimmedCopy() *Transaction {
 		inputs = append(inputs, input)
 	}
 	outputs = tx.TXOutputs
-	txCopy := Transaction{tx.TXID, inputs, outputs, tx.TimeStamp}
+	txCopy := Transaction{tx.Version, tx.TXID, inputs, outputs, tx.TimeStamp}
 	return &txCopy
 }
 
-func (tx *Transaction) verify(prevTxs map[string]*Transaction) bool {
+// verify checks the signature of every input of tx under the rules of a block of the
+// given version, see verifySignature.
+func (tx *Transaction) verify(prevTxs map[string]*Transaction, version uint64) bool {
 	txCopy := tx.trimmedCopy()
 	for i, input := range tx.TXInputs {
 		prevTx := prevTxs[string(input.Txid)]
 		if prevTx == nil {
 			return false
 		}
+		if input.Index < 0 || input.Index >= int64(len(prevTx.TXOutputs)) {
+			fmt.Printf("input[%d] references output %d of %x which doesn't exist\n", i, input.Index, input.Txid)
+			return false
+		}
 		output := prevTx.TXOutputs[input.Index]
 		txCopy.TXInputs[i].PubKey = output.ScriptPubKeyHash
 		txCopy.setHash()
 		txCopy.TXInputs[i].PubKey = nil
 		hashData := txCopy.TXID
-		signature := input.ScriptSig
-		pubKey := input.PubKey
-		var r, s, x, y big.Int
-		r.SetBytes(signature[:len(signature)/2])
-		s.SetBytes(signature[len(signature)/2:])
-		x.SetBytes(pubKey[:len(pubKey)/2])
-		y.SetBytes(pubKey[len(pubKey)/2:])
-		curve := elliptic.P256()
-		pubKeyRaw := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		res := ecdsa.Verify(&pubKeyRaw, hashData, &r, &s)
-		if !res {
-			fmt.Println("An input that failed validation was found!")
+		err := verifySignature(input.PubKey, input.ScriptSig, hashData, version)
+		if err != nil {
+			fmt.Printf("An input that failed validation was found! input[%d]: %v\n", i, err)
 			return false
 		}
 	}
@@ -202,7 +315,7 @@ func (tx *Transaction) verify(prevTxs map[string]*Transaction) bool {
 
 func (tx *Transaction) String() string {
 	var lines []string
-	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.TXID))
+	lines = append(lines, fmt.Sprintf("--- Transaction %x (version %d):", tx.TXID, tx.Version))
 	for i, input := range tx.TXInputs {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:      %x", input.Txid))
@@ -212,7 +325,7 @@ func (tx *Transaction) String() string {
 	}
 	for i, output := range tx.TXOutputs {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
-		lines = append(lines, fmt.Sprintf("       Value:  %f", output.Value))
+		lines = append(lines, fmt.Sprintf("       Value:  %s", formatAmount(output.Value)))
 		lines = append(lines, fmt.Sprintf("       Script: %x", output.ScriptPubKeyHash))
 	}
 	return strings.Join(lines, "\n")
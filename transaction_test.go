@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFeesArePaidToTheMiner(t *testing.T) {
+	payer, payee, miner := newWalletKeyPair(), newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, payer.getAddress())
+	genesisCoinbase := bc.GetBlockByHash(bc.tail).Transactions[0]
+	wm := NewWalletManager()
+	wm.Wallets[payer.getAddress()] = payer
+	value := genesisCoinbase.TXOutputs[0].Value
+	amount, fee := int64(3*coinUnit), int64(coinUnit/1000)
+
+	if NewTransaction(payer.getAddress(), payee.getAddress(), value, 1, bc, wm) != nil {
+		t.Fatal("a transaction spending more than the balance plus fee was created")
+	}
+	tx := NewTransaction(payer.getAddress(), payee.getAddress(), amount, fee, bc, wm)
+	if tx == nil {
+		t.Fatal("failed to create the transaction")
+	}
+	if len(tx.TXOutputs) != 2 || tx.TXOutputs[0].Value != amount || tx.TXOutputs[1].Value != value-amount-fee {
+		t.Fatalf("the transaction pays %v, want %d and the change", tx.TXOutputs, amount)
+	}
+	prevTxs := map[string]*Transaction{string(genesisCoinbase.TXID): genesisCoinbase}
+	if got, err := tx.fee(prevTxs); got != fee || err != nil {
+		t.Fatalf("the fee is %d, want %d: %v", got, fee, err)
+	}
+
+	mp := newTestMempool(t, bc)
+	err := mp.AddTransaction(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, fees := mp.SelectTransactions(); fees != fee {
+		t.Fatalf("the selected transactions pay %d in fees, want %d", fees, fee)
+	}
+
+	// A coinbase claiming more than the subsidy plus the fees is rejected.
+	tail := bc.GetBlockByHash(bc.tail)
+	greedy := NewBlock([]*Transaction{NewCoinbaseTx(miner.getAddress(), "test", 1, fee+1), tx},
+		tail.Hash, 1, bc.calcNextBits(tail), bc.medianTimePast(tail)+1)
+	err = bc.ProcessBlock(greedy)
+	if ruleErr, ok := err.(RuleError); !ok || ruleErr.ErrorCode != ErrBadCoinbaseValue {
+		t.Fatalf("a coinbase claiming more than the fees returned %v, want %v", err, ErrBadCoinbaseValue)
+	}
+
+	block, err := bc.MinePendingTransactions(miner.getAddress(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 2 || !bytes.Equal(block.Transactions[1].TXID, tx.TXID) {
+		t.Fatal("the pending transaction wasn't mined")
+	}
+	if balance(bc, miner) != blockSubsidy(1)+fee || balance(bc, payee) != amount || balance(bc, payer) != value-amount-fee {
+		t.Fatalf("the miner has %d, the payee %d and the payer %d", balance(bc, miner), balance(bc, payee), balance(bc, payer))
+	}
+
+	// Spending the whole balance as amount and fee leaves no change.
+	tx = NewTransaction(payer.getAddress(), payee.getAddress(), value-amount-2*fee, fee, bc, wm)
+	if tx == nil || len(tx.TXOutputs) != 1 {
+		t.Fatal("the transaction spending the whole balance has change")
+	}
+}
+
+func TestFeeOfInvalidTransactions(t *testing.T) {
+	payer := newWalletKeyPair()
+	prev := NewCoinbaseTx(payer.getAddress(), "test", 0, 0)
+	prevTxs := map[string]*Transaction{string(prev.TXID): prev}
+	value := prev.TXOutputs[0].Value
+	cases := []struct {
+		name    string
+		index   int64
+		outputs []int64
+	}{
+		{"outputs above the inputs", 0, []int64{value, 1}},
+		{"a zero output", 0, []int64{value - 1, 0}},
+		{"a negative output", 0, []int64{value + 1, -1}},
+		{"a missing output", 1, []int64{1}},
+		{"outputs out of range", 0, []int64{maxMoney, maxMoney}},
+	}
+	for _, c := range cases {
+		tx := Transaction{Version: txVersion, TXInputs: []TXInput{{Txid: prev.TXID, Index: c.index, PubKey: payer.PubKey}}}
+		for _, value := range c.outputs {
+			tx.TXOutputs = append(tx.TXOutputs, TXOutput{Value: value, ScriptPubKeyHash: getPubKeyHashFromPubKey(payer.PubKey)})
+		}
+		if _, err := tx.fee(prevTxs); err == nil {
+			t.Fatalf("the fee of a transaction with %s was computed", c.name)
+		}
+	}
+	if fee, err := prev.fee(nil); fee != 0 || err != nil {
+		t.Fatalf("the coinbase has a fee of %d: %v", fee, err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// bucketTxIndex maps a txid to the block containing it and its position in that block.
+const bucketTxIndex = "bucketTxIndex"
+
+type TxLocation struct {
+	BlockHash []byte
+	Position  int64
+}
+
+// Serialize returns the canonical encoding of loc.
+func (loc *TxLocation) Serialize() []byte {
+	var w canonicalWriter
+	w.putBytes(loc.BlockHash)
+	w.putVarint(loc.Position)
+	return w.Bytes()
+}
+
+func deserializeTxLocation(src []byte) *TxLocation {
+	r := canonicalReader{src: src}
+	loc := TxLocation{BlockHash: r.bytes(), Position: r.varint()}
+	err := r.finish()
+	if err != nil {
+		fmt.Println("Decode tx location err:", err)
+		return nil
+	}
+	return &loc
+}
+
+// indexTransactions records the location of every transaction in block.
+// It must run inside the same bolt transaction that stores the block.
+func indexTransactions(tx *bolt.Tx, block *Block) error {
+	bucket := tx.Bucket([]byte(bucketTxIndex))
+	if bucket == nil {
+		return errors.New("tx index bucket shouldn't be nil when indexing transactions")
+	}
+	for i, transaction := range block.Transactions {
+		loc := TxLocation{block.Hash, int64(i)}
+		err := bucket.Put(transaction.TXID, loc.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReindexTransactions drops the tx index bucket and rebuilds it from every block.
+func (bc *BlockChain) ReindexTransactions() error {
+	return bc.rebuildIndex(bucketTxIndex, indexTransactions)
+}
+
+// findTransactionBlock returns the block containing txid and the transaction's position in it.
+func (bc *BlockChain) findTransactionBlock(txid []byte) (*Block, int64) {
+	var block *Block
+	var position int64
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		indexBucket := tx.Bucket([]byte(bucketTxIndex))
+		if indexBucket == nil {
+			return errors.New("tx index bucket shouldn't be nil")
+		}
+		data := indexBucket.Get(txid)
+		if data == nil {
+			return nil
+		}
+		loc := deserializeTxLocation(data)
+		if loc == nil {
+			return errors.New("invalid tx location")
+		}
+		block = Deserialize(tx.Bucket([]byte(bucketBlock)).Get(loc.BlockHash))
+		if block == nil || loc.Position >= int64(len(block.Transactions)) {
+			return fmt.Errorf("tx index points to a missing transaction in block %x", loc.BlockHash)
+		}
+		position = loc.Position
+		return nil
+	})
+	if err != nil {
+		fmt.Println("findTransactionBlock err:", err)
+		return nil, 0
+	}
+	return block, position
+}
+
+func (bc *BlockChain) findTransaction(txid []byte) *Transaction {
+	block, position := bc.findTransactionBlock(txid)
+	if block == nil {
+		return nil
+	}
+	return block.Transactions[position]
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func checkTxIndex(t *testing.T, bc *BlockChain, blocks ...*Block) {
+	t.Helper()
+	for _, block := range blocks {
+		for i, tx := range block.Transactions {
+			found, position := bc.findTransactionBlock(tx.TXID)
+			if found == nil || !bytes.Equal(found.Hash, block.Hash) || position != int64(i) {
+				t.Fatalf("the tx index doesn't find %x at position %d of block %x", tx.TXID, i, block.Hash)
+			}
+			if !bytes.Equal(bc.findTransaction(tx.TXID).Serialize(), tx.Serialize()) {
+				t.Fatalf("findTransaction returned another transaction for %x", tx.TXID)
+			}
+		}
+	}
+}
+
+func TestTxIndexFindsMainChainTransactions(t *testing.T) {
+	miner, payee := newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesis := bc.GetBlockByHash(bc.tail)
+	spend := newTestSpend(t, miner, genesis.Transactions[0], 0, payee.getAddress())
+	block := processTestBlock(t, bc, genesis, miner.getAddress(), spend)
+	checkTxIndex(t, bc, genesis, block)
+	if found, _ := bc.findTransactionBlock(bytes.Repeat([]byte{1}, 32)); found != nil || bc.findTransaction(bytes.Repeat([]byte{1}, 32)) != nil {
+		t.Fatal("an unknown txid was found")
+	}
+
+	// The transactions of a side chain aren't indexed.
+	side := processTestBlock(t, bc, genesis, payee.getAddress())
+	if found, _ := bc.findTransactionBlock(side.Transactions[0].TXID); found != nil {
+		t.Fatal("the coinbase of a side chain block was indexed")
+	}
+
+	// A missing index is rebuilt from the main chain when the chain is opened.
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(bucketTxIndex))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.db.Close()
+	bc, err = GetBlockChainInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.db.Close()
+	checkTxIndex(t, bc, genesis, block)
+	if found, _ := bc.findTransactionBlock(side.Transactions[0].TXID); found != nil {
+		t.Fatal("the rebuilt index holds a side chain transaction")
+	}
+
+	// A location pointing past the block's transactions isn't trusted.
+	err = bc.db.Update(func(tx *bolt.Tx) error {
+		loc := TxLocation{block.Hash, 2}
+		return tx.Bucket([]byte(bucketTxIndex)).Put(spend.TXID, loc.Serialize())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := bc.findTransactionBlock(spend.TXID); found != nil {
+		t.Fatal("a location past the end of the block was returned")
+	}
+	err = bc.ReindexTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTxIndex(t, bc, genesis, block)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// bucketUTXO maps a txid to the outputs of that transaction which are still unspent.
+const bucketUTXO = "bucketUTXO"
+
+// bucketUndo maps a block hash to the outputs the block spent, in the order it spent
+// them, so the block can be disconnected again during a reorganization.
+const bucketUndo = "bucketUndo"
+
+func serializeUTXOs(utxos []UTXOInfo) []byte {
+	var w canonicalWriter
+	w.putUvarint(uint64(len(utxos)))
+	for _, utxo := range utxos {
+		w.putBytes(utxo.Txid)
+		w.putVarint(utxo.Index)
+		utxo.TXOutput.encode(&w)
+	}
+	return w.Bytes()
+}
+
+func deserializeUTXOs(src []byte) []UTXOInfo {
+	r := canonicalReader{src: src}
+	var utxos []UTXOInfo
+	for i, n := 0, r.count(minEncodedUTXO); i < n; i++ {
+		utxo := UTXOInfo{Txid: r.bytes(), Index: r.varint()}
+		utxo.TXOutput = decodeTXOutput(&r)
+		utxos = append(utxos, utxo)
+	}
+	err := r.finish()
+	if err != nil {
+		fmt.Println("Decode utxos err:", err)
+		return nil
+	}
+	return utxos
+}
+
+// updateUTXOSet spends the inputs and adds the outputs of every transaction in block,
+// and records the spent outputs as the undo data of block.
+// It must run inside the same bolt transaction that stores the block.
+func updateUTXOSet(tx *bolt.Tx, block *Block) error {
+	bucket := tx.Bucket([]byte(bucketUTXO))
+	if bucket == nil {
+		return errors.New("UTXO bucket shouldn't be nil when updating the UTXO set")
+	}
+	undoBucket, err := tx.CreateBucketIfNotExists([]byte(bucketUndo))
+	if err != nil {
+		return err
+	}
+	var undo []UTXOInfo
+	for _, transaction := range block.Transactions {
+		if !transaction.isCoinbaseTx() {
+			for _, input := range transaction.TXInputs {
+				data := bucket.Get(input.Txid)
+				if data == nil {
+					return fmt.Errorf("output %x:%d is not in the UTXO set", input.Txid, input.Index)
+				}
+				utxos := deserializeUTXOs(data)
+				var remain []UTXOInfo
+				found := false
+				for _, utxo := range utxos {
+					if utxo.Index == input.Index {
+						found = true
+						undo = append(undo, utxo)
+						continue
+					}
+					remain = append(remain, utxo)
+				}
+				if !found {
+					return fmt.Errorf("output %x:%d is not in the UTXO set", input.Txid, input.Index)
+				}
+				if len(remain) == 0 {
+					err = bucket.Delete(input.Txid)
+				} else {
+					err = bucket.Put(input.Txid, serializeUTXOs(remain))
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		var utxos []UTXOInfo
+		for i, output := range transaction.TXOutputs {
+			utxos = append(utxos, UTXOInfo{transaction.TXID, int64(i), output})
+		}
+		if len(utxos) != 0 {
+			err := bucket.Put(transaction.TXID, serializeUTXOs(utxos))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(undo) == 0 {
+		return undoBucket.Delete(block.Hash)
+	}
+	return undoBucket.Put(block.Hash, serializeUTXOs(undo))
+}
+
+// ReindexUTXO drops the UTXO bucket and rebuilds it by replaying every block from genesis.
+func (bc *BlockChain) ReindexUTXO() error {
+	return bc.rebuildIndex(bucketUTXO, updateUTXOSet)
+}
+
+// CountUTXOTransactions returns the number of transactions that still have unspent outputs.
+func (bc *BlockChain) CountUTXOTransactions() int {
+	count := 0
+	bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketUTXO))
+		if bucket == nil {
+			return nil
+		}
+		count = bucket.Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+func (bc *BlockChain) FindMyUTXO(pubKeyHash []byte) []UTXOInfo {
+	var utxoInfos []UTXOInfo
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketUTXO))
+		if bucket == nil {
+			return errors.New("UTXO bucket shouldn't be nil, please run reindex-utxo")
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			for _, utxo := range deserializeUTXOs(v) {
+				if bytes.Equal(utxo.ScriptPubKeyHash, pubKeyHash) {
+					utxoInfos = append(utxoInfos, utxo)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		fmt.Println("FindMyUTXO err:", err)
+		return nil
+	}
+	return utxoInfos
+}
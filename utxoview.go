@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// UTXOView is a cached, writable view of the unspent outputs used while validating
+// transactions. Spends and new outputs only live in memory; when bc is set, outputs
+// that aren't cached yet are read from the UTXO bucket. The transactions connected
+// to the view are kept in txs so later inputs can find them before they are stored.
+type UTXOView struct {
+	bc      *BlockChain
+	entries map[string][]UTXOInfo
+	txs     map[string]*Transaction
+}
+
+func newUTXOView(bc *BlockChain) *UTXOView {
+	return &UTXOView{bc: bc, entries: make(map[string][]UTXOInfo), txs: make(map[string]*Transaction)}
+}
+
+func (view *UTXOView) outputs(txid []byte) []UTXOInfo {
+	utxos, ok := view.entries[string(txid)]
+	if !ok && view.bc != nil {
+		utxos = view.bc.getUTXOs(txid)
+		view.entries[string(txid)] = utxos
+	}
+	return utxos
+}
+
+// findOutput returns the unspent output txid:index, or nil if it is spent or never existed.
+func (view *UTXOView) findOutput(txid []byte, index int64) *UTXOInfo {
+	for _, utxo := range view.outputs(txid) {
+		if utxo.Index == index {
+			return &utxo
+		}
+	}
+	return nil
+}
+
+func (view *UTXOView) spendOutput(txid []byte, index int64) {
+	var remain []UTXOInfo
+	for _, utxo := range view.outputs(txid) {
+		if utxo.Index != index {
+			remain = append(remain, utxo)
+		}
+	}
+	view.entries[string(txid)] = remain
+}
+
+// connectTransaction spends the inputs of tx and adds its outputs to the view.
+func (view *UTXOView) connectTransaction(tx *Transaction) {
+	if !tx.isCoinbaseTx() {
+		for _, input := range tx.TXInputs {
+			view.spendOutput(input.Txid, input.Index)
+		}
+	}
+	var utxos []UTXOInfo
+	for i, output := range tx.TXOutputs {
+		utxos = append(utxos, UTXOInfo{tx.TXID, int64(i), output})
+	}
+	view.entries[string(tx.TXID)] = utxos
+	view.txs[string(tx.TXID)] = tx
+}
+
+// restoreOutput makes utxo unspent again.
+func (view *UTXOView) restoreOutput(utxo UTXOInfo) {
+	utxos := append(view.outputs(utxo.Txid), utxo)
+	sort.Slice(utxos, func(i, j int) bool { return utxos[i].Index < utxos[j].Index })
+	view.entries[string(utxo.Txid)] = utxos
+}
+
+// disconnectBlock undoes block, whose spent outputs are listed in undo in the order
+// they were spent: the outputs of its transactions disappear and the outputs they
+// spent become unspent again.
+func (view *UTXOView) disconnectBlock(block *Block, undo []UTXOInfo) error {
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		view.entries[string(tx.TXID)] = nil
+		delete(view.txs, string(tx.TXID))
+		if tx.isCoinbaseTx() {
+			continue
+		}
+		for j := len(tx.TXInputs) - 1; j >= 0; j-- {
+			utxo, err := popUndo(&undo, tx.TXInputs[j])
+			if err != nil {
+				return fmt.Errorf("block %x: %v", block.Hash, err)
+			}
+			view.restoreOutput(utxo)
+		}
+	}
+	return nil
+}
+
+// popUndo takes the last entry of undo, which must be the output spent by input.
+func popUndo(undo *[]UTXOInfo, input TXInput) (UTXOInfo, error) {
+	n := len(*undo)
+	if n == 0 {
+		return UTXOInfo{}, fmt.Errorf("the undo data of %x:%d is missing", input.Txid, input.Index)
+	}
+	utxo := (*undo)[n-1]
+	*undo = (*undo)[:n-1]
+	if !bytes.Equal(utxo.Txid, input.Txid) || utxo.Index != input.Index {
+		return UTXOInfo{}, fmt.Errorf("the undo data %x:%d doesn't match input %x:%d",
+			utxo.Txid, utxo.Index, input.Txid, input.Index)
+	}
+	return utxo, nil
+}
+
+// checkInputs makes sure every input of tx spends an output that exists and is still
+// unspent in view with the public key the output pays to, and returns the referenced
+// transactions keyed by txid. Transactions connected to view are found even if they
+// aren't stored yet. No two inputs of tx may spend the same output.
+func (bc *BlockChain) checkInputs(tx *Transaction, view *UTXOView) (map[string]*Transaction, error) {
+	prevTxs := make(map[string]*Transaction)
+	spentBy := make(map[string]int)
+	for i, input := range tx.TXInputs {
+		prevTx := view.txs[string(input.Txid)]
+		if prevTx == nil {
+			prevTx = bc.findTransaction(input.Txid)
+		}
+		if prevTx == nil {
+			return nil, ruleError(ErrMissingTxOut, "input %d of transaction %x spends unknown transaction %x",
+				i, tx.TXID, input.Txid)
+		}
+		if input.Index < 0 || input.Index >= int64(len(prevTx.TXOutputs)) {
+			return nil, ruleError(ErrMissingTxOut, "input %d of transaction %x spends output %d but %x only has %d outputs",
+				i, tx.TXID, input.Index, input.Txid, len(prevTx.TXOutputs))
+		}
+		if view.findOutput(input.Txid, input.Index) == nil {
+			return nil, ruleError(ErrSpentTxOut, "input %d of transaction %x spends %x:%d which is already spent",
+				i, tx.TXID, input.Txid, input.Index)
+		}
+		outpoint := outpointKey(input.Txid, input.Index)
+		if j, ok := spentBy[outpoint]; ok {
+			return nil, ruleError(ErrSpentTxOut, "input %d of transaction %x spends %s which input %d already spends",
+				i, tx.TXID, outpoint, j)
+		}
+		spentBy[outpoint] = i
+		// The signature only proves ownership of the key the input supplies.
+		if !bytes.Equal(getPubKeyHashFromPubKey(input.PubKey), prevTx.TXOutputs[input.Index].ScriptPubKeyHash) {
+			return nil, ruleError(ErrBadPubKeyHash, "input %d of transaction %x spends %x:%d with a public key the output doesn't pay to",
+				i, tx.TXID, input.Txid, input.Index)
+		}
+		prevTxs[string(input.Txid)] = prevTx
+	}
+	return prevTxs, nil
+}
+
+// getUTXOs returns the unspent outputs of txid stored in the UTXO bucket.
+func (bc *BlockChain) getUTXOs(txid []byte) []UTXOInfo {
+	var utxos []UTXOInfo
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketUTXO))
+		if bucket == nil {
+			return fmt.Errorf("UTXO bucket shouldn't be nil")
+		}
+		data := bucket.Get(txid)
+		if data != nil {
+			utxos = deserializeUTXOs(data)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("getUTXOs err:", err)
+	}
+	return utxos
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func checkRejectedInput(t *testing.T, bc *BlockChain, name string, tx *Transaction, code ErrorCode, input string) {
+	t.Helper()
+	err := bc.checkTransaction(tx, newUTXOView(bc))
+	ruleErr, ok := err.(RuleError)
+	if !ok || ruleErr.ErrorCode != code || !strings.Contains(err.Error(), input) {
+		t.Fatalf("a transaction with %s returned %v, want %v naming %s", name, err, code, input)
+	}
+	if bc.verifyTransaction(tx) {
+		t.Fatalf("a transaction with %s was verified", name)
+	}
+	if newTestMempool(t, bc).AddTransaction(tx) == nil {
+		t.Fatalf("a transaction with %s entered the mempool", name)
+	}
+}
+
+// newTestSpends returns a transaction spending the given outputs of prevTx to to,
+// signed with the key of w.
+func newTestSpends(t *testing.T, w *wallet, prevTx *Transaction, to string, value int64, indexes ...int64) *Transaction {
+	t.Helper()
+	tx := Transaction{Version: txVersion, TXOutputs: []TXOutput{newTXOutput(to, value)}, TimeStamp: prevTx.TimeStamp + 1}
+	for _, index := range indexes {
+		tx.TXInputs = append(tx.TXInputs, TXInput{Txid: prevTx.TXID, Index: index, PubKey: w.PubKey})
+	}
+	tx.setHash()
+	if !tx.sign(w, map[string]*Transaction{string(prevTx.TXID): prevTx}) {
+		t.Fatal("failed to sign the transaction")
+	}
+	return &tx
+}
+
+func TestSpentAndMissingOutputsAreRejected(t *testing.T) {
+	miner, payee := newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesis := bc.GetBlockByHash(bc.tail)
+	genesisCoinbase := genesis.Transactions[0]
+	value := genesisCoinbase.TXOutputs[0].Value
+	spend := newTestSpend(t, miner, genesisCoinbase, 0, payee.getAddress())
+	block := processTestBlock(t, bc, genesis, miner.getAddress(), spend)
+	coinbase := block.Transactions[0]
+
+	// The genesis output was spent by an earlier block.
+	doubleSpend := newTestSpend(t, miner, genesisCoinbase, 0, miner.getAddress())
+	checkRejectedInput(t, bc, "a spent output", doubleSpend, ErrSpentTxOut, "input 0 ")
+	mixed := newTestSpends(t, miner, coinbase, miner.getAddress(), value, 0)
+	mixed.TXInputs = append(mixed.TXInputs, TXInput{Txid: genesisCoinbase.TXID, Index: 0, PubKey: miner.PubKey})
+	mixed.setHash()
+	checkRejectedInput(t, bc, "a spent second output", mixed, ErrSpentTxOut, "input 1 ")
+
+	// Output indexes that don't exist are rejected without a panic.
+	for _, index := range []int64{1, -1} {
+		missing := newTestSpends(t, miner, coinbase, miner.getAddress(), value, 0)
+		missing.TXInputs[0].Index = index
+		missing.setHash()
+		checkRejectedInput(t, bc, "a missing output index", missing, ErrMissingTxOut, "input 0 ")
+	}
+	unknown := newTestSpends(t, miner, coinbase, miner.getAddress(), value, 0)
+	unknown.TXInputs[0].Txid = append([]byte{}, spend.TXID...)
+	unknown.TXInputs[0].Txid[0] ^= 0xff
+	unknown.setHash()
+	checkRejectedInput(t, bc, "an unknown transaction", unknown, ErrMissingTxOut, "input 0 ")
+
+	// Spending one output twice in the same transaction doesn't count it twice.
+	twice := newTestSpends(t, miner, coinbase, miner.getAddress(), 2*coinbase.TXOutputs[0].Value, 0, 0)
+	checkRejectedInput(t, bc, "an output spent twice", twice, ErrSpentTxOut, "input 1 ")
+	err := bc.ProcessBlock(mineTestBlock(t, bc, miner.getAddress(), twice))
+	if ruleErr, ok := err.(RuleError); !ok || ruleErr.ErrorCode != ErrDoubleSpendInBlock {
+		t.Fatalf("a block with an output spent twice by one transaction returned %v", err)
+	}
+
+	// Two transactions of a block spending the same output.
+	first := newTestSpend(t, miner, coinbase, 0, payee.getAddress())
+	second := newTestSpend(t, miner, coinbase, 0, miner.getAddress())
+	err = bc.ProcessBlock(mineTestBlock(t, bc, miner.getAddress(), first, second))
+	if ruleErr, ok := err.(RuleError); !ok || ruleErr.ErrorCode != ErrDoubleSpendInBlock {
+		t.Fatalf("a block spending an output twice returned %v", err)
+	}
+	// The unspent output is still spendable.
+	err = bc.checkTransaction(first, newUTXOView(bc))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrorCode identifies the consensus rule a block breaks.
+type ErrorCode int
+
+const (
+	ErrBadBlockHash ErrorCode = iota
+	ErrUnknownVersion
+	ErrOrphanBlock
+	ErrBadGenesis
+	ErrBadHeight
+	ErrBadBits
+	ErrHighHash
+	ErrBadNonce
+	ErrTimeTooOld
+	ErrTimeTooNew
+	ErrNoTransactions
+	ErrFirstTxNotCoinbase
+	ErrMultipleCoinbases
+	ErrBadCoinbaseHeight
+	ErrBadTxID
+	ErrBadTxVersion
+	ErrDuplicateTx
+	ErrBadMerkleRoot
+	ErrDoubleSpendInBlock
+	ErrMissingTxOut
+	ErrSpentTxOut
+	ErrBadPubKeyHash
+	ErrBadTxValue
+	ErrBadSignature
+	ErrBadCoinbaseValue
+	ErrInvalidAncestor
+)
+
+var errorCodeStrings = map[ErrorCode]string{
+	ErrBadBlockHash:       "ErrBadBlockHash",
+	ErrUnknownVersion:     "ErrUnknownVersion",
+	ErrOrphanBlock:        "ErrOrphanBlock",
+	ErrBadGenesis:         "ErrBadGenesis",
+	ErrBadHeight:          "ErrBadHeight",
+	ErrBadBits:            "ErrBadBits",
+	ErrHighHash:           "ErrHighHash",
+	ErrBadNonce:           "ErrBadNonce",
+	ErrTimeTooOld:         "ErrTimeTooOld",
+	ErrTimeTooNew:         "ErrTimeTooNew",
+	ErrNoTransactions:     "ErrNoTransactions",
+	ErrFirstTxNotCoinbase: "ErrFirstTxNotCoinbase",
+	ErrMultipleCoinbases:  "ErrMultipleCoinbases",
+	ErrBadCoinbaseHeight:  "ErrBadCoinbaseHeight",
+	ErrBadTxID:            "ErrBadTxID",
+	ErrBadTxVersion:       "ErrBadTxVersion",
+	ErrDuplicateTx:        "ErrDuplicateTx",
+	ErrBadMerkleRoot:      "ErrBadMerkleRoot",
+	ErrDoubleSpendInBlock: "ErrDoubleSpendInBlock",
+	ErrMissingTxOut:       "ErrMissingTxOut",
+	ErrSpentTxOut:         "ErrSpentTxOut",
+	ErrBadPubKeyHash:      "ErrBadPubKeyHash",
+	ErrBadTxValue:         "ErrBadTxValue",
+	ErrBadSignature:       "ErrBadSignature",
+	ErrBadCoinbaseValue:   "ErrBadCoinbaseValue",
+	ErrInvalidAncestor:    "ErrInvalidAncestor",
+}
+
+func (e ErrorCode) String() string {
+	if s := errorCodeStrings[e]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("Unknown ErrorCode (%d)", int(e))
+}
+
+// RuleError is returned by ValidateBlock when a block breaks a consensus rule.
+type RuleError struct {
+	ErrorCode   ErrorCode
+	Description string
+}
+
+func (e RuleError) Error() string {
+	return fmt.Sprintf("%s: %s", e.ErrorCode, e.Description)
+}
+
+func ruleError(c ErrorCode, format string, args ...interface{}) RuleError {
+	return RuleError{ErrorCode: c, Description: fmt.Sprintf(format, args...)}
+}
+
+// ValidateBlock checks every consensus rule for block, which must extend the tail,
+// against its parent and the UTXO set.
+func (bc *BlockChain) ValidateBlock(block *Block) error {
+	return bc.validateBlock(block, newUTXOView(bc))
+}
+
+// validateBlock checks block against view, the unspent outputs right before it.
+// The view is updated with the transactions of block as they are checked.
+// Blocks with a Version older than merkleTreeVersion were migrated from the float
+// amount format, so their TXIDs and signatures can no longer be recomputed and
+// are trusted as stored.
+func (bc *BlockChain) validateBlock(block *Block, view *UTXOView) error {
+	err := bc.checkBlockHeader(block)
+	if err != nil {
+		return err
+	}
+	err = checkBlockTransactions(block)
+	if err != nil {
+		return err
+	}
+	return bc.checkBlockInputs(block, view)
+}
+
+// checkBlockHeader checks the header of block against its parent, which must be stored.
+func (bc *BlockChain) checkBlockHeader(block *Block) error {
+	if block.Version > blockVersion {
+		return ruleError(ErrUnknownVersion, "block version %d is newer than %d", block.Version, blockVersion)
+	}
+
+	pow := NewProofOfWork(block)
+	hash := headerHash(block)
+	if !bytes.Equal(hash, block.Hash) {
+		return ruleError(ErrBadBlockHash, "block hash %x doesn't match the header hash %x", block.Hash, hash)
+	}
+
+	if len(block.PrevHash) == 0 {
+		if block.Height != 0 {
+			return ruleError(ErrBadGenesis, "a block without parent must be at height 0, not %d", block.Height)
+		}
+	} else {
+		prev := bc.headerBlock(block.PrevHash)
+		if prev == nil {
+			return ruleError(ErrOrphanBlock, "the parent block %x is unknown", block.PrevHash)
+		}
+		if block.Height != prev.Height+1 {
+			return ruleError(ErrBadHeight, "block height %d doesn't follow parent height %d", block.Height, prev.Height)
+		}
+		medianTime := bc.medianTimePast(prev)
+		if block.Version >= timeRulesVersion && block.TimeStamp <= medianTime {
+			return ruleError(ErrTimeTooOld, "block timestamp %d isn't after the median time %d of its ancestors",
+				block.TimeStamp, medianTime)
+		}
+	}
+	if block.TimeStamp > maxBlockTime() {
+		return ruleError(ErrTimeTooNew, "block timestamp %d is more than %d seconds in the future",
+			block.TimeStamp, maxFutureBlockTime)
+	}
+	if block.Version >= timeRulesVersion && block.Nonce > maxNonce {
+		return ruleError(ErrBadNonce, "block nonce %d is larger than %d", block.Nonce, maxNonce)
+	}
+	expectedBits := bc.expectedBits(block)
+	if normalizeBits(block.Bits) != expectedBits {
+		return ruleError(ErrBadBits, "block bits %08x don't match the expected bits %08x", block.Bits, expectedBits)
+	}
+	if !pow.IsValid(expectedBits) {
+		return ruleError(ErrHighHash, "block hash %x is above the target of bits %08x", block.Hash, block.Bits)
+	}
+	return nil
+}
+
+// checkBlockTransactions checks the rules on the transactions of block that don't
+// depend on the outputs they spend.
+func checkBlockTransactions(block *Block) error {
+	legacy := block.Version < merkleTreeVersion
+	if len(block.Transactions) == 0 {
+		return ruleError(ErrNoTransactions, "the block has no transactions")
+	}
+	if !block.Transactions[0].isCoinbaseTx() {
+		return ruleError(ErrFirstTxNotCoinbase, "the first transaction isn't a coinbase")
+	}
+	coinbase := block.Transactions[0]
+	if !legacy && !bytes.HasPrefix(coinbase.TXInputs[0].ScriptSig, uintToByte(block.Height)) {
+		return ruleError(ErrBadCoinbaseHeight, "the coinbase doesn't commit to height %d", block.Height)
+	}
+
+	var wantTxVersion uint64 = legacyTxVersion
+	if block.Version >= canonicalTxVersion {
+		wantTxVersion = txVersion
+	}
+	seenTxs := make(map[string]*Transaction)
+	for i, tx := range block.Transactions {
+		if i > 0 && tx.isCoinbaseTx() {
+			return ruleError(ErrMultipleCoinbases, "transaction %d is a second coinbase", i)
+		}
+		if tx.Version != wantTxVersion {
+			return ruleError(ErrBadTxVersion, "transaction %d has version %d but a version %d block requires %d",
+				i, tx.Version, block.Version, wantTxVersion)
+		}
+		if !legacy && !bytes.Equal(tx.computeTXID(), tx.TXID) {
+			return ruleError(ErrBadTxID, "transaction %d has TXID %x but hashes to %x", i, tx.TXID, tx.computeTXID())
+		}
+		if seenTxs[string(tx.TXID)] != nil {
+			return ruleError(ErrDuplicateTx, "transaction %x appears twice", tx.TXID)
+		}
+		seenTxs[string(tx.TXID)] = tx
+	}
+
+	merkleBlock := Block{Version: block.Version, Transactions: block.Transactions}
+	merkleBlock.HashTransactionMerkleRoot()
+	if !bytes.Equal(merkleBlock.MerkleRoot, block.MerkleRoot) {
+		return ruleError(ErrBadMerkleRoot, "merkle root %x doesn't match the computed %x", block.MerkleRoot, merkleBlock.MerkleRoot)
+	}
+	return nil
+}
+
+// checkBlockInputs checks that the transactions of block only spend unspent outputs
+// of view, pay valid signatures and fees, and that the coinbase claims no more than
+// the subsidy plus fees. The view is updated with the transactions as they are checked.
+func (bc *BlockChain) checkBlockInputs(block *Block, view *UTXOView) error {
+	legacy := block.Version < merkleTreeVersion
+	coinbase := block.Transactions[0]
+	view.connectTransaction(coinbase)
+	spent := make(map[string]bool)
+	var fees int64
+	var ok bool
+	for i, tx := range block.Transactions[1:] {
+		for _, input := range tx.TXInputs {
+			outpoint := fmt.Sprintf("%x:%d", input.Txid, input.Index)
+			if spent[outpoint] {
+				return ruleError(ErrDoubleSpendInBlock, "output %s is spent twice in the block", outpoint)
+			}
+			spent[outpoint] = true
+		}
+		// Inputs may spend outputs created earlier in the same block, which the view already holds.
+		prevTxs, err := bc.checkInputs(tx, view)
+		if err != nil {
+			return err
+		}
+		fee, err := tx.fee(prevTxs)
+		if err != nil {
+			return ruleError(ErrBadTxValue, "transaction %d: %v", i+1, err)
+		}
+		if !legacy && !tx.verify(prevTxs, block.Version) {
+			return ruleError(ErrBadSignature, "transaction %x has an invalid signature", tx.TXID)
+		}
+		fees, ok = addAmount(fees, fee)
+		if !ok {
+			return ruleError(ErrBadTxValue, "the total fee is out of range")
+		}
+		view.connectTransaction(tx)
+	}
+
+	var coinbaseValue int64
+	for _, output := range coinbase.TXOutputs {
+		coinbaseValue, ok = addAmount(coinbaseValue, output.Value)
+		if !ok || output.Value < 0 {
+			return ruleError(ErrBadCoinbaseValue, "the coinbase value is out of range")
+		}
+	}
+	subsidy := blockSubsidy(block.Height)
+	if coinbaseValue > subsidy+fees {
+		return ruleError(ErrBadCoinbaseValue, "the coinbase pays %s, more than the subsidy %s plus fees %s",
+			formatAmount(coinbaseValue), formatAmount(subsidy), formatAmount(fees))
+	}
+	return nil
+}
+
+// VerifyChain validates every block of the main chain from genesis and returns
+// the first invalid block together with the rule it breaks. Once every block is
+// valid, the UTXO set is compared with the outputs the blocks left unspent.
+func (bc *BlockChain) VerifyChain() (*Block, error) {
+	hashes, err := bc.blockHashesFromGenesis()
+	if err != nil {
+		return nil, err
+	}
+	// The UTXO bucket holds the state at the tail, so replay the chain in memory instead.
+	view := newUTXOView(nil)
+	for _, hash := range hashes {
+		block := bc.GetBlockByHash(hash)
+		if block == nil {
+			return nil, fmt.Errorf("failed to read block %x", hash)
+		}
+		err = bc.validateBlock(block, view)
+		if err != nil {
+			return block, err
+		}
+	}
+	return nil, bc.checkUTXOSet(view)
+}
+
+// checkUTXOSet compares the UTXO bucket with view, the outputs left unspent by
+// replaying the main chain.
+func (bc *BlockChain) checkUTXOSet(view *UTXOView) error {
+	return bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketUTXO))
+		if bucket == nil {
+			return errors.New("UTXO bucket shouldn't be nil, please run reindex-utxo")
+		}
+		stored := 0
+		err := bucket.ForEach(func(k, v []byte) error {
+			stored++
+			utxos := view.entries[string(k)]
+			if len(utxos) == 0 {
+				return fmt.Errorf("the UTXO set holds outputs of %x which the chain left none of, please run reindex-utxo", k)
+			}
+			if !bytes.Equal(v, serializeUTXOs(utxos)) {
+				return fmt.Errorf("the UTXO set entry of %x doesn't match the chain, please run reindex-utxo", k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		unspent := 0
+		for _, utxos := range view.entries {
+			if len(utxos) != 0 {
+				unspent++
+			}
+		}
+		if stored != unspent {
+			return fmt.Errorf("the UTXO set holds outputs of %d transactions but the chain left %d, please run reindex-utxo", stored, unspent)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// newTestChain creates a chain paying its genesis coinbase to miner in a temporary
+// working directory, since the database and wallet files live in the current one.
+func newTestChain(t *testing.T, miner string) *BlockChain {
+	t.Helper()
+	chdirTemp(t)
+	err := CreateBlockChain(miner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := GetBlockChainInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bc.db.Close() })
+	return bc
+}
+
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	chdir(t, t.TempDir())
+}
+
+// chdir changes the working directory to dir until the test ends.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// newTestSpend returns a transaction spending output index of prevTx to to, supplying
+// and signing with the key of w.
+func newTestSpend(t *testing.T, w *wallet, prevTx *Transaction, index int64, to string) *Transaction {
+	t.Helper()
+	input := TXInput{Txid: prevTx.TXID, Index: index, PubKey: w.PubKey}
+	output := newTXOutput(to, prevTx.TXOutputs[index].Value)
+	tx := Transaction{txVersion, nil, []TXInput{input}, []TXOutput{output}, uint64(time.Now().Unix())}
+	tx.setHash()
+	if !tx.sign(w, map[string]*Transaction{string(prevTx.TXID): prevTx}) {
+		t.Fatal("failed to sign the transaction")
+	}
+	return &tx
+}
+
+// mineTestBlock mines txs after a fresh coinbase on top of the tail.
+func mineTestBlock(t *testing.T, bc *BlockChain, miner string, txs ...*Transaction) *Block {
+	t.Helper()
+	return mineTestBlockOn(t, bc, bc.GetBlockByHash(bc.tail), miner, txs...)
+}
+
+// mineTestBlockOn mines txs after a fresh coinbase on top of parent.
+func mineTestBlockOn(t *testing.T, bc *BlockChain, parent *Block, miner string, txs ...*Transaction) *Block {
+	t.Helper()
+	coinbase := NewCoinbaseTx(miner, "test", parent.Height+1, 0)
+	block := NewBlock(append([]*Transaction{coinbase}, txs...), parent.Hash, parent.Height+1,
+		bc.calcNextBits(parent), bc.medianTimePast(parent)+1)
+	if block == nil {
+		t.Fatal("failed to mine the block")
+	}
+	return block
+}
+
+func balance(bc *BlockChain, w *wallet) int64 {
+	var total int64
+	for _, utxo := range bc.FindMyUTXO(getPubKeyHashFromPubKey(w.PubKey)) {
+		total += utxo.Value
+	}
+	return total
+}
+
+func TestForeignKeySpendIsRejected(t *testing.T) {
+	victim, thief := newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, victim.getAddress())
+	genesisCoinbase := bc.GetBlockByHash(bc.tail).Transactions[0]
+
+	theft := newTestSpend(t, thief, genesisCoinbase, 0, thief.getAddress())
+	if bc.verifyTransaction(theft) {
+		t.Fatal("verifyTransaction accepted a spend signed with a foreign key")
+	}
+	err := bc.ProcessBlock(mineTestBlock(t, bc, thief.getAddress(), theft))
+	ruleErr, ok := err.(RuleError)
+	if !ok || ruleErr.ErrorCode != ErrBadPubKeyHash {
+		t.Fatalf("ProcessBlock returned %v, want %v", err, ErrBadPubKeyHash)
+	}
+	if balance(bc, thief) != 0 || balance(bc, victim) != genesisCoinbase.TXOutputs[0].Value {
+		t.Fatal("the rejected block changed the balances")
+	}
+
+	spend := newTestSpend(t, victim, genesisCoinbase, 0, thief.getAddress())
+	err = bc.ProcessBlock(mineTestBlock(t, bc, victim.getAddress(), spend))
+	if err != nil {
+		t.Fatal("the owner's spend was rejected:", err)
+	}
+	if balance(bc, thief) != genesisCoinbase.TXOutputs[0].Value {
+		t.Fatal("the owner's spend didn't reach the payee")
+	}
+}
+
+func TestAddBlockReturnsVerificationError(t *testing.T) {
+	victim, thief := newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, victim.getAddress())
+	tail := bc.tail
+	genesisCoinbase := bc.GetBlockByHash(tail).Transactions[0]
+
+	theft := newTestSpend(t, thief, genesisCoinbase, 0, thief.getAddress())
+	coinbase := NewCoinbaseTx(thief.getAddress(), "test", 1, 0)
+	err := bc.AddBlock([]*Transaction{coinbase, theft})
+	ruleErr, ok := err.(RuleError)
+	if !ok || ruleErr.ErrorCode != ErrBadPubKeyHash {
+		t.Fatalf("AddBlock returned %v, want %v", err, ErrBadPubKeyHash)
+	}
+	if string(bc.tail) != string(tail) {
+		t.Fatal("AddBlock mined a block without the invalid transaction")
+	}
+}
+
+// remineTestBlock mines block again after a test changed its header.
+func remineTestBlock(t *testing.T, block *Block) {
+	t.Helper()
+	hash, nonce, err := NewProofOfWork(block).Run(context.Background())
+	if err != nil {
+		t.Fatal("failed to mine the block:", err)
+	}
+	block.Hash, block.Nonce = hash, nonce
+}
+
+func TestInvalidBlocksAreRejected(t *testing.T) {
+	miner := newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesis := bc.GetBlockByHash(bc.tail)
+	spend := newTestSpend(t, miner, genesis.Transactions[0], 0, newWalletKeyPair().getAddress())
+	cases := []struct {
+		name  string
+		block func() *Block
+		want  ErrorCode
+	}{
+		{"a bad merkle root", func() *Block {
+			block := mineTestBlock(t, bc, miner.getAddress())
+			// The root of a single transaction is its TXID, so flip a copy.
+			block.MerkleRoot = append([]byte{}, block.MerkleRoot...)
+			block.MerkleRoot[0] ^= 1
+			remineTestBlock(t, block)
+			return block
+		}, ErrBadMerkleRoot},
+		{"bad bits", func() *Block {
+			coinbase := NewCoinbaseTx(miner.getAddress(), "test", 1, 0)
+			return NewBlock([]*Transaction{coinbase}, genesis.Hash, 1, powLimitBits, genesis.TimeStamp+1)
+		}, ErrBadBits},
+		{"a timestamp at the median time past", func() *Block {
+			block := mineTestBlock(t, bc, miner.getAddress())
+			block.TimeStamp = bc.medianTimePast(genesis)
+			remineTestBlock(t, block)
+			return block
+		}, ErrTimeTooOld},
+		{"a timestamp below the median time past", func() *Block {
+			block := mineTestBlock(t, bc, miner.getAddress())
+			block.TimeStamp = bc.medianTimePast(genesis) - 1
+			remineTestBlock(t, block)
+			return block
+		}, ErrTimeTooOld},
+		{"an overpaying coinbase", func() *Block {
+			coinbase := NewCoinbaseTx(miner.getAddress(), "test", 1, 1)
+			return NewBlock([]*Transaction{coinbase}, genesis.Hash, 1, bc.calcNextBits(genesis), genesis.TimeStamp+1)
+		}, ErrBadCoinbaseValue},
+		{"a duplicate transaction", func() *Block {
+			return mineTestBlock(t, bc, miner.getAddress(), spend, spend)
+		}, ErrDuplicateTx},
+		{"a bad signature", func() *Block {
+			forged := *spend
+			forged.TXInputs = []TXInput{spend.TXInputs[0]}
+			forged.TXInputs[0].ScriptSig = append([]byte{}, spend.TXInputs[0].ScriptSig...)
+			forged.TXInputs[0].ScriptSig[len(forged.TXInputs[0].ScriptSig)-1] ^= 1
+			return mineTestBlock(t, bc, miner.getAddress(), &forged)
+		}, ErrBadSignature},
+	}
+	for _, c := range cases {
+		block := c.block()
+		err := bc.ValidateBlock(block)
+		ruleErr, ok := err.(RuleError)
+		if !ok || ruleErr.ErrorCode != c.want {
+			t.Fatalf("a block with %s was rejected with %v, want %v", c.name, err, c.want)
+		}
+		err = bc.ProcessBlock(block)
+		if ruleErr, ok := err.(RuleError); !ok || ruleErr.ErrorCode != c.want {
+			t.Fatalf("ProcessBlock returned %v for a block with %s, want %v", err, c.name, c.want)
+		}
+		if !bytes.Equal(bc.tail, genesis.Hash) {
+			t.Fatalf("the block with %s was connected", c.name)
+		}
+	}
+
+	// The spend the rejected blocks carried is valid on its own.
+	err := bc.ProcessBlock(mineTestBlock(t, bc, miner.getAddress(), spend))
+	if err != nil {
+		t.Fatal("the valid spend was rejected:", err)
+	}
+}
+
+func TestVerifyChainCatchesATamperedUTXOSet(t *testing.T) {
+	miner, payee := newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesisCoinbase := bc.GetBlockByHash(bc.tail).Transactions[0]
+	spend := newTestSpend(t, miner, genesisCoinbase, 0, payee.getAddress())
+	err := bc.ProcessBlock(mineTestBlock(t, bc, miner.getAddress(), spend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block, err := bc.VerifyChain(); block != nil || err != nil {
+		t.Fatalf("VerifyChain rejected a valid chain at %v: %v", block, err)
+	}
+
+	tamper := func(name string, update func(bucket *bolt.Bucket) error) {
+		err := bc.db.Update(func(tx *bolt.Tx) error {
+			return update(tx.Bucket([]byte(bucketUTXO)))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block, err := bc.VerifyChain(); block != nil || err == nil {
+			t.Fatalf("VerifyChain accepted a UTXO set with %s: %v, %v", name, block, err)
+		}
+		err = bc.ReindexUTXO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block, err := bc.VerifyChain(); block != nil || err != nil {
+			t.Fatalf("VerifyChain rejected the reindexed UTXO set: %v, %v", block, err)
+		}
+	}
+	tamper("a raised value", func(bucket *bolt.Bucket) error {
+		utxos := deserializeUTXOs(bucket.Get(spend.TXID))
+		utxos[0].Value++
+		return bucket.Put(spend.TXID, serializeUTXOs(utxos))
+	})
+	tamper("a missing entry", func(bucket *bolt.Bucket) error {
+		return bucket.Delete(spend.TXID)
+	})
+	tamper("a spent output", func(bucket *bolt.Bucket) error {
+		return bucket.Put(genesisCoinbase.TXID, serializeUTXOs([]UTXOInfo{{genesisCoinbase.TXID, 0, genesisCoinbase.TXOutputs[0]}}))
+	})
+}
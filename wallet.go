@@ -6,31 +6,162 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"math/big"
+	"github.com/btcsuite/btcd/btcec/v2"
+	btcecdsa "github.com/btcsuite/btcd/btcec/v2/ecdsa"
 	"github.com/btcsuite/btcutil/base58"
 	"golang.org/x/crypto/ripemd160"
 )
 
+// wallet holds a secp256k1 key whose PubKey is SEC1 compressed, so that its address
+// is the Bitcoin P2PKH address of the same private key. A key of a wallet created
+// before secp256k1 keys is a P-256 key in p256Key instead, with PubKey in the
+// encoding its address was derived from.
 type wallet struct {
-	PriKey *ecdsa.PrivateKey
-	PubKey []byte
+	PriKey  *btcec.PrivateKey
+	PubKey  []byte
+	p256Key *ecdsa.PrivateKey
 }
 
 func newWalletKeyPair() *wallet {
-	curve := elliptic.P256()
-	priKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	priKey, err := btcec.NewPrivateKey()
 	if err != nil {
-		fmt.Println("ecdsa.GenerateKey err:", err)
+		fmt.Println("btcec.NewPrivateKey err:", err)
 		return nil
 	}
-	pubKeyRaw := priKey.PublicKey
-	pubKey := append(pubKeyRaw.X.Bytes(), pubKeyRaw.Y.Bytes()...)
-	wallet := wallet{priKey, pubKey}
+	return newWallet(priKey)
+}
+
+func newWallet(priKey *btcec.PrivateKey) *wallet {
+	wallet := wallet{PriKey: priKey, PubKey: priKey.PubKey().SerializeCompressed()}
+	return &wallet
+}
+
+func newP256Wallet(priKey *ecdsa.PrivateKey, pubKey []byte) *wallet {
+	wallet := wallet{PubKey: pubKey, p256Key: priKey}
 	return &wallet
 }
 
+// isLocked reports whether w has only the public key, as in a locked wallet.
+func (w *wallet) isLocked() bool {
+	return w.PriKey == nil && w.p256Key == nil
+}
+
+// sign returns the signature of hash: r followed by s, each padded to keyFieldSize bytes.
+func (w *wallet) sign(hash []byte) []byte {
+	if w.p256Key != nil {
+		r, s, err := ecdsa.Sign(rand.Reader, w.p256Key, hash)
+		if err != nil {
+			fmt.Println("ecdsa.Sign err:", err)
+			return nil
+		}
+		signature := make([]byte, 2*keyFieldSize)
+		r.FillBytes(signature[:keyFieldSize])
+		s.FillBytes(signature[keyFieldSize:])
+		return signature
+	}
+	// The compact signature is a recovery byte followed by r and s.
+	return btcecdsa.SignCompact(w.PriKey, hash, true)[1:]
+}
+
+// P-256 public keys, which every block before secp256k1Version used, are encoded as
+// X followed by Y and signatures as r followed by s, each number padded to
+// keyFieldSize bytes. Wallets created before strictEncodingVersion didn't pad the
+// public keys, so the rare key with a short X or Y can't spend in newer blocks.
+const keyFieldSize = 32
+
+// decodeP256Key returns the P-256 private key with scalar d whose public key is
+// pubKey, in the encoding of the wallet that created it.
+func decodeP256Key(d, pubKey []byte) (*ecdsa.PrivateKey, error) {
+	pub, err := decodePubKey(pubKey, false)
+	if err != nil {
+		return nil, err
+	}
+	priKey := &ecdsa.PrivateKey{PublicKey: *pub, D: new(big.Int).SetBytes(d)}
+	x, y := pub.Curve.ScalarBaseMult(d)
+	if priKey.D.Sign() == 0 || x.Cmp(pub.X) != 0 || y.Cmp(pub.Y) != 0 {
+		return nil, errors.New("the private key doesn't match the public key")
+	}
+	return priKey, nil
+}
+
+// splitPair splits data into its two numbers. Unless strict is set, shorter data is
+// split in half, as it was before the numbers were padded.
+func splitPair(data []byte, strict bool) (*big.Int, *big.Int, error) {
+	if strict && len(data) != 2*keyFieldSize {
+		return nil, nil, fmt.Errorf("%d bytes instead of %d", len(data), 2*keyFieldSize)
+	}
+	if len(data) == 0 || len(data) > 2*keyFieldSize {
+		return nil, nil, fmt.Errorf("malformed length %d", len(data))
+	}
+	half := len(data) / 2
+	return new(big.Int).SetBytes(data[:half]), new(big.Int).SetBytes(data[half:]), nil
+}
+
+func decodePubKey(data []byte, strict bool) (*ecdsa.PublicKey, error) {
+	x, y, err := splitPair(data, strict)
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("the point isn't on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeSignature(data []byte, strict bool) (*big.Int, *big.Int, error) {
+	return splitPair(data, strict)
+}
+
+// verifySignature checks that signature signs hash with pubKey under the rules of a
+// block of the given version. From secp256k1Version on a compressed public key is a
+// secp256k1 key; P-256 keys stay valid so that the outputs they own can be spent.
+func verifySignature(pubKey, signature, hash []byte, version uint64) error {
+	if version >= secp256k1Version && len(pubKey) == btcec.PubKeyBytesLenCompressed {
+		return verifySecp256k1(pubKey, signature, hash)
+	}
+	strict := version >= strictEncodingVersion
+	key, err := decodePubKey(pubKey, strict)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	r, s, err := decodeSignature(signature, strict)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	if !ecdsa.Verify(key, hash, r, s) {
+		return errors.New("the signature doesn't match")
+	}
+	return nil
+}
+
+func verifySecp256k1(pubKey, signature, hash []byte) error {
+	key, err := btcec.ParsePubKey(pubKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(signature) != 2*keyFieldSize {
+		return fmt.Errorf("invalid signature: %d bytes instead of %d", len(signature), 2*keyFieldSize)
+	}
+	var r, s btcec.ModNScalar
+	if r.SetByteSlice(signature[:keyFieldSize]) || s.SetByteSlice(signature[keyFieldSize:]) || r.IsZero() || s.IsZero() {
+		return errors.New("invalid signature: r or s is out of range")
+	}
+	if !btcecdsa.NewSignature(&r, &s).Verify(hash, key) {
+		return errors.New("the signature doesn't match")
+	}
+	return nil
+}
+
 func (w *wallet) getAddress() string {
 	pubKeyHash := getPubKeyHashFromPubKey(w.PubKey)
+	return getAddressFromPubKeyHash(pubKeyHash)
+}
+
+func getAddressFromPubKeyHash(pubKeyHash []byte) string {
 	payload := append([]byte{byte(0x00)}, pubKeyHash...)
 	checksum := checkSum(payload)
 	payload = append(payload, checksum...)
@@ -63,6 +194,42 @@ func checkSum(payload []byte) []byte {
 	return checksum
 }
 
+// Private keys are exported in Wallet Import Format: the base58 encoding of the
+// version byte, the 32-byte key, the flag of a compressed public key and a checksum.
+const (
+	wifVersion    = 0x80
+	wifCompressed = 0x01
+)
+
+func encodeWIF(priKey *btcec.PrivateKey) string {
+	payload := append([]byte{wifVersion}, priKey.Serialize()...)
+	payload = append(payload, wifCompressed)
+	payload = append(payload, checkSum(payload)...)
+	return base58.Encode(payload)
+}
+
+func decodeWIF(wif string) (*btcec.PrivateKey, error) {
+	decodeInfo := base58.Decode(wif)
+	if len(decodeInfo) == 1+btcec.PrivKeyBytesLen+4 {
+		return nil, errors.New("the key is for an uncompressed public key, whose address differs from the wallet's")
+	}
+	if len(decodeInfo) != 1+btcec.PrivKeyBytesLen+1+4 {
+		return nil, errors.New("the length is invalid")
+	}
+	payload := decodeInfo[:len(decodeInfo)-4]
+	if !bytes.Equal(decodeInfo[len(decodeInfo)-4:], checkSum(payload)) {
+		return nil, errors.New("the checksum is incorrect")
+	}
+	if payload[0] != wifVersion || payload[len(payload)-1] != wifCompressed {
+		return nil, errors.New("the version or compression flag is invalid")
+	}
+	var k btcec.ModNScalar
+	if k.SetByteSlice(payload[1:len(payload)-1]) || k.IsZero() {
+		return nil, errors.New("the private key is out of range")
+	}
+	return btcec.PrivKeyFromScalar(&k), nil
+}
+
 func isValidAddress(address string) bool {
 	decodeInfo := base58.Decode(address)
 	if len(decodeInfo) != 25 {
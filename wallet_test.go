@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+func TestSecp256k1SignAndVerify(t *testing.T) {
+	w := newWalletKeyPair()
+	if len(w.PubKey) != btcec.PubKeyBytesLenCompressed {
+		t.Fatalf("the public key has %d bytes, want a compressed key", len(w.PubKey))
+	}
+	hash := sha256.Sum256([]byte("message"))
+	signature := w.sign(hash[:])
+	err := verifySignature(w.PubKey, signature, hash[:], blockVersion)
+	if err != nil {
+		t.Fatal("the signature doesn't verify:", err)
+	}
+	other := sha256.Sum256([]byte("other message"))
+	if verifySignature(w.PubKey, signature, other[:], blockVersion) == nil {
+		t.Fatal("the signature verifies for another hash")
+	}
+	if verifySignature(newWalletKeyPair().PubKey, signature, hash[:], blockVersion) == nil {
+		t.Fatal("the signature verifies for another key")
+	}
+}
+
+func TestP2PKHAddress(t *testing.T) {
+	// The key 1 and its well known compressed P2PKH address.
+	key, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000001")
+	priKey, _ := btcec.PrivKeyFromBytes(key)
+	w := newWallet(priKey)
+	if hex.EncodeToString(w.PubKey) != "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" {
+		t.Fatalf("the public key is %x", w.PubKey)
+	}
+	address := w.getAddress()
+	if address != "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH" {
+		t.Fatalf("the address is %s", address)
+	}
+	if !isValidAddress(address) || !bytes.Equal(getPubKeyHashFromAddress(address), getPubKeyHashFromPubKey(w.PubKey)) {
+		t.Fatal("the address doesn't decode to the public key hash")
+	}
+}
+
+// legacyP256Curve stands for the P-256 curve type that old wallet files gob encoded
+// as the Curve of every key, which current Go versions can't encode any more.
+type legacyP256Curve struct {
+	*elliptic.CurveParams
+}
+
+// newLegacyP256Key returns a P-256 key whose coordinates fill 32 bytes each, so the
+// unpadded public key of the old wallets is also valid in current blocks.
+func newLegacyP256Key(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	for {
+		priKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(priKey.X.Bytes()) == keyFieldSize && len(priKey.Y.Bytes()) == keyFieldSize {
+			return priKey
+		}
+	}
+}
+
+func legacyP256Address(priKey *ecdsa.PrivateKey) string {
+	pubKey := append(priKey.X.Bytes(), priKey.Y.Bytes()...)
+	return getAddressFromPubKeyHash(getPubKeyHashFromPubKey(pubKey))
+}
+
+// writeLegacyWallet writes walletFile holding priKey the way wallets did before
+// secp256k1 keys.
+func writeLegacyWallet(t *testing.T, priKey *ecdsa.PrivateKey) {
+	t.Helper()
+	type legacyWallet struct {
+		PriKey *ecdsa.PrivateKey
+		PubKey []byte
+	}
+	type WalletManager struct {
+		Wallets map[string]*legacyWallet
+	}
+	gob.RegisterName("crypto/elliptic.p256Curve", legacyP256Curve{})
+
+	legacyKey := *priKey
+	legacyKey.Curve = legacyP256Curve{elliptic.P256().Params()}
+	w := &legacyWallet{&legacyKey, append(priKey.X.Bytes(), priKey.Y.Bytes()...)}
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(&WalletManager{map[string]*legacyWallet{legacyP256Address(priKey): w}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(walletFile, buffer.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyP256WalletStillSigns(t *testing.T) {
+	priKey := newLegacyP256Key(t)
+	address := legacyP256Address(priKey)
+	bc := newTestChain(t, address)
+	writeLegacyWallet(t, priKey)
+
+	wm := NewWalletManager()
+	if wm == nil {
+		t.Fatal("the legacy wallet doesn't load")
+	}
+	w := wm.Wallets[address]
+	if w == nil || w.p256Key == nil || w.p256Key.D.Cmp(priKey.D) != 0 {
+		t.Fatalf("the legacy wallet holds %v, want the P-256 key of %s", wm.listAddresses(), address)
+	}
+
+	// The converted file loads the same key, unencrypted and encrypted.
+	wm = NewWalletManager()
+	if wm == nil || wm.Wallets[address] == nil || wm.Wallets[address].p256Key == nil {
+		t.Fatal("the converted wallet file lost the P-256 key")
+	}
+	err := wm.encrypt("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wm = NewWalletManager()
+	if wm == nil || !wm.isLocked() || wm.Wallets[address] == nil {
+		t.Fatal("the encrypted wallet doesn't list the P-256 address")
+	}
+	err = wm.unlock("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = wm.Wallets[address]
+	if w.p256Key == nil || w.p256Key.D.Cmp(priKey.D) != 0 {
+		t.Fatal("unlocking the wallet didn't restore the P-256 key")
+	}
+	if _, err := wm.dumpPrivKey(address); err == nil {
+		t.Fatal("a P-256 key was exported in Wallet Import Format")
+	}
+
+	// The key still spends what was paid to its address.
+	payee := newWalletKeyPair()
+	genesisCoinbase := bc.GetBlockByHash(bc.tail).Transactions[0]
+	spend := newTestSpend(t, w, genesisCoinbase, 0, payee.getAddress())
+	err = bc.ProcessBlock(mineTestBlock(t, bc, payee.getAddress(), spend))
+	if err != nil {
+		t.Fatal("the spend of the P-256 key was rejected:", err)
+	}
+	if balance(bc, payee) != genesisCoinbase.TXOutputs[0].Value+blockSubsidy(1) {
+		t.Fatal("the spend of the P-256 key didn't reach the payee")
+	}
+}
+
+func TestExcessiveScryptParametersAreRejected(t *testing.T) {
+	chdirTemp(t)
+	wm := NewWalletManager()
+	wm.createWallet()
+	err := wm.encrypt("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(walletFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data walletData
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, params := range [][3]int{{1 << 21, 8, 1}, {1<<15 + 1, 8, 1}, {1 << 15, 33, 1}, {1 << 15, 8, 17}} {
+		data.ScryptN, data.ScryptR, data.ScryptP = params[0], params[1], params[2]
+		if (&WalletManager{Wallets: make(map[string]*wallet)}).loadEncrypted(&data) == nil {
+			t.Fatalf("scrypt N=%d r=%d p=%d was accepted", params[0], params[1], params[2])
+		}
+	}
+	data.ScryptN, data.ScryptR, data.ScryptP = maxScryptN, maxScryptR, maxScryptP
+	if err := (&WalletManager{Wallets: make(map[string]*wallet)}).loadEncrypted(&data); err != nil {
+		t.Fatal("the largest scrypt parameters were rejected:", err)
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	chdirTemp(t)
+	wm := NewWalletManager()
+	address := wm.createWallet()
+	priKey := wm.Wallets[address].PriKey.Serialize()
+	if wm.encrypt("") == nil {
+		t.Fatal("the wallet was encrypted with an empty passphrase")
+	}
+	err := wm.encrypt("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wm.encrypt("again") == nil {
+		t.Fatal("an encrypted wallet was encrypted again")
+	}
+	salt := wm.encryption.salt
+
+	wm = NewWalletManager()
+	if !wm.isLocked() || !wm.Wallets[address].isLocked() {
+		t.Fatal("the encrypted wallet was loaded unlocked")
+	}
+	if err := wm.unlock("wrong"); err == nil || !wm.isLocked() {
+		t.Fatalf("a wrong passphrase returned %v", err)
+	}
+	if wm.changePassphrase("wrong", "new") == nil {
+		t.Fatal("the passphrase was changed without the old one")
+	}
+	if wm.changePassphrase("old", "") == nil {
+		t.Fatal("the passphrase was changed to an empty one")
+	}
+	err = wm.changePassphrase("old", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(wm.encryption.salt, salt) {
+		t.Fatal("the new passphrase reused the old salt")
+	}
+
+	wm = NewWalletManager()
+	if wm.unlock("old") == nil {
+		t.Fatal("the old passphrase still unlocks the wallet")
+	}
+	err = wm.unlock("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(wm.Wallets[address].PriKey.Serialize(), priKey) {
+		t.Fatal("the new passphrase unlocked another private key")
+	}
+
+	// The public keys are authenticated with the private keys.
+	wm = NewWalletManager()
+	wm.encryption.pubKeys = [][]byte{newWalletKeyPair().PubKey}
+	if wm.unlock("new") == nil {
+		t.Fatal("the wallet unlocked with a replaced public key")
+	}
+}
+
+// captureStdout returns what f prints.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	output := make(chan []byte)
+	go func() {
+		content, _ := ioutil.ReadAll(r)
+		output <- content
+	}()
+	f()
+	w.Close()
+	return string(<-output)
+}
+
+func TestWIF(t *testing.T) {
+	cases := []struct{ key, wif string }{
+		{"0c28fca386c7a227600b2fe50b7cae11ec86d3bf1fbe471be89827e19d72aa1d", "KwdMAjGmerYanjeui5SHS7JkmpZvVipYvB2LJGU1ZxJwYvP98617"},
+		{"0000000000000000000000000000000000000000000000000000000000000001", "KwDiBf89QgGbjEhKnhXJuH7LrciVrZi3qYjgd9M7rFU73sVHnoWn"},
+	}
+	for _, c := range cases {
+		key, _ := hex.DecodeString(c.key)
+		priKey, _ := btcec.PrivKeyFromBytes(key)
+		if wif := encodeWIF(priKey); wif != c.wif {
+			t.Fatalf("the key %s is encoded as %s, want %s", c.key, wif, c.wif)
+		}
+		decoded, err := decodeWIF(c.wif)
+		if err != nil || !bytes.Equal(decoded.Serialize(), key) {
+			t.Fatalf("%s decodes to %x: %v", c.wif, decoded.Serialize(), err)
+		}
+	}
+
+	// An uncompressed key, a bad checksum and nothing at all.
+	for _, wif := range []string{
+		"5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTJ",
+		"KwdMAjGmerYanjeui5SHS7JkmpZvVipYvB2LJGU1ZxJwYvP98618",
+		"",
+	} {
+		if _, err := decodeWIF(wif); err == nil {
+			t.Fatalf("%q was decoded", wif)
+		}
+	}
+}
+
+func TestImportPrivKeyRescan(t *testing.T) {
+	miner, payee := newWalletKeyPair(), newWalletKeyPair()
+	bc := newTestChain(t, miner.getAddress())
+	genesis := bc.GetBlockByHash(bc.tail)
+	spend := newTestSpend(t, miner, genesis.Transactions[0], 0, payee.getAddress())
+	block := processTestBlock(t, bc, genesis, miner.getAddress(), spend)
+	bc.db.Close()
+
+	cli := CLI{}
+	output := captureStdout(t, func() { cli.importPrivKey(encodeWIF(miner.PriKey), true) })
+	for _, want := range []string{
+		"The imported address is: " + miner.getAddress(),
+		"Found 3 transactions of " + miner.getAddress(),
+		"height: 1, txid: " + hex.EncodeToString(spend.TXID) + ", received: 0.00000000, sent: " + formatAmount(genesis.Transactions[0].TXOutputs[0].Value),
+		"height: 0, txid: " + hex.EncodeToString(genesis.Transactions[0].TXID),
+		"amount is: " + formatAmount(block.Transactions[0].TXOutputs[0].Value),
+	} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("the rescan printed %q, missing %q", output, want)
+		}
+	}
+
+	// Without rescan the chain isn't read; the key is only imported once.
+	output = captureStdout(t, func() { cli.importPrivKey(encodeWIF(payee.PriKey), false) })
+	if !strings.Contains(output, payee.getAddress()) || strings.Contains(output, "Found") {
+		t.Fatalf("the import without rescan printed %q", output)
+	}
+	output = captureStdout(t, func() { cli.importPrivKey(encodeWIF(payee.PriKey), true) })
+	if !strings.Contains(output, "already in the wallet") || strings.Contains(output, "Found") {
+		t.Fatalf("importing the key again printed %q", output)
+	}
+	wm := NewWalletManager()
+	if len(wm.Wallets) != 2 || wm.Wallets[miner.getAddress()] == nil || wm.Wallets[payee.getAddress()] == nil {
+		t.Fatalf("the wallet holds %v", wm.listAddresses())
+	}
+}
+
+func TestDumpPrivKeyOfLockedWallet(t *testing.T) {
+	chdirTemp(t)
+	wm := NewWalletManager()
+	address := wm.createWallet()
+	wif, err := wm.dumpPrivKey(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wm.encrypt("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wm = NewWalletManager()
+	if _, err := wm.dumpPrivKey(address); err == nil {
+		t.Fatal("the key of a locked wallet was dumped")
+	}
+	if _, err := wm.importPrivKey(encodeWIF(newWalletKeyPair().PriKey)); err == nil {
+		t.Fatal("a key was imported into a locked wallet")
+	}
+	t.Setenv(passphraseEnvVar, "wrong")
+	cli := CLI{}
+	output := captureStdout(t, func() { cli.dumpPrivKey(address) })
+	if strings.Contains(output, wif) || !strings.Contains(output, "Unlock the wallet err") {
+		t.Fatalf("dumpPrivKey with a wrong passphrase printed %q", output)
+	}
+
+	t.Setenv(passphraseEnvVar, "passphrase")
+	output = captureStdout(t, func() { cli.dumpPrivKey(address) })
+	if strings.TrimSpace(output) != wif {
+		t.Fatalf("dumpPrivKey of the unlocked wallet printed %q, want %s", output, wif)
+	}
+}
+
+// paddedP256PubKey returns the public key of priKey as X followed by Y, each padded
+// to keyFieldSize bytes.
+func paddedP256PubKey(priKey *ecdsa.PrivateKey) []byte {
+	pubKey := make([]byte, 2*keyFieldSize)
+	priKey.X.FillBytes(pubKey[:keyFieldSize])
+	priKey.Y.FillBytes(pubKey[keyFieldSize:])
+	return pubKey
+}
+
+func TestFixedWidthP256Encoding(t *testing.T) {
+	priKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := paddedP256PubKey(priKey)
+	w := newP256Wallet(priKey, pubKey)
+	hash := sha256.Sum256([]byte("message"))
+
+	// About one signature in 256 has an r with a leading zero byte, which only
+	// verifies because it is padded.
+	var signature []byte
+	for i := 0; ; i++ {
+		signature = w.sign(hash[:])
+		if signature[0] == 0 {
+			break
+		}
+		if i == 10000 {
+			t.Fatal("no signature with a short r was made")
+		}
+	}
+	if len(signature) != 2*keyFieldSize {
+		t.Fatalf("the signature has %d bytes", len(signature))
+	}
+	err = verifySignature(pubKey, signature, hash[:], blockVersion)
+	if err != nil {
+		t.Fatal("the padded signature with a short r doesn't verify:", err)
+	}
+
+	for _, c := range []struct {
+		name              string
+		pubKey, signature []byte
+	}{
+		{"an unpadded signature", pubKey, signature[1:]},
+		{"a long signature", pubKey, append(append([]byte{}, signature...), 0)},
+		{"an empty signature", pubKey, nil},
+		{"a short public key", pubKey[1:], signature},
+		{"a long public key", append(append([]byte{}, pubKey...), 0), signature},
+		{"an uncompressed SEC1 public key", append([]byte{4}, pubKey...), signature},
+	} {
+		for _, version := range []uint64{strictEncodingVersion, blockVersion} {
+			if verifySignature(c.pubKey, c.signature, hash[:], version) == nil {
+				t.Fatalf("%s verified in a block of version %d", c.name, version)
+			}
+		}
+	}
+	if _, err := decodePubKey(pubKey[:keyFieldSize], true); err == nil {
+		t.Fatal("half a public key was decoded")
+	}
+	if _, _, err := decodeSignature(make([]byte, 2*keyFieldSize+2), false); err == nil {
+		t.Fatal("a signature longer than two fields was decoded")
+	}
+}
+
+func TestMalformedSecp256k1SignaturesAreRejected(t *testing.T) {
+	w := newWalletKeyPair()
+	hash := sha256.Sum256([]byte("message"))
+	signature := w.sign(hash[:])
+	if len(signature) != 2*keyFieldSize {
+		t.Fatalf("the signature has %d bytes", len(signature))
+	}
+	order := btcec.S256().N.FillBytes(make([]byte, keyFieldSize))
+	badPrefix := append([]byte{5}, w.PubKey[1:]...)
+	for _, c := range []struct {
+		name              string
+		pubKey, signature []byte
+	}{
+		{"a short signature", w.PubKey, signature[1:]},
+		{"a long signature", w.PubKey, append(append([]byte{}, signature...), 0)},
+		{"r = 0", w.PubKey, append(make([]byte, keyFieldSize), signature[keyFieldSize:]...)},
+		{"s = n", w.PubKey, append(append([]byte{}, signature[:keyFieldSize]...), order...)},
+		{"a public key with a bad prefix", badPrefix, signature},
+		{"a truncated public key", w.PubKey[:btcec.PubKeyBytesLenCompressed-1], signature},
+	} {
+		if verifySignature(c.pubKey, c.signature, hash[:], blockVersion) == nil {
+			t.Fatalf("%s verified", c.name)
+		}
+	}
+	if verifySignature(w.PubKey, signature, hash[:], blockVersion) != nil {
+		t.Fatal("the valid signature doesn't verify")
+	}
+}
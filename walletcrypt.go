@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// An encrypted wallet file keeps the public keys in the clear, so that its
+// addresses can be listed while it is locked, and seals the concatenated 32-byte
+// private keys, followed by the seed of an HD wallet, with AES-256-GCM under a key
+// derived from the passphrase with scrypt. The public keys are authenticated as the
+// additional data of the seal. A public key that isn't 33 bytes long is the P-256
+// key of a wallet created before secp256k1 keys.
+const (
+	scryptN          = 1 << 15
+	scryptR          = 8
+	scryptP          = 1
+	maxScryptN       = 1 << 20
+	maxScryptR       = 32
+	maxScryptP       = 16
+	walletKeyLen     = 32
+	walletSaltLen    = 16
+	passphraseEnvVar = "WALLET_PASSPHRASE"
+)
+
+// walletEncryption is how an encrypted wallet was sealed. key is nil until the
+// wallet is unlocked.
+type walletEncryption struct {
+	salt    []byte
+	n, r, p int
+	nonce   []byte
+	sealed  []byte
+	pubKeys [][]byte
+	key     []byte
+}
+
+func deriveWalletKey(passphrase string, salt []byte, n, r, p int) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, n, r, p, walletKeyLen)
+}
+
+func newWalletAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newWalletEncryption derives a key from passphrase with a fresh salt.
+func newWalletEncryption(passphrase string) (*walletEncryption, error) {
+	if passphrase == "" {
+		return nil, errors.New("the passphrase can't be empty")
+	}
+	salt := make([]byte, walletSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveWalletKey(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	return &walletEncryption{salt: salt, n: scryptN, r: scryptR, p: scryptP, key: key}, nil
+}
+
+func (wm *WalletManager) isEncrypted() bool {
+	return wm.encryption != nil
+}
+
+func (wm *WalletManager) isLocked() bool {
+	return wm.encryption != nil && wm.encryption.key == nil
+}
+
+// seal fills the encrypted fields of data with the private keys of addresses and the seed.
+func (wm *WalletManager) seal(data *walletData, addresses []string) error {
+	enc := wm.encryption
+	if enc.key == nil {
+		return errors.New("the wallet is locked")
+	}
+	var plaintext []byte
+	for _, address := range addresses {
+		w := wm.Wallets[address]
+		data.PubKeys = append(data.PubKeys, w.PubKey)
+		plaintext = append(plaintext, w.privateKeyBytes()...)
+	}
+	plaintext = append(plaintext, wm.seed...)
+	aead, err := newWalletAEAD(enc.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	data.Salt, data.ScryptN, data.ScryptR, data.ScryptP = enc.salt, enc.n, enc.r, enc.p
+	data.Nonce = nonce
+	data.Encrypted = aead.Seal(nil, nonce, plaintext, bytes.Join(data.PubKeys, nil))
+	enc.nonce, enc.sealed, enc.pubKeys = data.Nonce, data.Encrypted, data.PubKeys
+	return nil
+}
+
+// loadEncrypted reads the encrypted fields of data; the wallets stay locked,
+// without private keys. The scrypt parameters are capped, so that a crafted wallet
+// file can't make unlocking take unbounded time and memory.
+func (wm *WalletManager) loadEncrypted(data *walletData) error {
+	n, r, p := data.ScryptN, data.ScryptR, data.ScryptP
+	if len(data.Salt) == 0 || n <= 1 || n&(n-1) != 0 || r <= 0 || p <= 0 {
+		return errors.New("the wallet file has invalid key derivation parameters")
+	}
+	if n > maxScryptN || r > maxScryptR || p > maxScryptP {
+		return fmt.Errorf("the wallet file asks for scrypt N=%d r=%d p=%d, more than N=%d r=%d p=%d",
+			n, r, p, maxScryptN, maxScryptR, maxScryptP)
+	}
+	for _, pubKey := range data.PubKeys {
+		var err error
+		if len(pubKey) == btcec.PubKeyBytesLenCompressed {
+			_, err = btcec.ParsePubKey(pubKey)
+		} else {
+			_, err = decodePubKey(pubKey, false)
+		}
+		if err != nil {
+			return fmt.Errorf("the wallet file holds an invalid public key: %v", err)
+		}
+		w := &wallet{PubKey: pubKey}
+		wm.Wallets[w.getAddress()] = w
+	}
+	wm.encryption = &walletEncryption{
+		salt:    data.Salt,
+		n:       data.ScryptN,
+		r:       data.ScryptR,
+		p:       data.ScryptP,
+		nonce:   data.Nonce,
+		sealed:  data.Encrypted,
+		pubKeys: data.PubKeys,
+	}
+	return nil
+}
+
+// unlock decrypts the private keys and the seed with passphrase.
+func (wm *WalletManager) unlock(passphrase string) error {
+	enc := wm.encryption
+	if enc == nil {
+		return errors.New("the wallet isn't encrypted")
+	}
+	key, err := deriveWalletKey(passphrase, enc.salt, enc.n, enc.r, enc.p)
+	if err != nil {
+		return err
+	}
+	return wm.unlockWithKey(key)
+}
+
+// unlockWithKey decrypts the private keys with a key derived from the passphrase,
+// which lets a long running process unlock the wallet again without keeping the
+// passphrase.
+func (wm *WalletManager) unlockWithKey(key []byte) error {
+	enc := wm.encryption
+	aead, err := newWalletAEAD(key)
+	if err != nil {
+		return err
+	}
+	if len(enc.nonce) != aead.NonceSize() {
+		return errors.New("the wallet file has an invalid nonce")
+	}
+	plaintext, err := aead.Open(nil, enc.nonce, enc.sealed, bytes.Join(enc.pubKeys, nil))
+	if err != nil {
+		return errors.New("the passphrase is incorrect")
+	}
+	keysLen := len(enc.pubKeys) * btcec.PrivKeyBytesLen
+	if len(plaintext) != keysLen && len(plaintext) != keysLen+hdSeedLen {
+		return errors.New("the wallet file holds a wrong number of private keys")
+	}
+	seed := plaintext[keysLen:]
+	for i, pubKey := range enc.pubKeys {
+		key := plaintext[i*btcec.PrivKeyBytesLen : (i+1)*btcec.PrivKeyBytesLen]
+		w := &wallet{PubKey: pubKey}
+		if len(pubKey) == btcec.PubKeyBytesLenCompressed {
+			priKey, _ := btcec.PrivKeyFromBytes(key)
+			w.PriKey = priKey
+			if !bytes.Equal(priKey.PubKey().SerializeCompressed(), pubKey) {
+				return fmt.Errorf("the private key of %s doesn't match its public key", w.getAddress())
+			}
+		} else {
+			w.p256Key, err = decodeP256Key(key, pubKey)
+			if err != nil {
+				return fmt.Errorf("the private key of %s: %v", w.getAddress(), err)
+			}
+		}
+		wm.Wallets[w.getAddress()] = w
+	}
+	if len(seed) != 0 {
+		wm.seed = seed
+	}
+	enc.key = key
+	return nil
+}
+
+// encrypt seals the private keys of an unencrypted wallet with passphrase.
+func (wm *WalletManager) encrypt(passphrase string) error {
+	if wm.isEncrypted() {
+		return errors.New("the wallet is already encrypted, use changePassphrase")
+	}
+	enc, err := newWalletEncryption(passphrase)
+	if err != nil {
+		return err
+	}
+	wm.encryption = enc
+	if !wm.saveFile() {
+		wm.encryption = nil
+		return errors.New("failed to save the wallet")
+	}
+	return nil
+}
+
+// changePassphrase seals the private keys again under newPassphrase, with a new salt.
+func (wm *WalletManager) changePassphrase(oldPassphrase, newPassphrase string) error {
+	err := wm.unlock(oldPassphrase)
+	if err != nil {
+		return err
+	}
+	enc, err := newWalletEncryption(newPassphrase)
+	if err != nil {
+		return err
+	}
+	old := wm.encryption
+	wm.encryption = enc
+	if !wm.saveFile() {
+		wm.encryption = old
+		return errors.New("failed to save the wallet")
+	}
+	return nil
+}
+
+// stdin is shared by every prompt so that no answer is lost in the buffer of another.
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassphrase returns the passphrase in WALLET_PASSPHRASE or asks for it with
+// prompt. A terminal doesn't echo the answer; otherwise a line is read from stdin.
+func readPassphrase(prompt string) (string, error) {
+	if passphrase, ok := os.LookupEnv(passphraseEnvVar); ok {
+		return passphrase, nil
+	}
+	return askPassphrase(prompt)
+}
+
+// askPassphrase always asks, for the passphrases being chosen.
+func askPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		passphrase, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(passphrase), err
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
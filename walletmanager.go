@@ -2,16 +2,47 @@ package main
 
 import (
 	"bytes"
-	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"sort"
+
+	"github.com/btcsuite/btcd/btcec/v2"
 )
 
 const walletFile = "wallet.dat"
 type WalletManager struct {
 	Wallets map[string]*wallet
+	// encryption is nil for a wallet whose private keys are stored in the clear.
+	encryption *walletEncryption
+	// seed is the BIP39 seed of an HD wallet, see hdwallet.go, and nextIndex the
+	// index of the next address to derive from it.
+	seed      []byte
+	nextIndex uint32
+}
+
+// walletData is the gob encoded content of walletFile; the addresses and public keys
+// are derived again from the 32-byte secp256k1 private keys. An encrypted wallet
+// stores its keys and seed in the fields described in walletcrypt.go instead of
+// PrivateKeys and Seed.
+type walletData struct {
+	PrivateKeys [][]byte
+	Seed        []byte
+	HDIndex     uint32
+	// P256Keys holds the private keys of a wallet created before secp256k1 keys, and
+	// P256PubKeys their public keys in the encoding their addresses hash.
+	P256Keys    [][]byte
+	P256PubKeys [][]byte
+
+	PubKeys   [][]byte
+	Encrypted []byte
+	Nonce     []byte
+	Salt      []byte
+	ScryptN   int
+	ScryptR   int
+	ScryptP   int
 }
 
 func NewWalletManager() *WalletManager {
@@ -24,6 +55,18 @@ func NewWalletManager() *WalletManager {
 }
 
 func (wm *WalletManager) createWallet() string {
+	if wm.isLocked() {
+		fmt.Println("The wallet is locked, unlock it to add a key")
+		return ""
+	}
+	if wm.isHD() {
+		address, err := wm.deriveAddress(wm.nextIndex)
+		if err != nil {
+			fmt.Println("Derive the next address err:", err)
+			return ""
+		}
+		return address
+	}
 	w := newWalletKeyPair()
 	if w == nil {
 		fmt.Println("newWalletKeyPair Failed")
@@ -38,10 +81,28 @@ func (wm *WalletManager) createWallet() string {
 }
 
 func (wm *WalletManager) saveFile() bool {
+	data := walletData{HDIndex: wm.nextIndex}
+	if wm.isEncrypted() {
+		err := wm.seal(&data, wm.listAddresses())
+		if err != nil {
+			fmt.Println("Seal the wallet err:", err)
+			return false
+		}
+	} else {
+		for _, address := range wm.listAddresses() {
+			w := wm.Wallets[address]
+			if w.p256Key != nil {
+				data.P256Keys = append(data.P256Keys, w.privateKeyBytes())
+				data.P256PubKeys = append(data.P256PubKeys, w.PubKey)
+				continue
+			}
+			data.PrivateKeys = append(data.PrivateKeys, w.privateKeyBytes())
+		}
+		data.Seed = wm.seed
+	}
 	var buffer bytes.Buffer
-	gob.Register(elliptic.P256())
 	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(wm)
+	err := encoder.Encode(&data)
 	if err != nil {
 		fmt.Println("encoder.Encode err:", err)
 		return false
@@ -64,16 +125,144 @@ func (wm *WalletManager) loadFile() bool {
 		fmt.Println("ioutil.ReadFile err:", err)
 		return false
 	}
-	gob.Register(elliptic.P256())
+	var data walletData
 	decoder := gob.NewDecoder(bytes.NewReader(content))
-	err = decoder.Decode(wm)
+	err = decoder.Decode(&data)
 	if err != nil {
-		fmt.Println("decoder.Decode err:", err)
+		legacyErr := wm.loadLegacyFile(content)
+		if legacyErr != nil {
+			fmt.Println("decoder.Decode err:", err)
+			fmt.Println("Load the file as a P-256 wallet err:", legacyErr)
+			return false
+		}
+		return true
+	}
+	wm.nextIndex = data.HDIndex
+	if data.Encrypted != nil {
+		err = wm.loadEncrypted(&data)
+		if err != nil {
+			fmt.Println("Load the encrypted wallet err:", err)
+			return false
+		}
+		return true
+	}
+	for _, key := range data.PrivateKeys {
+		if len(key) != btcec.PrivKeyBytesLen {
+			fmt.Printf("The wallet file holds a private key of %d bytes instead of %d\n", len(key), btcec.PrivKeyBytesLen)
+			return false
+		}
+		priKey, _ := btcec.PrivKeyFromBytes(key)
+		w := newWallet(priKey)
+		wm.Wallets[w.getAddress()] = w
+	}
+	if len(data.P256Keys) != len(data.P256PubKeys) {
+		fmt.Println("The wallet file holds a P-256 key without its public key")
+		return false
+	}
+	for i, key := range data.P256Keys {
+		priKey, err := decodeP256Key(key, data.P256PubKeys[i])
+		if err != nil {
+			fmt.Println("The wallet file holds an invalid P-256 key:", err)
+			return false
+		}
+		w := newP256Wallet(priKey, data.P256PubKeys[i])
+		wm.Wallets[w.getAddress()] = w
+	}
+	if data.Seed != nil && len(data.Seed) != hdSeedLen {
+		fmt.Printf("The wallet file holds a seed of %d bytes instead of %d\n", len(data.Seed), hdSeedLen)
 		return false
 	}
+	wm.seed = data.Seed
 	return true
 }
 
+// legacyWalletFile is walletFile as written before secp256k1 keys: the gob encoded
+// WalletManager holding an *ecdsa.PrivateKey on P-256 per address. Only the private
+// scalar is read; the public key and the curve, which gob stored as an interface
+// value, are skipped.
+type legacyWalletFile struct {
+	Wallets map[string]*struct {
+		PriKey *struct{ D *big.Int }
+		PubKey []byte
+	}
+}
+
+// loadLegacyFile reads the P-256 keys of a wallet file written before secp256k1 keys
+// and saves them in the current format. Their addresses stay the same, and the keys
+// keep signing for them with P-256.
+func (wm *WalletManager) loadLegacyFile(content []byte) error {
+	var legacy legacyWalletFile
+	decoder := gob.NewDecoder(bytes.NewReader(content))
+	err := decoder.Decode(&legacy)
+	if err != nil {
+		return err
+	}
+	for address, lw := range legacy.Wallets {
+		if lw == nil || lw.PriKey == nil || lw.PriKey.D == nil || lw.PriKey.D.BitLen() > 8*keyFieldSize {
+			return fmt.Errorf("%s has no valid private key", address)
+		}
+		priKey, err := decodeP256Key(lw.PriKey.D.FillBytes(make([]byte, keyFieldSize)), lw.PubKey)
+		if err != nil {
+			return fmt.Errorf("%s: %v", address, err)
+		}
+		w := newP256Wallet(priKey, lw.PubKey)
+		if w.getAddress() != address {
+			return fmt.Errorf("the public key of %s hashes to %s", address, w.getAddress())
+		}
+		wm.Wallets[address] = w
+	}
+	fmt.Printf("Convert the wallet file with %d P-256 keys to the current format\n", len(wm.Wallets))
+	if !wm.saveFile() {
+		return errors.New("failed to save the wallet")
+	}
+	return nil
+}
+
+// privateKeyBytes returns the 32-byte private key of w, of either curve.
+func (w *wallet) privateKeyBytes() []byte {
+	if w.p256Key != nil {
+		return w.p256Key.D.FillBytes(make([]byte, keyFieldSize))
+	}
+	return w.PriKey.Serialize()
+}
+
+// dumpPrivKey returns the private key of address in Wallet Import Format.
+func (wm *WalletManager) dumpPrivKey(address string) (string, error) {
+	w, ok := wm.Wallets[address]
+	if !ok {
+		return "", errors.New("the address isn't in the wallet")
+	}
+	if w.isLocked() {
+		return "", errors.New("the wallet is locked")
+	}
+	if w.p256Key != nil {
+		return "", errors.New("the address has a P-256 key, which Wallet Import Format can't hold")
+	}
+	return encodeWIF(w.PriKey), nil
+}
+
+// importPrivKey adds the private key wif in Wallet Import Format and returns its address.
+func (wm *WalletManager) importPrivKey(wif string) (string, error) {
+	if wm.isLocked() {
+		return "", errors.New("the wallet is locked")
+	}
+	priKey, err := decodeWIF(wif)
+	if err != nil {
+		return "", fmt.Errorf("invalid WIF private key: %v", err)
+	}
+	w := newWallet(priKey)
+	address := w.getAddress()
+	if _, ok := wm.Wallets[address]; ok {
+		return address, errors.New("the key is already in the wallet")
+	}
+	wm.Wallets[address] = w
+	if !wm.saveFile() {
+		delete(wm.Wallets, address)
+		return "", errors.New("failed to save the wallet")
+	}
+	return address, nil
+}
+
 func (wm *WalletManager) listAddresses() []string {
 	var addresses []string
 	for address := range wm.Wallets {
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The notification server streams chain events to WebSocket clients connected to
+// /ws, one JSON text message per event:
+//
+//	{"type":"blockconnected","hash":...,"height":...,"txids":[...]}
+//	{"type":"blockdisconnected","hash":...,"height":...,"txids":[...]}
+//	{"type":"mempooltx","tx":{...}}
+//
+// Each address query parameter, such as /ws?address=<A>&address=<B>, limits the
+// stream to transactions paying to or spending from one of the addresses; block
+// events then only list the matching txids and are skipped when there are none.
+// Transactions returned to the mempool by a reorganization are only announced as
+// part of the blockdisconnected event.
+const (
+	websocketGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	maxWebSocketPayload = 1 << 16
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsCloseNormal        = 1000
+	wsClosePolicy        = 1008
+	wsCloseProtocolError = 1002
+)
+
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket completes the opening handshake of RFC 6455 and takes over the
+// connection from the HTTP server.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "a WebSocket handshake is required", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "the connection can't be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("the response writer doesn't support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+// writeFrame sends payload as a single unmasked frame, as servers must.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	_, err := c.rw.Write(append(header, payload...))
+	if err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return c.writeFrame(wsOpClose, append(payload, reason...))
+}
+
+// readFrame reads one frame from the client, whose frames must be masked.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	_, err := io.ReadFull(c.rw, head[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	opcode := head[0] & 0x0f
+	if head[1]&0x80 == 0 {
+		return opcode, nil, errors.New("client frames must be masked")
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.rw, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.rw, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return opcode, nil, err
+	}
+	if length > maxWebSocketPayload {
+		return opcode, nil, fmt.Errorf("frame of %d bytes is too large", length)
+	}
+	var mask [4]byte
+	_, err = io.ReadFull(c.rw, mask[:])
+	if err != nil {
+		return opcode, nil, err
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.rw, payload)
+	if err != nil {
+		return opcode, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readLoop answers pings and the closing handshake; the client has nothing else to
+// say, so its data frames are ignored. It returns when the connection is closed.
+func (c *wsConn) readLoop() {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				c.writeClose(wsCloseProtocolError, err.Error())
+			}
+			return
+		}
+		switch opcode {
+		case wsOpPing:
+			c.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			c.writeClose(wsCloseNormal, "")
+			return
+		case wsOpContinuation, wsOpText, wsOpBinary, wsOpPong:
+		default:
+			c.writeClose(wsCloseProtocolError, "unknown opcode")
+			return
+		}
+	}
+}
+
+type wsEvent struct {
+	Type   EventType       `json:"type"`
+	Hash   string          `json:"hash,omitempty"`
+	Height uint64          `json:"height,omitempty"`
+	Txids  []string        `json:"txids,omitempty"`
+	Tx     *rpcTransaction `json:"tx,omitempty"`
+}
+
+// newWSEvent returns the message for event, or nil when no transaction of it touches
+// one of pubKeyHashes. An empty pubKeyHashes matches every event.
+func newWSEvent(event *Event, pubKeyHashes [][]byte) *wsEvent {
+	msg := wsEvent{Type: event.Type}
+	if event.Tx != nil {
+		if len(pubKeyHashes) != 0 && !event.Tx.touches(pubKeyHashes) {
+			return nil
+		}
+		msg.Tx = newRPCTransaction(event.Tx)
+		return &msg
+	}
+	msg.Hash = hex.EncodeToString(event.Block.Hash)
+	msg.Height = event.Block.Height
+	msg.Txids = []string{}
+	for _, tx := range event.Block.Transactions {
+		if len(pubKeyHashes) == 0 || tx.touches(pubKeyHashes) {
+			msg.Txids = append(msg.Txids, hex.EncodeToString(tx.TXID))
+		}
+	}
+	if len(pubKeyHashes) != 0 && len(msg.Txids) == 0 {
+		return nil
+	}
+	return &msg
+}
+
+func handleWebSocket(bus *EventBus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var pubKeyHashes [][]byte
+		for _, address := range r.URL.Query()["address"] {
+			if !isValidAddress(address) {
+				http.Error(w, fmt.Sprintf("invalid address %q", address), http.StatusBadRequest)
+				return
+			}
+			pubKeyHashes = append(pubKeyHashes, getPubKeyHashFromAddress(address))
+		}
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.conn.Close()
+		sub := bus.Subscribe()
+		defer sub.Unsubscribe()
+		fmt.Printf("WebSocket client %s connected with %d address filters\n", r.RemoteAddr, len(pubKeyHashes))
+
+		closed := make(chan struct{})
+		go func() {
+			conn.readLoop()
+			close(closed)
+		}()
+		for {
+			select {
+			case event, ok := <-sub.C:
+				if !ok {
+					conn.writeClose(wsClosePolicy, "the client fell too far behind")
+					return
+				}
+				msg := newWSEvent(event, pubKeyHashes)
+				if msg == nil {
+					continue
+				}
+				data, err := json.Marshal(msg)
+				if err != nil {
+					fmt.Println("Encode event err:", err)
+					continue
+				}
+				if conn.writeFrame(wsOpText, data) != nil {
+					return
+				}
+			case <-closed:
+				fmt.Printf("WebSocket client %s disconnected\n", r.RemoteAddr)
+				return
+			}
+		}
+	}
+}
+
+// startNotifier serves the /ws endpoint on localhost:port in the background; the
+// caller closes the returned server.
+func startNotifier(bus *EventBus, port int) (*http.Server, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", handleWebSocket(bus))
+	server := &http.Server{Handler: mux}
+	fmt.Printf("WebSocket notifications on ws://%s/ws\n", ln.Addr())
+	go server.Serve(ln)
+	return server, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWebSocket opens the handshake of RFC 6455 section 1.3 on path and returns the
+// connection with the server's response.
+func dialWebSocket(t *testing.T, server *httptest.Server, path string, version string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: %s\r\n\r\n", path, version)
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, response
+}
+
+// readServerFrame reads one unmasked frame of up to 64 KiB.
+func readServerFrame(t *testing.T, conn net.Conn, reader *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var head [2]byte
+	_, err := io.ReadFull(reader, head[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head[1]&0x80 != 0 {
+		t.Fatal("the server sent a masked frame")
+	}
+	length := int(head[1])
+	if length == 126 {
+		var ext [2]byte
+		_, err = io.ReadFull(reader, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	if err == nil {
+		_, err = io.ReadFull(reader, payload)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+func waitForSubscribers(t *testing.T, bus *EventBus, n int) {
+	t.Helper()
+	waitFor(t, "the WebSocket client to subscribe", func() bool {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		return len(bus.subscribers) == n
+	})
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	server := httptest.NewServer(handleWebSocket(newEventBus()))
+	defer server.Close()
+
+	_, _, response := dialWebSocket(t, server, "/ws", "13")
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("the handshake returned status %d", response.StatusCode)
+	}
+	// The accept value of the key in RFC 6455 section 1.3.
+	if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept is %q", accept)
+	}
+	if !headerContains(response.Header, "Upgrade", "websocket") || !headerContains(response.Header, "Connection", "upgrade") {
+		t.Fatalf("the handshake returned the headers %v", response.Header)
+	}
+
+	_, _, response = dialWebSocket(t, server, "/ws", "8")
+	if response.StatusCode != http.StatusUpgradeRequired || response.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Fatalf("an unsupported version returned status %d", response.StatusCode)
+	}
+	_, _, response = dialWebSocket(t, server, "/ws?address=1notanaddress", "13")
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("an invalid address returned status %d", response.StatusCode)
+	}
+	plain, err := server.Client().Get(server.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Body.Close()
+	if plain.StatusCode != http.StatusBadRequest {
+		t.Fatalf("a plain GET returned status %d", plain.StatusCode)
+	}
+}
+
+func TestWebSocketAddressFilter(t *testing.T) {
+	watched, other := newWalletKeyPair(), newWalletKeyPair()
+	bus := newEventBus()
+	server := httptest.NewServer(handleWebSocket(bus))
+	defer server.Close()
+	conn, reader, response := dialWebSocket(t, server, "/ws?address="+watched.getAddress(), "13")
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("the handshake returned status %d", response.StatusCode)
+	}
+	waitForSubscribers(t, bus, 1)
+
+	otherCoinbase := NewCoinbaseTx(other.getAddress(), "other", 1, 0)
+	watchedCoinbase := NewCoinbaseTx(watched.getAddress(), "watched", 2, 0)
+	bus.publish(&Event{Type: EventBlockConnected, Block: &Block{Hash: []byte{1}, Height: 1, Transactions: []*Transaction{otherCoinbase}}})
+	bus.publish(&Event{Type: EventMempoolTx, Tx: otherCoinbase})
+	bus.publish(&Event{Type: EventBlockConnected, Block: &Block{Hash: []byte{2}, Height: 2,
+		Transactions: []*Transaction{watchedCoinbase, otherCoinbase}}})
+	bus.publish(&Event{Type: EventBlockDisconnected, Block: &Block{Hash: []byte{2}, Height: 2,
+		Transactions: []*Transaction{watchedCoinbase, otherCoinbase}}})
+	bus.publish(&Event{Type: EventMempoolTx, Tx: watchedCoinbase})
+
+	// The first two events don't touch the address and are skipped.
+	for _, eventType := range []EventType{EventBlockConnected, EventBlockDisconnected} {
+		opcode, payload := readServerFrame(t, conn, reader)
+		var msg wsEvent
+		if opcode != wsOpText || json.Unmarshal(payload, &msg) != nil {
+			t.Fatalf("the server sent the frame %d %q", opcode, payload)
+		}
+		if msg.Type != eventType || msg.Hash != "02" || msg.Height != 2 ||
+			len(msg.Txids) != 1 || msg.Txids[0] != hex.EncodeToString(watchedCoinbase.TXID) {
+			t.Fatalf("the client got %s, want the %s event of block 02 listing only the watched coinbase", payload, eventType)
+		}
+	}
+	_, payload := readServerFrame(t, conn, reader)
+	var msg wsEvent
+	if json.Unmarshal(payload, &msg) != nil || msg.Type != EventMempoolTx || msg.Tx == nil || msg.Tx.Txid != hex.EncodeToString(watchedCoinbase.TXID) {
+		t.Fatalf("the client got %s, want the watched mempool transaction", payload)
+	}
+}